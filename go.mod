@@ -7,4 +7,5 @@ require (
 	github.com/gorilla/websocket v1.5.0
 	github.com/mattermost/mattermost-server/v6 v6.2.1
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 )
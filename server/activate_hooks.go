@@ -1,6 +1,13 @@
 package main
 
 import (
+	"os"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	root "github.com/mattermost/mattermost-plugin-outlook-presence"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/metrics"
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
 )
 
@@ -9,11 +16,89 @@ func (p *Plugin) OnActivate() error {
 		return err
 	}
 
+	nodeName, err := os.Hostname()
+	if err != nil {
+		nodeName = model.NewId()
+	}
+	p.nodeName = nodeName
+	p.eventOrder = newEventOrderer(p.nodeName)
+	p.clusterRequests = make(map[string]chan interface{})
+	p.presenceTrace = newPresenceTracer()
+
+	p.directory = newUserDirectory(p.API)
+	p.optOuts = newPresenceOptOuts()
+	p.policyMembership = newPolicyMembership()
+	p.overrides = newPresenceOverrides()
+	p.statusDamper = newStatusDamper()
+	p.aliases = newAliasCache()
+	if err = p.loadOptOuts(); err != nil {
+		p.API.LogError("Unable to load the users who opted out of sharing their presence", "Error", err.Error())
+	}
+	if err = p.loadOverrides(); err != nil {
+		p.API.LogError("Unable to load the presence overrides", "Error", err.Error())
+	}
+	p.metrics = metrics.New(p.nodeName)
+
+	if err = p.registerCommand(); err != nil {
+		return errors.Wrap(err, "failed to register the slash command")
+	}
+
 	// Initialize the router and websocket pool
 	p.router = p.InitAPI()
-	pool := websocket.NewPool()
-	go pool.Start(p.API)
+	pool := websocket.NewPool(p.nodeName, root.Manifest.Version, p.metrics)
+	pool.RPCHandler = p
+	pool.Start(p.API)
+	pool.SetBatchSettings(p.getConfiguration().getBatchSettings())
 	p.wsPool = pool
 
+	p.webhooks = newWebhookCache()
+	p.webhookDispatcher = newWebhookDispatcher(p)
+	p.webhookDispatcher.Start()
+
+	p.registry = newConnectionRegistry(p)
+	p.registry.Start()
+
+	p.directoryWatcher = newDirectoryWatcher(p)
+	p.directoryWatcher.Start()
+
+	p.overrideWatcher = newOverrideWatcher(p)
+	p.overrideWatcher.Start()
+
+	if p.getConfiguration().AliasLDAPAttribute != "" {
+		go func() {
+			if _, err := p.syncLDAPAliases(); err != nil {
+				p.API.LogWarn("Unable to synchronize the aliases from LDAP", "Error", err.Error())
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (p *Plugin) OnDeactivate() error {
+	if p.webhookDispatcher != nil {
+		p.webhookDispatcher.Stop()
+	}
+
+	if p.registry != nil {
+		p.registry.Stop()
+	}
+
+	if p.directoryWatcher != nil {
+		p.directoryWatcher.Stop()
+	}
+
+	if p.overrideWatcher != nil {
+		p.overrideWatcher.Stop()
+	}
+
+	if p.statusDamper != nil {
+		p.statusDamper.Stop()
+	}
+
+	if p.wsPool != nil {
+		p.wsPool.Close()
+	}
+
 	return nil
 }
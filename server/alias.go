@@ -0,0 +1,565 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// ldapAliasSeparator splits a multi-valued LDAP attribute like "proxyAddresses" into the separate addresses
+var ldapAliasSeparator = regexp.MustCompile(`[\s,;]+`)
+
+func normalizeAlias(alias string) string {
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	return strings.TrimPrefix(alias, "smtp:")
+}
+
+func getAliasKey(alias string) string {
+	hash := sha256.Sum256([]byte(alias))
+	return constants.KeyPrefixAlias + hex.EncodeToString(hash[:])[:40]
+}
+
+func getUserAliasesKey(userID string) string {
+	return constants.KeyPrefixUserAliases + userID
+}
+
+// getAlias returns the alias registered for the address, or nil if the address is not an alias.
+func (p *Plugin) getAlias(address string) (*serializer.Alias, error) {
+	var alias *serializer.Alias
+	if _, err := p.kvGetJSON(getAliasKey(normalizeAlias(address)), &alias); err != nil {
+		return nil, err
+	}
+
+	return alias, nil
+}
+
+// aliasCache keeps the aliases of the users in memory, so that they are not read from the KV store for every status change.
+// The servers notify each other when the aliases of a user change, and they are loaded again on the next status change.
+type aliasCache struct {
+	lock  sync.RWMutex
+	users map[string][]string
+
+	// generation is incremented whenever the aliases of a user are invalidated, so that the aliases loaded
+	// before are not cached
+	generation uint64
+}
+
+func newAliasCache() *aliasCache {
+	return &aliasCache{
+		users: make(map[string][]string),
+	}
+}
+
+// get returns the cached aliases of the user, along with the generation to cache the aliases with if they are not cached.
+func (c *aliasCache) get(userID string) ([]string, bool, uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	aliases, ok := c.users[userID]
+	return aliases, ok, c.generation
+}
+
+// set caches the aliases of the user, unless the aliases of any user were invalidated since they were loaded.
+func (c *aliasCache) set(userID string, aliases []string, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.generation == generation {
+		c.users[userID] = aliases
+	}
+}
+
+func (c *aliasCache) invalidate(userID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	delete(c.users, userID)
+}
+
+// getAliasesForUser returns all the aliases registered for the user.
+func (p *Plugin) getAliasesForUser(userID string) ([]string, error) {
+	var aliases []string
+	if _, err := p.kvGetJSON(getUserAliasesKey(userID), &aliases); err != nil {
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+// getCachedAliasesForUser returns the aliases of the user from the cache, loading them if they are not cached.
+// The returned aliases are shared and must not be modified.
+func (p *Plugin) getCachedAliasesForUser(userID string) ([]string, error) {
+	aliases, ok, generation := p.aliases.get(userID)
+	if ok {
+		return aliases, nil
+	}
+
+	aliases, err := p.getAliasesForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	p.aliases.set(userID, aliases, generation)
+	return aliases, nil
+}
+
+// setAliasesForUser stores the aliases of the user, and notifies the other servers so that they load them again.
+func (p *Plugin) setAliasesForUser(userID string, aliases []string) error {
+	var err error
+	if len(aliases) == 0 {
+		err = p.kvDelete(getUserAliasesKey(userID))
+	} else {
+		err = p.kvSetJSON(getUserAliasesKey(userID), aliases)
+	}
+
+	p.aliases.invalidate(userID)
+	if err != nil {
+		return err
+	}
+
+	if err = p.publishClusterEvent(constants.ClusterEventAliasesChanged, &serializer.AliasesChange{UserID: userID}); err != nil {
+		p.API.LogError("Unable to publish the aliases change to the other servers", "UserID", userID, "Error", err.Error())
+	}
+	return nil
+}
+
+func (p *Plugin) handleAliasesClusterEvent(data []byte) {
+	var change *serializer.AliasesChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	p.aliases.invalidate(change.UserID)
+}
+
+// saveAlias registers the alias for the user, moving it if it was registered for another user.
+func (p *Plugin) saveAlias(alias *serializer.Alias) error {
+	p.aliasLock.Lock()
+	defer p.aliasLock.Unlock()
+
+	alias.Alias = normalizeAlias(alias.Alias)
+	existing, err := p.getAlias(alias.Alias)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil && existing.UserID != alias.UserID {
+		if err = p.removeAliasFromUser(existing.UserID, existing.Alias); err != nil {
+			return err
+		}
+	}
+
+	if err = p.kvSetJSON(getAliasKey(alias.Alias), alias); err != nil {
+		return err
+	}
+
+	aliases, err := p.getAliasesForUser(alias.UserID)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range aliases {
+		if a == alias.Alias {
+			return nil
+		}
+	}
+
+	return p.setAliasesForUser(alias.UserID, append(aliases, alias.Alias))
+}
+
+// deleteAlias removes the alias. It returns false if the alias does not exist.
+func (p *Plugin) deleteAlias(address string) (bool, error) {
+	p.aliasLock.Lock()
+	defer p.aliasLock.Unlock()
+
+	alias, err := p.getAlias(address)
+	if err != nil || alias == nil {
+		return false, err
+	}
+
+	if err = p.kvDelete(getAliasKey(alias.Alias)); err != nil {
+		return false, err
+	}
+
+	return true, p.removeAliasFromUser(alias.UserID, alias.Alias)
+}
+
+func (p *Plugin) removeAliasFromUser(userID, address string) error {
+	aliases, err := p.getAliasesForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	remaining := make([]string, 0, len(aliases))
+	for _, a := range aliases {
+		if a != address {
+			remaining = append(remaining, a)
+		}
+	}
+
+	return p.setAliasesForUser(userID, remaining)
+}
+
+// listAliases returns all the registered aliases.
+func (p *Plugin) listAliases() ([]*serializer.Alias, error) {
+	keys, err := p.kvListKeys(constants.KeyPrefixUserAliases)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []*serializer.Alias{}
+	for _, key := range keys {
+		userAliases, userErr := p.getAliasesForUser(strings.TrimPrefix(key, constants.KeyPrefixUserAliases))
+		if userErr != nil {
+			return nil, userErr
+		}
+
+		for _, address := range userAliases {
+			alias, aliasErr := p.getAlias(address)
+			if aliasErr != nil {
+				return nil, aliasErr
+			}
+
+			if alias != nil {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+
+	return aliases, nil
+}
+
+// resolveUser returns the user having the given email address or alias.
+func (p *Plugin) resolveUser(address string) (*model.User, *model.AppError) {
+	alias, err := p.getAlias(address)
+	if err != nil {
+		p.API.LogDebug("Unable to get alias", "Alias", address, "Error", err.Error())
+	}
+
+	if alias != nil {
+		return p.API.GetUser(alias.UserID)
+	}
+
+	return p.API.GetUserByEmail(address)
+}
+
+// expandAliases returns the event along with a copy of it for every alias of the user,
+// so that the clients watching any of the user's addresses receive the status change.
+func (p *Plugin) expandAliases(event *serializer.UserStatus) []*serializer.UserStatus {
+	aliases, err := p.getCachedAliasesForUser(event.UserID)
+	if err != nil {
+		p.API.LogDebug("Unable to get aliases for user", "UserID", event.UserID, "Error", err.Error())
+	}
+
+	events := []*serializer.UserStatus{event}
+	for _, alias := range aliases {
+		if alias == strings.ToLower(event.Email) {
+			continue
+		}
+
+		aliasEvent := *event
+		aliasEvent.Email = alias
+		events = append(events, &aliasEvent)
+	}
+
+	return events
+}
+
+// syncLDAPAliases replaces the aliases imported from LDAP with the values of the configured LDAP attribute.
+// It returns the number of users whose aliases were synchronized.
+func (p *Plugin) syncLDAPAliases() (int, error) {
+	attribute := p.getConfiguration().AliasLDAPAttribute
+	if attribute == "" {
+		return 0, errors.New("the LDAP attribute for the aliases is not configured")
+	}
+
+	users, err := p.directory.getUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, user := range users {
+		if user.AuthService != model.UserAuthServiceLdap && user.AuthService != model.UserAuthServiceSaml {
+			continue
+		}
+
+		attributes, appErr := p.API.GetLDAPUserAttributes(user.Id, []string{attribute})
+		if appErr != nil {
+			if appErr.StatusCode == http.StatusNotImplemented {
+				return count, appErr
+			}
+
+			p.API.LogWarn("Unable to get LDAP attributes for user", "UserID", user.Id, "Error", appErr.Error())
+			continue
+		}
+
+		if err = p.replaceLDAPAliases(user.Id, ldapAliasSeparator.Split(attributes[attribute], -1)); err != nil {
+			p.API.LogWarn("Unable to save LDAP aliases for user", "UserID", user.Id, "Error", err.Error())
+			continue
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (p *Plugin) replaceLDAPAliases(userID string, addresses []string) error {
+	aliases, err := p.getAliasesForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range aliases {
+		alias, aliasErr := p.getAlias(address)
+		if aliasErr != nil {
+			return aliasErr
+		}
+
+		if alias != nil && alias.Source == constants.AliasSourceLDAP {
+			if _, err = p.deleteAlias(address); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, address := range addresses {
+		address = normalizeAlias(address)
+		if !model.IsValidEmail(address) {
+			continue
+		}
+
+		if err = p.saveAlias(&serializer.Alias{
+			Alias:  address,
+			UserID: userID,
+			Source: constants.AliasSourceLDAP,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importAliases registers the aliases from a CSV file having the alias and the user (ID, email or username) in each row.
+func (p *Plugin) importAliases(data io.Reader) (*serializer.AliasImportResult, error) {
+	reader := csv.NewReader(data)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	result := &serializer.AliasImportResult{Errors: []string{}}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return result, nil
+		}
+
+		if err != nil {
+			// A malformed row is skipped, while the other errors prevent reading the rest of the file
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, errors.Wrap(err, "failed to read the file")
+			}
+
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+
+		if line == 1 && strings.EqualFold(record[0], constants.Alias) {
+			continue
+		}
+
+		user, appErr := p.getUserByIDEmailOrUsername(record[1])
+		if appErr != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: unable to find user %s", line, record[1]))
+			continue
+		}
+
+		if !model.IsValidEmail(normalizeAlias(record[0])) {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: alias %s is not a valid email", line, record[0]))
+			continue
+		}
+
+		if owned, appErr := p.isEmailOfAnotherUser(record[0], user.Id); appErr != nil || owned {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: alias %s is the email of another user", line, record[0]))
+			continue
+		}
+
+		if err = p.saveAlias(&serializer.Alias{
+			Alias:  record[0],
+			UserID: user.Id,
+			Source: constants.AliasSourceCSV,
+		}); err != nil {
+			return nil, err
+		}
+		result.Imported++
+	}
+}
+
+// isEmailOfAnotherUser checks if the alias is the email of a user other than the one it is registered for.
+// Such aliases are rejected, as the aliases are resolved before the emails and would hide the other user.
+func (p *Plugin) isEmailOfAnotherUser(alias, userID string) (bool, *model.AppError) {
+	user, appErr := p.API.GetUserByEmail(normalizeAlias(alias))
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, appErr
+	}
+
+	return user.Id != userID, nil
+}
+
+func (p *Plugin) getUserByIDEmailOrUsername(value string) (*model.User, *model.AppError) {
+	switch {
+	case model.IsValidId(value):
+		return p.API.GetUser(value)
+	case strings.Contains(value, "@"):
+		return p.API.GetUserByEmail(value)
+	default:
+		return p.API.GetUserByUsername(value)
+	}
+}
+
+func (p *Plugin) handleGetAliases(w http.ResponseWriter, r *http.Request) {
+	aliases, err := p.listAliases()
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in getting aliases. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if userID := r.URL.Query().Get(constants.UserID); userID != "" {
+		userAliases := []*serializer.Alias{}
+		for _, alias := range aliases {
+			if alias.UserID == userID {
+				userAliases = append(userAliases, alias)
+			}
+		}
+		aliases = userAliases
+	}
+
+	p.writeJSON(w, aliases)
+}
+
+func (p *Plugin) handleCreateAlias(w http.ResponseWriter, r *http.Request) {
+	alias, err := serializer.AliasFromJSON(r.Body)
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in deserializing the request body. Error: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !model.IsValidEmail(normalizeAlias(alias.Alias)) {
+		p.writeError(w, "alias is not a valid email", http.StatusBadRequest)
+		return
+	}
+
+	if _, appErr := p.API.GetUser(alias.UserID); appErr != nil {
+		p.writeError(w, fmt.Sprintf("Unable to get user by id %s. Error: %s", alias.UserID, appErr.Error()), appErr.StatusCode)
+		return
+	}
+
+	if owned, appErr := p.isEmailOfAnotherUser(alias.Alias, alias.UserID); appErr != nil {
+		p.writeError(w, fmt.Sprintf("Unable to get user by email %s. Error: %s", alias.Alias, appErr.Error()), appErr.StatusCode)
+		return
+	} else if owned {
+		p.writeError(w, "alias is the email of another user", http.StatusBadRequest)
+		return
+	}
+
+	alias.Source = constants.AliasSourceAPI
+	if err = p.saveAlias(alias); err != nil {
+		p.writeError(w, fmt.Sprintf("Error in saving the alias. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, alias)
+}
+
+func (p *Plugin) handleDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	deleted, err := p.deleteAlias(mux.Vars(r)[constants.Alias])
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in deleting the alias. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if !deleted {
+		p.writeError(w, "alias not found", http.StatusNotFound)
+		return
+	}
+
+	writeStatusOK(w)
+}
+
+func (p *Plugin) handleImportAliases(w http.ResponseWriter, r *http.Request) {
+	result, err := p.importAliases(http.MaxBytesReader(w, r.Body, constants.MaxAliasImportSize))
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in importing the aliases. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, result)
+}
+
+func (p *Plugin) handleSyncLDAPAliases(w http.ResponseWriter, r *http.Request) {
+	count, err := p.syncLDAPAliases()
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in synchronizing the aliases from LDAP. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, map[string]int{"synchronized_users": count})
+}
+
+// LookupStatus returns the status of the user having the given email address or alias.
+func (p *Plugin) LookupStatus(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get(constants.Email)
+	if address == "" {
+		p.writeError(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	userStatus, appErr := p.lookupStatus(address)
+	if appErr != nil {
+		p.writeError(w, fmt.Sprintf("Unable to look up the status of %s. Error: %s", address, appErr.Error()), appErr.StatusCode)
+		return
+	}
+
+	p.writeJSON(w, userStatus)
+}
+
+// lookupStatus returns the status of the user having the email address, which can also be one of the user's aliases.
+func (p *Plugin) lookupStatus(address string) (*serializer.UserStatus, *model.AppError) {
+	user, appErr := p.resolveUser(address)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	status, appErr := p.API.GetUserStatus(user.Id)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	userStatus := p.newUserStatusFromModel(user, status)
+	if !p.applyPresencePolicy(user, userStatus) {
+		return nil, model.NewAppError("lookupStatus", "user not found", nil, "", http.StatusNotFound)
+	}
+
+	userStatus.Email = address
+	return userStatus, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// failingReader returns the data, and then fails on every read
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if n, _ := r.data.Read(b); n > 0 {
+		return n, nil
+	}
+	return 0, errors.New("connection reset")
+}
+
+func TestImportAliases(t *testing.T) {
+	user := &model.User{Id: model.NewId(), Email: "john@example.com", Username: "john"}
+	other := &model.User{Id: model.NewId(), Email: "jane@example.com", Username: "jane.doe"}
+
+	for _, test := range []struct {
+		name     string
+		data     io.Reader
+		imported int
+		errors   int
+		aliases  []string
+		fails    bool
+	}{
+		{
+			name:     "users by ID, email and username",
+			data:     strings.NewReader(fmt.Sprintf("alias,user\nA@old.com,%s\nb@old.com, john@example.com\nc@old.com,john\n", user.Id)),
+			imported: 3,
+			aliases:  []string{"a@old.com", "b@old.com", "c@old.com"},
+		},
+		{
+			name:     "unknown user and invalid alias",
+			data:     strings.NewReader("a@old.com,jane\nnot-an-email,john\nb@old.com,john\n"),
+			imported: 1,
+			errors:   2,
+			aliases:  []string{"b@old.com"},
+		},
+		{
+			name:     "malformed rows are skipped",
+			data:     strings.NewReader("a@old.com,john,extra\na@o\"ld.com,john\nc@old.com,john\n"),
+			imported: 1,
+			errors:   2,
+			aliases:  []string{"c@old.com"},
+		},
+		{
+			name:     "wrong number of fields",
+			data:     strings.NewReader("a@old.com\nb@old.com,john\n"),
+			imported: 1,
+			errors:   1,
+			aliases:  []string{"b@old.com"},
+		},
+		{
+			name:     "email of another user",
+			data:     strings.NewReader("jane@example.com,john\njohn@example.com,john\n"),
+			imported: 1,
+			errors:   1,
+			aliases:  []string{"john@example.com"},
+		},
+		{
+			name:  "read error",
+			data:  &failingReader{data: strings.NewReader("a@old.com,john\n")},
+			fails: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPlugin(newTestAPI(user, other))
+			p.aliases = newAliasCache()
+			result, err := p.importAliases(test.data)
+			if test.fails {
+				if err == nil {
+					t.Fatal("the import did not fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Imported != test.imported || len(result.Errors) != test.errors {
+				t.Errorf("got %d imported and errors %q, want %d imported and %d errors", result.Imported, result.Errors, test.imported, test.errors)
+			}
+
+			aliases, err := p.getAliasesForUser(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(aliases) != fmt.Sprint(test.aliases) {
+				t.Errorf("got aliases %v, want %v", aliases, test.aliases)
+			}
+		})
+	}
+}
+
+func TestHandleCreateAlias(t *testing.T) {
+	user := &model.User{Id: model.NewId(), Email: "john@example.com"}
+	other := &model.User{Id: model.NewId(), Email: "jane@example.com"}
+
+	for _, test := range []struct {
+		name       string
+		alias      string
+		statusCode int
+	}{
+		{
+			name:       "new address",
+			alias:      "john@old.com",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "email of the user",
+			alias:      "John@example.com",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "email of another user",
+			alias:      "Jane@example.com",
+			statusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPlugin(newTestAPI(user, other))
+			p.aliases = newAliasCache()
+
+			w := httptest.NewRecorder()
+			body := fmt.Sprintf(`{"alias": %q, "user_id": %q}`, test.alias, user.Id)
+			p.handleCreateAlias(w, httptest.NewRequest(http.MethodPost, "/aliases", strings.NewReader(body)))
+			if w.Code != test.statusCode {
+				t.Errorf("got status %d, want %d", w.Code, test.statusCode)
+			}
+		})
+	}
+}
+
+func TestExpandAliases(t *testing.T) {
+	user := &model.User{Id: model.NewId(), Email: "john@example.com"}
+	api := newTestAPI(user)
+	p := newTestPlugin(api)
+	p.aliases = newAliasCache()
+	expand := func() []string {
+		var emails []string
+		for _, event := range p.expandAliases(&serializer.UserStatus{UserID: user.Id, Email: user.Email}) {
+			emails = append(emails, event.Email)
+		}
+		return emails
+	}
+
+	if err := p.saveAlias(&serializer.Alias{Alias: "john@old.com", UserID: user.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if emails := fmt.Sprint(expand()); emails != "[john@example.com john@old.com]" {
+		t.Errorf("got %s, want the email and the alias", emails)
+	}
+
+	// The aliases are read from the cache until another server changes them
+	if err := p.kvSetJSON(getUserAliasesKey(user.Id), []string{"john@new.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if emails := fmt.Sprint(expand()); emails != "[john@example.com john@old.com]" {
+		t.Errorf("got %s, want the cached alias", emails)
+	}
+
+	if len(api.clusterEvents) != 1 || api.clusterEvents[0].Id != constants.ClusterEventAliasesChanged {
+		t.Fatalf("got cluster events %v, want the aliases change", api.clusterEvents)
+	}
+	p.OnPluginClusterEvent(nil, api.clusterEvents[0])
+	if emails := fmt.Sprint(expand()); emails != "[john@example.com john@new.com]" {
+		t.Errorf("got %s, want the changed alias", emails)
+	}
+}
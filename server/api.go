@@ -4,12 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
 
+	root "github.com/mattermost/mattermost-plugin-outlook-presence"
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
@@ -26,7 +32,36 @@ func (p *Plugin) InitAPI() *mux.Router {
 	// Add the custom plugin routes here
 	s.HandleFunc(constants.PathPublishStatusChanged, p.PublishStatusChanged).Methods(http.MethodPost)
 	s.HandleFunc(constants.PathGetStatusesForAllUsers, p.handleAuthRequired(p.GetStatusesForAllUsers)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathExportStatuses, p.handleAuthRequired(p.ExportStatuses)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathLookupStatus, p.handleAuthRequired(p.LookupStatus)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathPollStatus, p.handleAuthRequired(p.PollStatus)).Methods(http.MethodGet)
 	s.HandleFunc(constants.PathWebsocket, p.handleAuthRequired(p.serveWebSocket))
+	s.HandleFunc(constants.PathEvents, p.handleAuthRequired(p.serveEvents)).Methods(http.MethodGet)
+
+	// User routes
+	s.HandleFunc(constants.PathPresencePreference, p.handleUserRequired(p.handleGetPresencePreference)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathPresencePreference, p.handleUserRequired(p.handleUpdatePresencePreference)).Methods(http.MethodPut)
+
+	// Admin routes
+	s.HandleFunc(constants.PathAliases, p.handleAdminRequired(p.handleGetAliases)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathAliases, p.handleAdminRequired(p.handleCreateAlias)).Methods(http.MethodPost)
+	s.HandleFunc(constants.PathImportAliases, p.handleAdminRequired(p.handleImportAliases)).Methods(http.MethodPost)
+	s.HandleFunc(constants.PathSyncLDAPAliases, p.handleAdminRequired(p.handleSyncLDAPAliases)).Methods(http.MethodPost)
+	s.HandleFunc(constants.PathAlias, p.handleAdminRequired(p.handleDeleteAlias)).Methods(http.MethodDelete)
+	s.HandleFunc(constants.PathWebhooks, p.handleAdminRequired(p.handleGetWebhooks)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathWebhooks, p.handleAdminRequired(p.handleCreateWebhook)).Methods(http.MethodPost)
+	s.HandleFunc(constants.PathWebhook, p.handleAdminRequired(p.handleDeleteWebhook)).Methods(http.MethodDelete)
+	s.HandleFunc(constants.PathWebhookDeliveries, p.handleAdminRequired(p.handleGetWebhookDeliveries)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathWebhookDeadLetters, p.handleAdminRequired(p.handleGetWebhookDeadLetters)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathClients, p.handleAdminRequired(p.handleGetClients)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathClientsSummary, p.handleAdminRequired(p.handleGetClientsSummary)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathClient, p.handleAdminRequired(p.handleDisconnectClient)).Methods(http.MethodDelete)
+	s.HandleFunc(constants.PathEvaluatePolicy, p.handleAdminRequired(p.handleEvaluatePresencePolicy)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathExplainPresence, p.handleAdminRequired(p.handleExplainPresence)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathOverrides, p.handleAdminRequired(p.handleGetOverrides)).Methods(http.MethodGet)
+	s.HandleFunc(constants.PathOverride, p.handleAdminRequired(p.handleSetOverride)).Methods(http.MethodPut)
+	s.HandleFunc(constants.PathOverride, p.handleAdminRequired(p.handleRemoveOverride)).Methods(http.MethodDelete)
+	s.HandleFunc(constants.PathMetrics, p.handleAdminRequired(p.metrics.Handler().ServeHTTP)).Methods(http.MethodGet)
 
 	// 404 handler
 	r.Handle("{anything:.*}", http.NotFoundHandler())
@@ -45,22 +80,198 @@ func (p *Plugin) handleAuthRequired(handleFunc func(w http.ResponseWriter, r *ht
 	}
 }
 
+// handleUserRequired verifies if provided request is performed by a logged-in user.
+func (p *Plugin) handleUserRequired(handleFunc func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(constants.HeaderMattermostUserID) == "" {
+			p.writeError(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		handleFunc(w, r)
+	}
+}
+
+// handleAdminRequired verifies if provided request is performed by a logged-in system admin.
+func (p *Plugin) handleAdminRequired(handleFunc func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get(constants.HeaderMattermostUserID)
+		if userID == "" {
+			p.writeError(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+			p.writeError(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+
+		handleFunc(w, r)
+	}
+}
+
 func (p *Plugin) serveWebSocket(w http.ResponseWriter, r *http.Request) {
-	connection, err := websocket.CreateConnection(w, r)
+	scope, err := parseScope(r)
 	if err != nil {
-		p.writeError(w, fmt.Sprintf("Error in creating websocket connection. Error: %s", err.Error()), http.StatusInternalServerError)
+		p.writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	client := &websocket.Client{
-		Conn: connection,
-		Pool: p.wsPool,
+	subscription, scopeErr := p.getScopeUserIDs(scope)
+	if scopeErr != nil {
+		p.writeError(w, fmt.Sprintf("failed to get members. Error: %s", scopeErr.Error()), scopeErr.StatusCode)
+		return
+	}
+
+	compression := p.getConfiguration().getCompressionSettings()
+	connection, err := websocket.CreateConnection(w, r, compression)
+	if errors.Is(err, websocket.ErrUnsupportedProtocol) {
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in creating websocket connection. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
 	}
 
+	version := websocket.ProtocolVersion(connection)
+	writer := websocket.NewConnWriter(connection, version >= websocket.ProtocolVersion2, compression.Threshold)
+	go func() {
+		if err := writer.Serve(); err != nil {
+			p.metrics.IncWriteErrors()
+			p.API.LogDebug("Error in writing to the websocket.", "Error", err.Error())
+		}
+	}()
+
+	client := websocket.NewClient(r, websocket.ClientTypeWebsocket, constants.CredentialWebhookSecret, writer, p.wsPool)
+	client.Conn = connection
+	client.ProtocolVersion = version
+	client.Scope = scope
+	client.Subscription = subscription
+
 	p.RegisterClient(client)
 	client.Read(p.API)
 }
 
+// serveEvents streams the status changes as Server-Sent Events, for the clients which can't use the websocket.
+func (p *Plugin) serveEvents(w http.ResponseWriter, r *http.Request) {
+	scope, err := parseScope(r)
+	if err != nil {
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subscription, scopeErr := p.getScopeUserIDs(scope)
+	if scopeErr != nil {
+		p.writeError(w, fmt.Sprintf("failed to get members. Error: %s", scopeErr.Error()), scopeErr.StatusCode)
+		return
+	}
+
+	writer := websocket.NewSSEWriter()
+	client := websocket.NewClient(r, websocket.ClientTypeSSE, constants.CredentialWebhookSecret, writer, p.wsPool)
+	client.Scope = scope
+	client.Subscription = subscription
+	client.LastEventID = r.Header.Get(constants.HeaderLastEventID)
+
+	resume := p.RegisterClient(client)
+	defer func() {
+		p.wsPool.Unregister(client)
+	}()
+
+	if err = writer.Serve(w, r, constants.SSEKeepaliveInterval, resume); err != nil {
+		p.API.LogDebug("Error in writing the Server-Sent Events stream.", "Error", err.Error())
+	}
+}
+
+// PollStatus waits until there are status changes after the cursor or the timeout elapses, for the clients which can only make plain HTTP requests.
+// A request without a cursor returns the cursor to use for the next request, and a request with a cursor
+// whose status changes are not known anymore is rejected.
+func (p *Plugin) PollStatus(w http.ResponseWriter, r *http.Request) {
+	timeout, err := parseIntParamFromURL(r.URL, constants.Timeout, constants.DefaultPollTimeout)
+	if err != nil {
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if timeout < 0 || timeout > constants.MaxPollTimeout {
+		timeout = constants.MaxPollTimeout
+	}
+
+	scope, err := parseScope(r)
+	if err != nil {
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subscription, scopeErr := p.getScopeUserIDs(scope)
+	if scopeErr != nil {
+		p.writeError(w, fmt.Sprintf("failed to get members. Error: %s", scopeErr.Error()), scopeErr.StatusCode)
+		return
+	}
+
+	response := &serializer.PollResponse{
+		Events: []*serializer.UserStatus{},
+		Cursor: r.URL.Query().Get(constants.Cursor),
+	}
+
+	if response.Cursor == "" {
+		response.Cursor = p.wsPool.LastEventID()
+		p.writeJSON(w, response)
+		return
+	}
+
+	writer := websocket.NewChannelWriter(websocket.HistorySize)
+	client := websocket.NewClient(r, websocket.ClientTypePoll, constants.CredentialWebhookSecret, writer, p.wsPool)
+	client.Scope = scope
+	client.Subscription = subscription
+	client.LastEventID = response.Cursor
+
+	resume := p.RegisterClient(client)
+	defer func() {
+		p.wsPool.Unregister(client)
+	}()
+
+	// The status changes after the cursor are not known anymore, so the client must fetch all the statuses again
+	if resume.Resync {
+		p.writeError(w, "The cursor has expired. Fetch the statuses again and request a new cursor.", http.StatusGone)
+		return
+	}
+
+	response.Cursor = resume.LastEventID
+	for _, event := range resume.Events {
+		response.Events = append(response.Events, event.Data)
+	}
+
+	// Wait for the next event, unless there are events to replay
+	if len(response.Events) == 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Second)
+		defer timer.Stop()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-writer.Done():
+			return
+		case <-timer.C:
+		case event := <-writer.Events():
+			response.Events = append(response.Events, event.Data)
+			response.Cursor = event.ID
+		}
+	}
+
+	// Return all the events which are already queued in the same response
+	for {
+		select {
+		case event := <-writer.Events():
+			response.Events = append(response.Events, event.Data)
+			response.Cursor = event.ID
+		default:
+			p.writeJSON(w, response)
+			return
+		}
+	}
+}
+
 func (p *Plugin) PublishStatusChanged(w http.ResponseWriter, r *http.Request) {
 	statusChangedEvent, err := serializer.UserStatusFromJSON(r.Body)
 	if err != nil {
@@ -79,52 +290,151 @@ func (p *Plugin) PublishStatusChanged(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	statusChangedEvent.Email = user.Email
-
-	// Broadcasting the event here only works for the current cluster, so to broadcast it for other clusters,
-	// we are publishing a cluster event and that event will be handled by all the other clusters (not the current cluster)
-	p.BroadcastEvent(statusChangedEvent)
+	p.metrics.IncEventsReceived()
+	c := getPluginContext(r)
+	trace := &serializer.PublishTrace{
+		Status:        statusChangedEvent.Status,
+		SessionID:     c.SessionId,
+		RequestUserID: r.Header.Get(constants.HeaderMattermostUserID),
+		IPAddress:     c.IPAddress,
+		UserAgent:     c.UserAgent,
+	}
+	defer p.presenceTrace.recordPublish(user.Id, trace)
 
-	eventBytes, marshalErr := json.Marshal(statusChangedEvent)
-	if marshalErr != nil {
-		p.API.LogDebug("Error in marshaling the \"status changed\" event", "Error", marshalErr.Error())
+	// The status changes of the users who are always reported as offline, are omitted or have their status overridden
+	// are not published, as they would reveal the activity of the users without changing what the clients are told
+	decision := p.evaluatePresencePolicy(user, statusChangedEvent.Status)
+	trace.SharedStatus = decision.Status
+	if decision.Omitted || decision.Action == serializer.PolicyActionOffline || decision.Action == serializer.PolicyActionOverride {
 		writeStatusOK(w)
 		return
 	}
 
-	if err := p.API.PublishPluginClusterEvent(model.PluginClusterEvent{
-		Id:   constants.ClusterEvent,
-		Data: eventBytes,
-	}, model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable}); err != nil {
-		p.API.LogDebug("Error in publishing the event to clusters", "Error", err.Error())
+	// The changes which must last for a minimum time are held back, and published once the time elapses.
+	// The status shown before the plugin was started is loaded first, so that its time is kept if the status did not change.
+	p.loadShownStatus(user.Id)
+	publish, pending := p.statusDamper.observe(user.Id, decision.Status, p.getConfiguration().getDwellTime, model.GetMillis())
+
+	// The last activity is only fetched if the client did not send it and the change is published or held back
+	lastActivityAt := statusChangedEvent.LastActivityAt
+	if lastActivityAt == 0 && (publish || (pending != nil && pending.Status != "")) {
+		if userStatus, appErr := p.API.GetUserStatus(user.Id); appErr == nil {
+			lastActivityAt = userStatus.LastActivityAt
+		}
+	}
+
+	if pending != nil {
+		trace.DampedUntil = pending.Until
+		if pending.Status != "" {
+			pending.RawStatus = statusChangedEvent.Status
+			pending.LastActivityAt = lastActivityAt
+		}
+		p.holdStatus(pending)
+	}
+
+	if publish {
+		trace.Published = true
+		if trace.EventID, err = p.publishStatus(user, decision.Status, lastActivityAt); err != nil {
+			trace.ClusterError = err.Error()
+			p.API.LogDebug("Error in publishing the event to clusters", "Error", err.Error())
+		}
 	}
 
 	writeStatusOK(w)
 }
 
+// publishStatus sends a status change of the user to the clients connected to all the servers and to the webhook targets.
+// It returns the ID of the event sent to the other servers.
+func (p *Plugin) publishStatus(user *model.User, status string, lastActivityAt int64) (string, error) {
+	statusChangedEvent := p.newUserStatus(user, status)
+	statusChangedEvent.LastActivityAt = lastActivityAt
+	_, statusChangedEvent.StatusSince = p.shownStatus(user.Id, status)
+	p.saveShownStatus(user.Id, status, statusChangedEvent.StatusSince)
+	clusterEvent := p.eventOrder.stamp(statusChangedEvent)
+
+	// Broadcasting the event here only works for the current cluster, so to broadcast it for other clusters,
+	// we are publishing a cluster event and that event will be handled by all the other clusters (not the current cluster)
+	p.broadcastEventAt(statusChangedEvent, clusterEvent.Timestamp)
+	p.publishStatusWebhookEvent(statusChangedEvent)
+
+	return clusterEvent.ID, p.publishClusterEvent(constants.ClusterEvent, clusterEvent)
+}
+
 func (p *Plugin) GetStatusesForAllUsers(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	config := p.getConfiguration()
+	perPage, err := parseIntParamFromURL(r.URL, constants.PerPage, config.PerPageStatuses)
+	if err != nil {
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if perPage <= 0 {
+		p.writeError(w, "per_page must be greater than 0", http.StatusBadRequest)
+		return
+	}
+
+	if perPage > config.MaxPerPageStatuses {
+		perPage = config.MaxPerPageStatuses
+	}
+
 	page, err := parseIntParamFromURL(r.URL, constants.Page, constants.DefaultPage)
 	if err != nil {
 		p.writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	users, userErr := p.API.GetUsers(&model.UserGetOptions{
-		Active:  true,
-		Page:    page,
-		PerPage: p.getConfiguration().PerPageStatuses,
-	})
-	if userErr != nil {
-		p.writeError(w, fmt.Sprintf("failed to get users. Error: %s", userErr.Error()), userErr.StatusCode)
+	if page < 0 {
+		p.writeError(w, "page must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	// The index of the first user of the page must not overflow
+	if page > maxInt/perPage {
+		p.writeError(w, "page is too large", http.StatusBadRequest)
+		return
+	}
+
+	cursor := r.URL.Query().Get(constants.Cursor)
+	if cursor != "" && !model.IsValidId(cursor) {
+		p.writeError(w, "cursor is not valid", http.StatusBadRequest)
+		return
+	}
+
+	scope, err := parseScope(r)
+	if err != nil {
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scopeUserIDs, scopeErr := p.getScopeUserIDs(scope)
+	if scopeErr != nil {
+		p.writeError(w, fmt.Sprintf("failed to get members. Error: %s", scopeErr.Error()), scopeErr.StatusCode)
 		return
 	}
 
+	allUsers, dirErr := p.directory.getUsers()
+	if dirErr != nil {
+		p.writeError(w, fmt.Sprintf("failed to get users. Error: %s", dirErr.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	allUsers = p.filterOmittedUsers(filterUsersInScope(allUsers, scopeUserIDs))
+
+	// The "page" query param is still supported for the clients which do not use the cursor
+	startIndex := page * perPage
+	if cursor != "" {
+		startIndex = cursorIndex(allUsers, cursor)
+	}
+
+	users, nextCursor := pageUsers(allUsers, startIndex, perPage)
+
 	userStatusArr := make([]*serializer.UserStatus, len(users))
 	userIds := make([]string, len(users))
-	userIDEmailMap := make(map[string]string)
+	userMap := make(map[string]*model.User)
 	for index, user := range users {
 		userIds[index] = user.Id
-		userIDEmailMap[user.Id] = user.Email
+		userMap[user.Id] = user
 	}
 
 	statusArr, statusErr := p.API.GetUserStatusesByIds(userIds)
@@ -134,11 +444,17 @@ func (p *Plugin) GetStatusesForAllUsers(w http.ResponseWriter, r *http.Request)
 	}
 
 	for index, status := range statusArr {
-		userStatusArr[index] = &serializer.UserStatus{
-			UserID: status.UserId,
-			Email:  userIDEmailMap[status.UserId],
-			Status: status.Status,
-		}
+		user := userMap[status.UserId]
+		userStatusArr[index] = p.newUserStatusFromModel(user, status)
+
+		// The omitted users were filtered out before paging, so the status is only replaced here
+		p.applyPresencePolicy(user, userStatusArr[index])
+	}
+
+	w.Header().Set(constants.HeaderTotalCount, strconv.Itoa(len(allUsers)))
+	if nextCursor != "" {
+		w.Header().Set(constants.HeaderNextCursor, nextCursor)
+		w.Header().Set(constants.HeaderLink, fmt.Sprintf("<%s>; rel=\"next\"", p.getNextPageURL(r.URL, nextCursor, perPage)))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -148,9 +464,28 @@ func (p *Plugin) GetStatusesForAllUsers(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if _, wErr := w.Write(response); wErr != nil {
-		p.writeError(w, wErr.Error(), http.StatusInternalServerError)
+	if wErr := p.writeEncoded(w, r, response); wErr != nil {
+		p.API.LogError("Error in writing the response", "Error", wErr.Error())
 	}
+
+	p.metrics.ObserveStatusRequest(time.Since(start), len(userStatusArr))
+}
+
+// getNextPageURL returns the absolute URL of the next page for a paginated API.
+// The secret is not included in the URL, so the client has to add it again.
+func (p *Plugin) getNextPageURL(u *url.URL, nextCursor string, perPage int) string {
+	query := u.Query()
+	query.Del("secret")
+	query.Del(constants.Page)
+	query.Set(constants.Cursor, nextCursor)
+	query.Set(constants.PerPage, strconv.Itoa(perPage))
+
+	siteURL := ""
+	if config := p.API.GetConfig(); config != nil && config.ServiceSettings.SiteURL != nil {
+		siteURL = strings.TrimSuffix(*config.ServiceSettings.SiteURL, "/")
+	}
+
+	return fmt.Sprintf("%s/plugins/%s%s?%s", siteURL, root.Manifest.Id, u.Path, query.Encode())
 }
 
 // handleStaticFiles handles the static files under the assets directory.
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// clientsRequest is sent to the other servers in the cluster to get their connected clients
+type clientsRequest struct {
+	RequestID string `json:"request_id"`
+}
+
+// clientsReport is the response of a server to a clientsRequest
+type clientsReport struct {
+	RequestID string                   `json:"request_id"`
+	Clients   []*serializer.ClientInfo `json:"clients"`
+}
+
+type disconnectClientRequest struct {
+	ClientID string `json:"client_id"`
+}
+
+func (p *Plugin) isClusterEnabled() bool {
+	config := p.API.GetConfig()
+	return config != nil && config.ClusterSettings.Enable != nil && *config.ClusterSettings.Enable
+}
+
+// listClusterClients returns the clients connected to all the servers in the cluster.
+// The other servers are asked for their clients through a cluster event, and their responses are awaited for a fixed time,
+// as the number of servers in the cluster is not known.
+func (p *Plugin) listClusterClients() []*serializer.ClientInfo {
+	clients := p.wsPool.ListClients()
+	if !p.isClusterEnabled() {
+		return clients
+	}
+
+	requestID := model.NewId()
+	if err := p.awaitClusterReports(requestID, constants.ClusterEventClientsRequested, &clientsRequest{RequestID: requestID}, func(report interface{}) {
+		clients = append(clients, report.([]*serializer.ClientInfo)...)
+	}); err != nil {
+		p.API.LogError("Error in requesting the clients from the other servers", "Error", err.Error())
+	}
+
+	return clients
+}
+
+// awaitClusterReports publishes a request to the other servers and passes their reports for the request to handleReport,
+// until the fixed time for which the reports are awaited elapses.
+func (p *Plugin) awaitClusterReports(requestID, eventID string, request interface{}, handleReport func(report interface{})) error {
+	reports := make(chan interface{}, constants.ClusterReportsBufferSize)
+	p.clusterRequestsLock.Lock()
+	p.clusterRequests[requestID] = reports
+	p.clusterRequestsLock.Unlock()
+
+	defer func() {
+		p.clusterRequestsLock.Lock()
+		delete(p.clusterRequests, requestID)
+		p.clusterRequestsLock.Unlock()
+	}()
+
+	if err := p.publishClusterEvent(eventID, request); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(constants.ClusterRequestTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case report := <-reports:
+			handleReport(report)
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// deliverClusterReport passes the report of another server to the pending request, if it was made by this server.
+func (p *Plugin) deliverClusterReport(requestID string, report interface{}) {
+	p.clusterRequestsLock.Lock()
+	defer p.clusterRequestsLock.Unlock()
+
+	if reports, ok := p.clusterRequests[requestID]; ok {
+		select {
+		case reports <- report:
+		default:
+		}
+	}
+}
+
+// handleClientsRequested reports the clients connected to this server to the server which requested them.
+func (p *Plugin) handleClientsRequested(data []byte) {
+	var request *clientsRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	if err := p.publishClusterEvent(constants.ClusterEventClientsReported, &clientsReport{
+		RequestID: request.RequestID,
+		Clients:   p.wsPool.ListClients(),
+	}); err != nil {
+		p.API.LogError("Error in reporting the clients to the other servers", "Error", err.Error())
+	}
+}
+
+// handleClientsReported passes the clients reported by another server to the pending request, if it was made by this server.
+func (p *Plugin) handleClientsReported(data []byte) {
+	var report *clientsReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	p.deliverClusterReport(report.RequestID, report.Clients)
+}
+
+func (p *Plugin) handleDisconnectClientRequested(data []byte) {
+	var request *disconnectClientRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	p.wsPool.DisconnectClient(request.ClientID)
+}
+
+func (p *Plugin) handleGetClients(w http.ResponseWriter, r *http.Request) {
+	p.writeJSON(w, p.listClusterClients())
+}
+
+func (p *Plugin) handleDisconnectClient(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)[constants.ClientID]
+	if !model.IsValidId(clientID) {
+		p.writeError(w, "client id is not valid", http.StatusBadRequest)
+		return
+	}
+
+	if p.wsPool.DisconnectClient(clientID) {
+		writeStatusOK(w)
+		return
+	}
+
+	if !p.isClusterEnabled() {
+		p.writeError(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	// The client might be connected to another server, which disconnects it without reporting back,
+	// so the response only tells that the disconnection was requested
+	if err := p.publishClusterEvent(constants.ClusterEventDisconnectClient, &disconnectClientRequest{ClientID: clientID}); err != nil {
+		p.writeError(w, fmt.Sprintf("Error in disconnecting the client. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte(model.MapToJSON(map[string]string{model.STATUS: "disconnect requested"})))
+}
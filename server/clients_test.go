@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+)
+
+func TestHandleDisconnectClient(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		clientID       string
+		clusterEnabled bool
+		statusCode     int
+		clusterEvents  int
+	}{
+		{
+			name:       "invalid client ID",
+			clientID:   "invalid",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "client not found without a cluster",
+			clientID:   model.NewId(),
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:           "disconnection requested from the other servers",
+			clientID:       model.NewId(),
+			clusterEnabled: true,
+			statusCode:     http.StatusAccepted,
+			clusterEvents:  1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			api := newTestAPI()
+			api.config = &model.Config{}
+			api.config.ClusterSettings.Enable = model.NewBool(test.clusterEnabled)
+			p := newTestBroadcastPlugin(t, api, &configuration{})
+
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/clients/"+test.clientID, nil), map[string]string{constants.ClientID: test.clientID})
+			p.handleDisconnectClient(w, r)
+
+			if w.Code != test.statusCode {
+				t.Errorf("got status %d, want %d", w.Code, test.statusCode)
+			}
+			if len(api.clusterEvents) != test.clusterEvents {
+				t.Errorf("got %d cluster events, want %d", len(api.clusterEvents), test.clusterEvents)
+			}
+		})
+	}
+}
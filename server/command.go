@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+func (p *Plugin) registerCommand() error {
+	autocompleteData := model.NewAutocompleteData(constants.CommandTrigger, "[subcommand]", "Choose whether your presence is shared with Outlook and the other external clients")
+	autocompleteData.AddCommand(model.NewAutocompleteData(constants.SubcommandOptOut, "", "Stop sharing your presence with the external clients"))
+	autocompleteData.AddCommand(model.NewAutocompleteData(constants.SubcommandOptIn, "", "Share your presence with the external clients again"))
+	autocompleteData.AddCommand(model.NewAutocompleteData(constants.SubcommandStatus, "", "Show whether your presence is shared with the external clients"))
+
+	override := model.NewAutocompleteData(constants.SubcommandOverride, "[set|remove|list]", "Override the status of a user shown by the external clients")
+	override.RoleID = model.SystemAdminRoleId
+	override.AddCommand(model.NewAutocompleteData(constants.SubcommandOverrideSet, "@username status until [reason]", "Override the status of the user until a date (YYYY-MM-DD) or for a duration (like 36h or 14d)"))
+	override.AddCommand(model.NewAutocompleteData(constants.SubcommandOverrideRemove, "@username", "Remove the override of the user"))
+	override.AddCommand(model.NewAutocompleteData(constants.SubcommandOverrideList, "", "List the overrides"))
+	autocompleteData.AddCommand(override)
+
+	return p.API.RegisterCommand(&model.Command{
+		Trigger:          constants.CommandTrigger,
+		DisplayName:      "Outlook Presence",
+		Description:      "Choose whether your presence is shared with Outlook and the other external clients.",
+		AutoComplete:     true,
+		AutoCompleteDesc: fmt.Sprintf("Available commands: %s, %s, %s, %s (system admins only)", constants.SubcommandOptOut, constants.SubcommandOptIn, constants.SubcommandStatus, constants.SubcommandOverride),
+		AutoCompleteHint: "[subcommand]",
+		AutocompleteData: autocompleteData,
+	})
+}
+
+func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	fields := strings.Fields(args.Command)
+	subcommand := ""
+	if len(fields) > 1 {
+		subcommand = fields[1]
+	}
+
+	switch subcommand {
+	case constants.SubcommandOptOut, constants.SubcommandOptIn:
+		optedOut := subcommand == constants.SubcommandOptOut
+		if err := p.setPresenceOptOut(args.UserId, optedOut); err != nil {
+			p.API.LogError("Unable to save the presence preference", "UserID", args.UserId, "Error", err.Error())
+			return ephemeralResponse("Unable to save your preference. Please try again later."), nil
+		}
+
+		if optedOut {
+			return ephemeralResponse("Your presence is no longer shared with the external clients."), nil
+		}
+		return ephemeralResponse("Your presence is shared with the external clients again."), nil
+	case constants.SubcommandStatus:
+		if p.optOuts.isOptedOut(args.UserId) {
+			return ephemeralResponse("Your presence is not shared with the external clients."), nil
+		}
+		return ephemeralResponse("Your presence is shared with the external clients."), nil
+	case constants.SubcommandOverride:
+		if !p.API.HasPermissionTo(args.UserId, model.PermissionManageSystem) {
+			return ephemeralResponse("Only system admins can override the status of the users."), nil
+		}
+		return ephemeralResponse(p.executeOverrideCommand(args.UserId, fields[2:])), nil
+	default:
+		return ephemeralResponse(fmt.Sprintf("Usage: `/%[1]s %[2]s|%[3]s|%[4]s`, or `/%[1]s %[5]s` for the system admins",
+			constants.CommandTrigger, constants.SubcommandOptOut, constants.SubcommandOptIn, constants.SubcommandStatus, constants.SubcommandOverride)), nil
+	}
+}
+
+// executeOverrideCommand sets, removes or lists the overrides, and returns the response to the admin.
+func (p *Plugin) executeOverrideCommand(adminID string, fields []string) string {
+	usage := fmt.Sprintf("Usage: `/%[1]s %[2]s %[3]s @username status until [reason]`, `/%[1]s %[2]s %[4]s @username` or `/%[1]s %[2]s %[5]s`. The override ends at the end of the date given as YYYY-MM-DD, or after the duration given like 36h or 14d.",
+		constants.CommandTrigger, constants.SubcommandOverride, constants.SubcommandOverrideSet, constants.SubcommandOverrideRemove, constants.SubcommandOverrideList)
+	if len(fields) == 0 {
+		return usage
+	}
+
+	switch fields[0] {
+	case constants.SubcommandOverrideSet:
+		if len(fields) < 4 {
+			return usage
+		}
+
+		user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(fields[1], "@"))
+		if appErr != nil {
+			return fmt.Sprintf("User %s not found.", fields[1])
+		}
+
+		admin, appErr := p.API.GetUser(adminID)
+		if appErr != nil {
+			return "Unable to get your timezone. Please try again later."
+		}
+
+		endAt, err := parseOverrideEnd(fields[3], time.Now(), admin.GetPreferredTimezone())
+		if err != nil {
+			return err.Error()
+		}
+
+		override := &serializer.PresenceOverride{
+			UserID: user.Id,
+			Status: fields[2],
+			Reason: strings.Join(fields[4:], " "),
+			EndAt:  endAt,
+		}
+		if err = preparePresenceOverride(override, adminID); err != nil {
+			return fmt.Sprintf("The override is not valid: %s.", err.Error())
+		}
+
+		if err = p.setPresenceOverride(user.Id, override); err != nil {
+			p.API.LogError("Unable to save the presence override", "UserID", user.Id, "Error", err.Error())
+			return "Unable to save the override. Please try again later."
+		}
+
+		return fmt.Sprintf("The status of @%s is shown as %s until %s.", user.Username, override.Status, formatMillis(override.EndAt))
+	case constants.SubcommandOverrideRemove:
+		if len(fields) < 2 {
+			return usage
+		}
+
+		user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(fields[1], "@"))
+		if appErr != nil {
+			return fmt.Sprintf("User %s not found.", fields[1])
+		}
+
+		if err := p.setPresenceOverride(user.Id, nil); err != nil {
+			p.API.LogError("Unable to remove the presence override", "UserID", user.Id, "Error", err.Error())
+			return "Unable to remove the override. Please try again later."
+		}
+
+		return fmt.Sprintf("The override of @%s was removed.", user.Username)
+	case constants.SubcommandOverrideList:
+		overrides := p.overrides.list(model.GetMillis())
+		if len(overrides) == 0 {
+			return "There are no overrides."
+		}
+
+		lines := []string{"| User | Status | Reason | Start | End |", "| --- | --- | --- | --- | --- |"}
+		for _, override := range overrides {
+			username := override.UserID
+			if user, appErr := p.API.GetUser(override.UserID); appErr == nil {
+				username = "@" + user.Username
+			}
+
+			lines = append(lines, fmt.Sprintf("| %s | %s | %s | %s | %s |", username, override.Status, override.Reason, formatMillis(override.StartAt), formatMillis(override.EndAt)))
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return usage
+	}
+}
+
+// parseOverrideEnd parses the end of an override given as a date, which ends the override at the end of the date
+// in the given timezone, or as a duration like 36h or 14d.
+func parseOverrideEnd(value string, now time.Time, timezone string) (int64, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		count, err := strconv.Atoi(days)
+		if err != nil || count <= 0 {
+			return 0, fmt.Errorf("%s is not a valid number of days", value)
+		}
+		return now.AddDate(0, 0, count).UnixNano() / int64(time.Millisecond), nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(duration).UnixNano() / int64(time.Millisecond), nil
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", value, location)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid date or duration", value)
+	}
+	return date.AddDate(0, 0, 1).UnixNano() / int64(time.Millisecond), nil
+}
+
+func formatMillis(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04 MST")
+}
+
+func ephemeralResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
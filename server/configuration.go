@@ -1,10 +1,18 @@
 package main
 
 import (
+	"compress/flate"
+	"encoding/json"
 	"reflect"
 	"strings"
+	"time"
 
+	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
 )
 
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
@@ -19,8 +27,27 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
-	Secret          string `json:"Secret"`
-	PerPageStatuses int    `json:"PerPageStatuses"`
+	Secret                  string `json:"Secret"`
+	PerPageStatuses         int    `json:"PerPageStatuses"`
+	MaxPerPageStatuses      int    `json:"MaxPerPageStatuses"`
+	IdentityAttribute       string `json:"IdentityAttribute"`
+	IdentityCustomAttribute string `json:"IdentityCustomAttribute"`
+	SIPURITemplate          string `json:"SIPURITemplate"`
+	AliasLDAPAttribute      string `json:"AliasLDAPAttribute"`
+	BatchInterval           int    `json:"BatchInterval"`
+	MaxEventsPerSecond      int    `json:"MaxEventsPerSecond"`
+	EnableCompression       bool   `json:"EnableCompression"`
+	CompressionLevel        int    `json:"CompressionLevel"`
+	CompressionThreshold    int    `json:"CompressionThreshold"`
+	OptOutBehavior          string `json:"OptOutBehavior"`
+	PresencePolicy          string `json:"PresencePolicy"`
+	StatusDwellTimes        string `json:"StatusDwellTimes"`
+
+	// policyRules are parsed from the presence policy
+	policyRules []*serializer.PolicyRule
+
+	// dwellTimes are parsed from the status dwell times, in seconds by transition like "online:away"
+	dwellTimes map[string]int
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -34,6 +61,52 @@ func (c *configuration) Clone() *configuration {
 func (c *configuration) ProcessConfiguration() error {
 	c.Secret = strings.TrimSpace(c.Secret)
 
+	// The setting was added in a later version, so it is not present in older configurations.
+	// The page size of these configurations is kept, even if it is greater than the default maximum.
+	if c.MaxPerPageStatuses <= 0 {
+		c.MaxPerPageStatuses = constants.DefaultMaxPerPageStatuses
+		if c.PerPageStatuses > c.MaxPerPageStatuses {
+			c.MaxPerPageStatuses = c.PerPageStatuses
+		}
+	}
+
+	if c.PerPageStatuses > c.MaxPerPageStatuses {
+		c.PerPageStatuses = c.MaxPerPageStatuses
+	}
+
+	if c.BatchInterval <= 0 {
+		c.BatchInterval = constants.DefaultBatchIntervalMilliseconds
+	}
+
+	if c.CompressionLevel == 0 {
+		c.CompressionLevel = flate.BestSpeed
+	}
+
+	if c.IdentityAttribute == "" {
+		c.IdentityAttribute = constants.IdentityAttributeEmail
+	}
+
+	if c.OptOutBehavior == "" {
+		c.OptOutBehavior = constants.OptOutBehaviorOffline
+	}
+
+	c.IdentityCustomAttribute = strings.TrimSpace(c.IdentityCustomAttribute)
+	c.SIPURITemplate = strings.TrimSpace(c.SIPURITemplate)
+	c.AliasLDAPAttribute = strings.TrimSpace(c.AliasLDAPAttribute)
+
+	rules, err := serializer.PolicyRulesFromJSON(c.PresencePolicy)
+	if err != nil {
+		return errors.Wrap(err, "the presence policy is not valid JSON")
+	}
+	c.policyRules = rules
+
+	c.dwellTimes = nil
+	if strings.TrimSpace(c.StatusDwellTimes) != "" {
+		if err = json.Unmarshal([]byte(c.StatusDwellTimes), &c.dwellTimes); err != nil {
+			return errors.Wrap(err, "the status dwell times are not valid JSON")
+		}
+	}
+
 	return nil
 }
 
@@ -47,6 +120,54 @@ func (c *configuration) IsValid() error {
 		return errors.New("please enter a value greater than 0 for the status response page size")
 	}
 
+	if c.MaxEventsPerSecond < 0 {
+		return errors.New("the maximum events per second must not be negative")
+	}
+
+	if c.CompressionLevel < flate.BestSpeed || c.CompressionLevel > flate.BestCompression {
+		return errors.Errorf("the compression level must be between %d and %d", flate.BestSpeed, flate.BestCompression)
+	}
+
+	if c.CompressionThreshold < 0 {
+		return errors.New("the compression threshold must not be negative")
+	}
+
+	switch c.IdentityAttribute {
+	case constants.IdentityAttributeEmail, constants.IdentityAttributeUsername, constants.IdentityAttributeAuthData:
+	case constants.IdentityAttributeCustom:
+		if c.IdentityCustomAttribute == "" {
+			return errors.New("please enter the name of the custom profile attribute used as the user identity")
+		}
+	default:
+		return errors.Errorf("invalid user identity attribute %q", c.IdentityAttribute)
+	}
+
+	if c.OptOutBehavior != constants.OptOutBehaviorOffline && c.OptOutBehavior != constants.OptOutBehaviorOmit {
+		return errors.Errorf("invalid opt-out behavior %q", c.OptOutBehavior)
+	}
+
+	for index, rule := range c.policyRules {
+		if err := rule.IsValid(); err != nil {
+			return errors.Wrapf(err, "rule %d of the presence policy is not valid", index+1)
+		}
+	}
+
+	for transition, seconds := range c.dwellTimes {
+		statuses := strings.Split(transition, ":")
+		if len(statuses) != 2 || !serializer.IsValidStatus(statuses[0]) || !serializer.IsValidStatus(statuses[1]) || statuses[0] == statuses[1] {
+			return errors.Errorf("invalid status transition %q in the status dwell times", transition)
+		}
+
+		// The users going DND or offline are not expected to come back shortly
+		if statuses[1] == model.StatusDnd || statuses[1] == model.StatusOffline {
+			return errors.Errorf("the transitions to %s are always published immediately", statuses[1])
+		}
+
+		if seconds < 0 {
+			return errors.Errorf("the dwell time of the transition %q must not be negative", transition)
+		}
+	}
+
 	return nil
 }
 
@@ -109,5 +230,31 @@ func (p *Plugin) OnConfigurationChange() error {
 	}
 
 	p.setConfiguration(configuration)
+
+	// The pool is not created yet when the plugin is being activated, and receives the settings once it is started
+	if p.wsPool != nil {
+		p.wsPool.SetBatchSettings(configuration.getBatchSettings())
+	}
+
 	return nil
 }
+
+func (c *configuration) getCompressionSettings() websocket.CompressionSettings {
+	return websocket.CompressionSettings{
+		Enabled:   c.EnableCompression,
+		Level:     c.CompressionLevel,
+		Threshold: c.CompressionThreshold,
+	}
+}
+
+func (c *configuration) getBatchSettings() websocket.BatchSettings {
+	return websocket.BatchSettings{
+		Interval:           time.Duration(c.BatchInterval) * time.Millisecond,
+		MaxEventsPerSecond: c.MaxEventsPerSecond,
+	}
+}
+
+// getDwellTime returns the minimum time for which a status change must last before it is published.
+func (c *configuration) getDwellTime(from, to string) time.Duration {
+	return time.Duration(c.dwellTimes[from+":"+to]) * time.Second
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProcessConfigurationPageSize(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		perPage    int
+		maxPerPage int
+		wantPage   int
+		wantMax    int
+	}{
+		{
+			name:       "page size within the maximum",
+			perPage:    100,
+			maxPerPage: 200,
+			wantPage:   100,
+			wantMax:    200,
+		},
+		{
+			name:       "page size greater than the maximum is clamped",
+			perPage:    500,
+			maxPerPage: 200,
+			wantPage:   200,
+			wantMax:    200,
+		},
+		{
+			name:     "maximum of an older configuration defaults to the page size",
+			perPage:  500,
+			wantPage: 500,
+			wantMax:  500,
+		},
+		{
+			name:     "maximum of an older configuration with a small page size",
+			perPage:  50,
+			wantPage: 50,
+			wantMax:  200,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &configuration{Secret: "secret", PerPageStatuses: test.perPage, MaxPerPageStatuses: test.maxPerPage}
+			if err := config.ProcessConfiguration(); err != nil {
+				t.Fatal(err)
+			}
+			if err := config.IsValid(); err != nil {
+				t.Fatal(err)
+			}
+
+			if config.PerPageStatuses != test.wantPage || config.MaxPerPageStatuses != test.wantMax {
+				t.Errorf("got page size %d and maximum %d, want %d and %d", config.PerPageStatuses, config.MaxPerPageStatuses, test.wantPage, test.wantMax)
+			}
+		})
+	}
+}
@@ -1,7 +1,180 @@
 package constants
 
+import "time"
+
 const (
 	Page         = "page"
+	PerPage      = "per_page"
+	Cursor       = "cursor"
+	Timeout      = "timeout"
+	TeamID       = "team_id"
+	ChannelID    = "channel_id"
+	GroupID      = "group_id"
+	UserID       = "user_id"
+	Status       = "status"
+	Email        = "email"
+	Alias        = "alias"
+	WebhookID    = "webhook_id"
+	ClientID     = "client_id"
 	DefaultPage  = 0
 	ClusterEvent = "outlook_presence_status_changed_cluster_event"
+
+	ClusterEventMembershipChanged = "outlook_presence_membership_changed_cluster_event"
+	ClusterEventClientsRequested  = "outlook_presence_clients_requested_cluster_event"
+	ClusterEventClientsReported   = "outlook_presence_clients_reported_cluster_event"
+	ClusterEventDisconnectClient  = "outlook_presence_disconnect_client_cluster_event"
+	ClusterEventNodeSummary       = "outlook_presence_node_summary_cluster_event"
+	ClusterEventUserAdded         = "outlook_presence_user_added_cluster_event"
+	ClusterEventOptOutChanged     = "outlook_presence_opt_out_changed_cluster_event"
+	ClusterEventTraceRequested    = "outlook_presence_trace_requested_cluster_event"
+	ClusterEventTraceReported     = "outlook_presence_trace_reported_cluster_event"
+	ClusterEventOverrideChanged   = "outlook_presence_override_changed_cluster_event"
+	ClusterEventStatusPending     = "outlook_presence_status_pending_cluster_event"
+	ClusterEventWebhooksChanged   = "outlook_presence_webhooks_changed_cluster_event"
+	ClusterEventAliasesChanged    = "outlook_presence_aliases_changed_cluster_event"
+
+	// ClusterRequestTimeout is the time for which the responses of the other servers are awaited
+	ClusterRequestTimeout = 2 * time.Second
+
+	// Every server publishes the summary of its clients at the interval, and the summary expires if it is not updated
+	NodeSummaryInterval = 30 * time.Second
+	NodeSummaryTTL      = 3 * NodeSummaryInterval
+
+	// ClusterReportsBufferSize is the number of responses of the other servers which can be buffered for a request
+	ClusterReportsBufferSize = 64
+
+	// CredentialWebhookSecret is the name of the credential used by the clients authenticated with the webhook secret
+	CredentialWebhookSecret = "webhook_secret"
+
+	// DefaultMaxPerPageStatuses is used when the admin has not configured the maximum page size
+	DefaultMaxPerPageStatuses = 200
+
+	// UsersBatchSize is the number of users fetched at once while loading users from the server
+	UsersBatchSize = 200
+
+	// MaxAliasImportSize is the maximum size in bytes of a CSV file of aliases imported by an admin
+	MaxAliasImportSize = 10 * 1024 * 1024
+
+	// DirectoryCacheTTL is the time after which the cached snapshot of all the users is reloaded
+	DirectoryCacheTTL = time.Minute
+
+	// DirectoryWatchInterval is the interval at which the snapshot of the users is compared with the previous one,
+	// to detect the deactivated users and the changed emails for which there are no hooks
+	DirectoryWatchInterval = time.Minute
+
+	// OverrideCheckInterval is the interval at which the overrides which started or ended are detected and published
+	OverrideCheckInterval = 15 * time.Second
+
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeCSV    = "text/csv"
+	EncodingGzip      = "gzip"
+
+	IdentityAttributeEmail    = "email"
+	IdentityAttributeUsername = "username"
+	IdentityAttributeAuthData = "auth_data"
+	IdentityAttributeCustom   = "custom"
+
+	// CommandTrigger is the trigger of the slash command, which is followed by one of the subcommands
+	CommandTrigger   = "outlook-presence"
+	SubcommandOptOut = "opt-out"
+	SubcommandOptIn  = "opt-in"
+	SubcommandStatus = "status"
+
+	// The subcommands of the override subcommand can only be used by system admins
+	SubcommandOverride       = "override"
+	SubcommandOverrideSet    = "set"
+	SubcommandOverrideRemove = "remove"
+	SubcommandOverrideList   = "list"
+
+	// The users who opted out of sharing their presence are reported as offline or omitted, as configured by the admin
+	OptOutBehaviorOffline = "offline"
+	OptOutBehaviorOmit    = "omit"
+
+	AliasSourceAPI  = "api"
+	AliasSourceCSV  = "csv"
+	AliasSourceLDAP = "ldap"
+
+	KVListPerPage = 1000
+
+	// The KV store keys can't be longer than 50 characters, so the aliases are hashed to build their keys
+	KeyPrefixAlias       = "alias_"
+	KeyPrefixUserAliases = "user_aliases_"
+	KeyPrefixNodeSummary = "node_summary_"
+
+	// KeyPrefixOptOut is followed by the ID of a user who opted out of sharing their presence
+	KeyPrefixOptOut = "opt_out_"
+
+	// KeyPrefixOverride is followed by the ID of a user whose status is overridden, and KeyPrefixOverrideEvent is used
+	// by the servers to elect the one which delivers the start or the end of an override to the webhook targets
+	KeyPrefixOverride      = "presence_override_"
+	KeyPrefixOverrideEvent = "override_event_"
+
+	// KeyPrefixStatusSince is followed by the ID of a user whose last published status is stored with its time
+	KeyPrefixStatusSince = "status_since_"
+
+	// KeyPrefixPendingStatus is used by the servers to elect the one which publishes a status change once its dwell time elapses
+	KeyPrefixPendingStatus = "pending_status_"
+
+	// KeyPrefixDirectoryEvent is used by the servers to elect the one which delivers a directory change to the webhook targets
+	KeyPrefixDirectoryEvent = "directory_event_"
+
+	KeyWebhooks                 = "webhooks"
+	KeyPrefixWebhookQueue       = "webhook_queue_"
+	KeyPrefixWebhookDeadLetter  = "webhook_dead_"
+	KeyPrefixWebhookDeliveryLog = "webhook_log_"
+	KeyPrefixWebhookLock        = "webhook_lock_"
+
+	EventStatusChanged = "status_change"
+	EventUserAdded     = "user_added"
+	EventUserRemoved   = "user_removed"
+	EventUserUpdated   = "user_updated"
+
+	WebhookResultDelivered    = "delivered"
+	WebhookResultRetrying     = "retrying"
+	WebhookResultDeadLettered = "dead_lettered"
+
+	// WebhookMaxAttempts is the number of attempts after which a delivery is dead-lettered
+	WebhookMaxAttempts = 8
+
+	// WebhookUpdateAttempts is the number of times an update of the webhook targets is tried if they are updated concurrently
+	WebhookUpdateAttempts = 5
+
+	// WebhookBaseBackoff is doubled after every failed attempt until it reaches WebhookMaxBackoff
+	WebhookBaseBackoff = 5 * time.Second
+	WebhookMaxBackoff  = time.Hour
+
+	// WebhookWorkers is the number of webhook targets to which the deliveries are sent concurrently.
+	// The deliveries to a single target are sent one at a time, in the order in which they are due.
+	WebhookWorkers = 8
+
+	// WebhookDeadLetterExpiry is the time in seconds for which the dead-lettered deliveries are kept
+	WebhookDeadLetterExpiry = 7 * 24 * 60 * 60
+
+	WebhookRequestTimeout  = 10 * time.Second
+	WebhookLockExpiry      = 60
+	WebhookDeliveryLogSize = 100
+	WebhookSecretLength    = 32
+
+	// The number of users returned by the search_users method of the websocket clients
+	DefaultSearchUsersLimit = 20
+	MaxSearchUsersLimit     = 100
+
+	// DefaultBatchIntervalMilliseconds is used when the batch interval is not set in the configuration
+	DefaultBatchIntervalMilliseconds = 250
+
+	// SSEKeepaliveInterval is the time after which a comment is sent to an idle Server-Sent Events stream
+	SSEKeepaliveInterval = 30 * time.Second
+
+	// DefaultPollTimeout and MaxPollTimeout are in seconds
+	DefaultPollTimeout = 30
+	MaxPollTimeout     = 60
+
+	HeaderMattermostUserID = "Mattermost-User-ID"
+	HeaderLastEventID      = "Last-Event-ID"
+	HeaderSignature        = "X-Outlook-Presence-Signature"
+	HeaderEvent            = "X-Outlook-Presence-Event"
+	HeaderDeliveryID       = "X-Outlook-Presence-Delivery"
+	HeaderTotalCount       = "X-Total-Count"
+	HeaderNextCursor       = "X-Next-Cursor"
+	HeaderLink             = "Link"
 )
@@ -3,5 +3,26 @@ package constants
 const (
 	PathGetStatusesForAllUsers = "/status"
 	PathPublishStatusChanged   = "/status/publish"
+	PathExportStatuses         = "/status/export"
+	PathLookupStatus           = "/status/lookup"
+	PathPollStatus             = "/status/poll"
 	PathWebsocket              = "/ws"
+	PathEvents                 = "/events"
+	PathAliases                = "/aliases"
+	PathAlias                  = "/aliases/{alias}"
+	PathImportAliases          = "/aliases/import"
+	PathSyncLDAPAliases        = "/aliases/sync"
+	PathMetrics                = "/metrics"
+	PathClients                = "/clients"
+	PathClient                 = "/clients/{client_id}"
+	PathClientsSummary         = "/clients/summary"
+	PathWebhooks               = "/webhooks"
+	PathWebhook                = "/webhooks/{webhook_id}"
+	PathWebhookDeliveries      = "/webhooks/{webhook_id}/deliveries"
+	PathWebhookDeadLetters     = "/webhooks/{webhook_id}/dead"
+	PathPresencePreference     = "/me/preference"
+	PathEvaluatePolicy         = "/policy/evaluate"
+	PathExplainPresence        = "/explain/{user_id}"
+	PathOverrides              = "/overrides"
+	PathOverride               = "/overrides/{user_id}"
 )
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+)
+
+// userDirectory keeps a snapshot of all the active users ordered by user ID.
+// The plugin API only supports offset pagination ordered by username, so paging over the snapshot
+// is what allows the status APIs to use a stable cursor and report the total number of users.
+type userDirectory struct {
+	api plugin.API
+
+	lock      sync.RWMutex
+	users     []*model.User
+	updatedAt time.Time
+
+	// authData caches the AuthData of the users, as it is removed from the users returned by GetUsers.
+	// It is cleared along with the snapshot, or once it is older than the snapshot TTL, so that the changes
+	// of the AuthData are picked up.
+	authDataLock      sync.RWMutex
+	authData          map[string]string
+	authDataClearedAt time.Time
+}
+
+func newUserDirectory(api plugin.API) *userDirectory {
+	return &userDirectory{
+		api:               api,
+		authData:          make(map[string]string),
+		authDataClearedAt: time.Now(),
+	}
+}
+
+// getUsers returns the active users ordered by user ID, refreshing the snapshot if it is stale.
+// The returned slice must not be modified.
+func (d *userDirectory) getUsers() ([]*model.User, error) {
+	d.lock.RLock()
+	if d.users != nil && time.Since(d.updatedAt) < constants.DirectoryCacheTTL {
+		defer d.lock.RUnlock()
+		return d.users, nil
+	}
+	d.lock.RUnlock()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Another request might have refreshed the snapshot while we were waiting for the lock
+	if d.users != nil && time.Since(d.updatedAt) < constants.DirectoryCacheTTL {
+		return d.users, nil
+	}
+
+	users, err := d.loadUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	d.users = users
+	d.updatedAt = time.Now()
+	d.clearAuthData()
+	return d.users, nil
+}
+
+// invalidate forces the snapshot to be reloaded on the next call to getUsers, and the AuthData to be fetched again.
+func (d *userDirectory) invalidate() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.users = nil
+	d.clearAuthData()
+}
+
+func (d *userDirectory) clearAuthData() {
+	d.authDataLock.Lock()
+	defer d.authDataLock.Unlock()
+
+	d.authData = make(map[string]string)
+	d.authDataClearedAt = time.Now()
+}
+
+// getAuthData returns the AuthData of the user, fetching the complete user from the server if it is not cached.
+func (d *userDirectory) getAuthData(user *model.User) string {
+	if user.AuthData != nil && *user.AuthData != "" {
+		return *user.AuthData
+	}
+
+	d.authDataLock.RLock()
+	authData, ok := d.authData[user.Id]
+	expired := time.Since(d.authDataClearedAt) >= constants.DirectoryCacheTTL
+	d.authDataLock.RUnlock()
+	if expired {
+		d.clearAuthData()
+	} else if ok {
+		return authData
+	}
+
+	completeUser, err := d.api.GetUser(user.Id)
+	if err != nil {
+		d.api.LogDebug("Unable to get user", "UserID", user.Id, "Error", err.Error())
+		return ""
+	}
+
+	if completeUser.AuthData != nil {
+		authData = *completeUser.AuthData
+	}
+
+	d.authDataLock.Lock()
+	d.authData[user.Id] = authData
+	d.authDataLock.Unlock()
+	return authData
+}
+
+func (d *userDirectory) loadUsers() ([]*model.User, error) {
+	var users []*model.User
+	for page := 0; ; page++ {
+		batch, err := d.api.GetUsers(&model.UserGetOptions{
+			Active:  true,
+			Page:    page,
+			PerPage: constants.UsersBatchSize,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get users")
+		}
+
+		users = append(users, batch...)
+		if len(batch) < constants.UsersBatchSize {
+			break
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users, nil
+}
+
+// cursorIndex returns the index of the first user whose ID is greater than the cursor.
+func cursorIndex(users []*model.User, cursor string) int {
+	return sort.Search(len(users), func(i int) bool {
+		return users[i].Id > cursor
+	})
+}
+
+// pageUsers returns at most perPage users starting from the given index, along with the cursor
+// for the next page. The next cursor is empty if there are no more users, or if the start is out of range.
+func pageUsers(users []*model.User, start, perPage int) (page []*model.User, nextCursor string) {
+	if start < 0 || start >= len(users) {
+		return []*model.User{}, ""
+	}
+
+	end := start + perPage
+	if end >= len(users) || end < start {
+		return users[start:], ""
+	}
+
+	page = users[start:end]
+	return page, page[len(page)-1].Id
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+)
+
+func TestPageUsers(t *testing.T) {
+	users := []*model.User{{Id: "a"}, {Id: "c"}, {Id: "e"}, {Id: "g"}, {Id: "i"}}
+	userIDs := func(users []*model.User) []string {
+		ids := []string{}
+		for _, user := range users {
+			ids = append(ids, user.Id)
+		}
+		return ids
+	}
+
+	for _, test := range []struct {
+		name       string
+		cursor     string
+		start      int
+		perPage    int
+		want       []string
+		nextCursor string
+	}{
+		{
+			name:       "first page",
+			perPage:    2,
+			want:       []string{"a", "c"},
+			nextCursor: "c",
+		},
+		{
+			name:       "page after the cursor",
+			cursor:     "c",
+			perPage:    2,
+			want:       []string{"e", "g"},
+			nextCursor: "g",
+		},
+		{
+			name:    "last page",
+			cursor:  "g",
+			perPage: 2,
+			want:    []string{"i"},
+		},
+		{
+			name:    "last page with exactly perPage users",
+			cursor:  "e",
+			perPage: 2,
+			want:    []string{"g", "i"},
+		},
+		{
+			name:       "cursor of a removed user",
+			cursor:     "d",
+			perPage:    2,
+			want:       []string{"e", "g"},
+			nextCursor: "g",
+		},
+		{
+			name:    "start overflowed to a negative index",
+			start:   -4,
+			perPage: 2,
+			want:    []string{},
+		},
+		{
+			name:    "page size overflowing the end",
+			cursor:  "c",
+			perPage: maxInt,
+			want:    []string{"e", "g", "i"},
+		},
+		{
+			name:    "cursor after the last user",
+			cursor:  "z",
+			perPage: 2,
+			want:    []string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			start := test.start
+			if test.cursor != "" {
+				start = cursorIndex(users, test.cursor)
+			}
+
+			page, nextCursor := pageUsers(users, start, test.perPage)
+			if got := userIDs(page); !reflect.DeepEqual(got, test.want) || nextCursor != test.nextCursor {
+				t.Errorf("got %v with cursor %q, want %v with cursor %q", got, nextCursor, test.want, test.nextCursor)
+			}
+		})
+	}
+
+	t.Run("every user is returned once", func(t *testing.T) {
+		var got []string
+		for cursor := ""; ; {
+			page, nextCursor := pageUsers(users, cursorIndex(users, cursor), 2)
+			got = append(got, userIDs(page)...)
+			if nextCursor == "" {
+				break
+			}
+			cursor = nextCursor
+		}
+
+		if want := userIDs(users); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestUserDirectoryAuthData(t *testing.T) {
+	authData := "old"
+	api := newTestAPI(&model.User{Id: "user", AuthData: &authData})
+	d := newUserDirectory(api)
+	user := &model.User{Id: "user"}
+
+	if got := d.getAuthData(user); got != "old" {
+		t.Fatalf("got %q, want %q", got, "old")
+	}
+
+	authData = "new"
+	if got := d.getAuthData(user); got != "old" {
+		t.Errorf("got %q from the cache, want %q", got, "old")
+	}
+
+	for _, test := range []struct {
+		name  string
+		clear func()
+	}{
+		{
+			name:  "invalidated",
+			clear: d.invalidate,
+		},
+		{
+			name: "expired",
+			clear: func() {
+				d.authDataLock.Lock()
+				d.authDataClearedAt = time.Now().Add(-constants.DirectoryCacheTTL)
+				d.authDataLock.Unlock()
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			authData = test.name
+			test.clear()
+			if got := d.getAuthData(user); got != test.name {
+				t.Errorf("got %q, want %q", got, test.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// directoryWatcher detects the changes to the directory of the active users, so that the clients caching the directory
+// learn about them without fetching all the statuses again. The created users are reported by the UserHasBeenCreated hook,
+// while the deactivated users and the changed emails are detected by comparing the snapshots of the users,
+// as there are no hooks for them. Every server in the cluster watches the directory for its own clients.
+type directoryWatcher struct {
+	p *Plugin
+
+	// known contains the users of the previous snapshot by user ID. It is nil until the first snapshot is taken.
+	lock  sync.Mutex
+	known map[string]*serializer.UserStatus
+
+	stop chan struct{}
+}
+
+func newDirectoryWatcher(p *Plugin) *directoryWatcher {
+	return &directoryWatcher{
+		p:    p,
+		stop: make(chan struct{}),
+	}
+}
+
+// Start takes the first snapshot of the users, which is only recorded, and starts comparing the later snapshots with it.
+func (w *directoryWatcher) Start() {
+	go w.run()
+}
+
+func (w *directoryWatcher) Stop() {
+	close(w.stop)
+}
+
+func (w *directoryWatcher) run() {
+	ticker := time.NewTicker(constants.DirectoryWatchInterval)
+	defer ticker.Stop()
+
+	w.check()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// markKnown adds the user reported by the UserHasBeenCreated hook to the snapshot.
+// It returns false if the user was already known, in which case the change has already been published.
+func (w *directoryWatcher) markKnown(status *serializer.UserStatus) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.known == nil {
+		return true
+	}
+
+	if _, ok := w.known[status.UserID]; ok {
+		return false
+	}
+
+	w.known[status.UserID] = status
+	return true
+}
+
+// check compares the current users with the previous snapshot and publishes the changes.
+// The lock is held while loading the users, so that a user reported by the hook meanwhile is not reported again.
+func (w *directoryWatcher) check() {
+	w.lock.Lock()
+	changes, err := w.diff()
+	w.lock.Unlock()
+	if err != nil {
+		w.p.API.LogWarn("Unable to check the directory for changes", "Error", err.Error())
+		return
+	}
+
+	for _, change := range changes {
+		w.p.publishDirectoryChange(change)
+	}
+}
+
+func (w *directoryWatcher) diff() ([]*serializer.UserStatus, error) {
+	users, err := w.p.directory.getUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]*serializer.UserStatus, len(users))
+	for _, user := range users {
+		current[user.Id] = w.p.newUserStatus(user, "")
+	}
+
+	if w.known == nil {
+		w.known = current
+		return nil, nil
+	}
+
+	var changes []*serializer.UserStatus
+	var userIDs []string
+	for userID, status := range current {
+		change := *status
+		previous, ok := w.known[userID]
+		switch {
+		case !ok:
+			change.Event = constants.EventUserAdded
+		case previous.Email != status.Email:
+			change.Event = constants.EventUserUpdated
+			change.OldEmail = previous.Email
+		default:
+			continue
+		}
+
+		changes = append(changes, &change)
+		userIDs = append(userIDs, userID)
+	}
+
+	if len(userIDs) > 0 {
+		statuses, appErr := w.p.API.GetUserStatusesByIds(userIDs)
+		if appErr != nil {
+			// The snapshot is not updated, so the changes are detected again on the next check
+			return nil, errors.Wrap(appErr, "failed to get the statuses")
+		}
+
+		statusMap := make(map[string]*model.Status, len(statuses))
+		for _, status := range statuses {
+			statusMap[status.UserId] = status
+		}
+
+		for _, change := range changes {
+			if status, ok := statusMap[change.UserID]; ok {
+				change.Status = status.Status
+				change.LastActivityAt = status.LastActivityAt
+			}
+			if change.Status == "" {
+				change.Status = model.StatusOffline
+			}
+		}
+	}
+
+	for userID, previous := range w.known {
+		if _, ok := current[userID]; ok {
+			continue
+		}
+
+		change := *previous
+		change.Event = constants.EventUserRemoved
+		change.Status = model.StatusOffline
+		changes = append(changes, &change)
+	}
+
+	w.known = current
+	return changes, nil
+}
+
+// publishDirectoryChange sends the directory change to the clients connected to this server. Every server detects
+// the change on its own, so the change is delivered to the webhook targets only by the server which claims it first.
+// It returns false if the change is not published because the user is omitted by the presence policy.
+// The presence policy is not applied to the removed users, which are always reported as offline,
+// and which might not exist anymore if they were permanently deleted.
+func (p *Plugin) publishDirectoryChange(change *serializer.UserStatus) bool {
+	if change.Event != constants.EventUserRemoved {
+		user, appErr := p.API.GetUser(change.UserID)
+		if appErr != nil {
+			p.API.LogWarn("Unable to get the user for the directory change", "UserID", change.UserID, "Error", appErr.Error())
+			return false
+		}
+
+		if !p.applyPresencePolicy(user, change) {
+			return false
+		}
+	}
+
+	p.BroadcastEvent(change)
+
+	if !p.claimDirectoryChange(change) {
+		return true
+	}
+
+	p.publishWebhookEvent(&webhookEvent{
+		Event:  change.Event,
+		UserID: change.UserID,
+		Status: change.Status,
+		Data:   change,
+	})
+	return true
+}
+
+func (p *Plugin) claimDirectoryChange(change *serializer.UserStatus) bool {
+	// The claim expires once all the servers have checked the directory, so that a later change to the same values is delivered
+	claimed, err := p.claimClusterEvent(constants.KeyPrefixDirectoryEvent, change.Event+":"+change.UserID+":"+change.OldEmail+":"+change.Email, 2*constants.DirectoryWatchInterval)
+	if err != nil {
+		p.API.LogWarn("Unable to claim the directory change", "UserID", change.UserID, "Error", err.Error())
+		return false
+	}
+
+	return claimed
+}
+
+// claimClusterEvent elects the server which handles an event detected by all the servers, like delivering it
+// to the webhook targets. It returns true for the first server which claims the event, until the claim expires.
+func (p *Plugin) claimClusterEvent(prefix, event string, expiry time.Duration) (bool, error) {
+	hash := sha256.Sum256([]byte(event))
+	key := prefix + hex.EncodeToString(hash[:])[:32]
+
+	claimed, appErr := p.API.KVSetWithOptions(key, []byte(p.nodeName), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(expiry.Seconds()),
+	})
+	if appErr != nil {
+		return false, appErr
+	}
+
+	return claimed, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+func TestPublishDirectoryChange(t *testing.T) {
+	user := &model.User{Id: model.NewId(), Email: "user@example.com"}
+	deleted := &model.User{Id: model.NewId(), Email: "deleted@example.com"}
+	override := &serializer.PresenceOverride{UserID: user.Id, Status: model.StatusDnd, StartAt: 1, EndAt: model.GetMillis() + 60000}
+
+	for _, test := range []struct {
+		name      string
+		user      *model.User
+		event     string
+		published bool
+		status    string
+	}{
+		{
+			name:      "added user gets the overridden status",
+			user:      user,
+			event:     constants.EventUserAdded,
+			published: true,
+			status:    model.StatusDnd,
+		},
+		{
+			name:      "removed user is offline despite the override",
+			user:      user,
+			event:     constants.EventUserRemoved,
+			published: true,
+			status:    model.StatusOffline,
+		},
+		{
+			name:      "permanently deleted user",
+			user:      deleted,
+			event:     constants.EventUserRemoved,
+			published: true,
+			status:    model.StatusOffline,
+		},
+		{
+			name:  "added user who can't be found",
+			user:  deleted,
+			event: constants.EventUserAdded,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestBroadcastPlugin(t, newTestAPI(user), &configuration{})
+			p.overrides.set(user.Id, override, model.GetMillis())
+
+			change := p.newUserStatus(test.user, model.StatusOffline)
+			change.Event = test.event
+			if published := p.publishDirectoryChange(change); published != test.published {
+				t.Fatalf("got published %t, want %t", published, test.published)
+			}
+
+			traces, _ := p.wsPool.TraceUser(test.user.Id)
+			if !test.published {
+				if len(traces) != 0 {
+					t.Errorf("got %d events broadcasted, want 0", len(traces))
+				}
+				return
+			}
+
+			if len(traces) != 1 || traces[0].Event != test.event || traces[0].Status != test.status {
+				t.Errorf("got events %+v, want a %s event with the status %s", traces, test.event, test.status)
+			}
+		})
+	}
+}
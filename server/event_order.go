@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// Reasons for which a status event received from another server is discarded
+const (
+	discardReasonDuplicate = "duplicate"
+	discardReasonStale     = "stale"
+
+	// The events of the users who opted out or are omitted by the presence policy are discarded too,
+	// but they are only reported by the presence trace
+	discardReasonOptedOut = "opted_out"
+	discardReasonOmitted  = "omitted"
+)
+
+// eventOrderer stamps the status events published by this server with a logical timestamp, and discards
+// the events received from the other servers which are duplicated or older than the latest event of the user.
+// The logical timestamp is a hybrid logical clock: it follows the wall clock in milliseconds, and it is advanced
+// past the timestamps of the received events, so every server ends up with the same latest status of a user.
+// As the clock starts from the wall clock, the events of a restarted server are not older than its events before the restart.
+type eventOrderer struct {
+	node     string
+	instance string
+
+	lock  sync.Mutex
+	clock uint64
+	now   func() int64
+
+	// latest contains the latest event of every user, without the status
+	latest map[string]*serializer.StatusEvent
+
+	// instances contains the runs of the plugin on the other servers from which an event was received
+	instances map[string]bool
+}
+
+func newEventOrderer(node string) *eventOrderer {
+	return &eventOrderer{
+		node:      node,
+		instance:  model.NewId(),
+		now:       model.GetMillis,
+		latest:    make(map[string]*serializer.StatusEvent),
+		instances: make(map[string]bool),
+	}
+}
+
+// stamp wraps a status change published by this server in an event, which is newer than all the events seen so far.
+func (o *eventOrderer) stamp(status *serializer.UserStatus) *serializer.StatusEvent {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.advance()
+	event := &serializer.StatusEvent{
+		ID:        model.NewId(),
+		Origin:    o.node,
+		Instance:  o.instance,
+		Timestamp: o.clock,
+		Status:    status,
+	}
+	o.record(event)
+
+	return event
+}
+
+// tick advances the clock for a change detected by this server which is not published to the other servers,
+// and returns the logical time of the change.
+func (o *eventOrderer) tick() uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.advance()
+	return o.clock
+}
+
+func (o *eventOrderer) advance() {
+	o.clock++
+	if now := uint64(o.now()); now > o.clock {
+		o.clock = now
+	}
+}
+
+// accept checks if an event received from another server should be broadcasted. If not, it returns the reason.
+// The first event received from a run of the plugin on another server is not discarded as stale, as the clock
+// of a server which was restarted might be behind the clocks of the other servers.
+func (o *eventOrderer) accept(event *serializer.StatusEvent) (bool, string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if event.Timestamp > o.clock {
+		o.clock = event.Timestamp
+	}
+
+	firstFromInstance := event.Instance != "" && !o.instances[event.Instance]
+	if event.Instance != "" {
+		o.instances[event.Instance] = true
+	}
+
+	if latest, ok := o.latest[event.Status.UserID]; ok {
+		if latest.ID == event.ID {
+			return false, discardReasonDuplicate
+		}
+
+		if !firstFromInstance && !event.IsNewerThan(latest) {
+			return false, discardReasonStale
+		}
+	}
+
+	o.record(event)
+	return true, ""
+}
+
+func (o *eventOrderer) record(event *serializer.StatusEvent) {
+	o.latest[event.Status.UserID] = &serializer.StatusEvent{
+		ID:        event.ID,
+		Origin:    event.Origin,
+		Instance:  event.Instance,
+		Timestamp: event.Timestamp,
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+func newTestEventOrderer(node string, now int64) *eventOrderer {
+	o := newEventOrderer(node)
+	o.now = func() int64 { return now }
+	return o
+}
+
+func testStatusEvent(id, origin, instance string, timestamp uint64) *serializer.StatusEvent {
+	return &serializer.StatusEvent{
+		ID:        id,
+		Origin:    origin,
+		Instance:  instance,
+		Timestamp: timestamp,
+		Status:    &serializer.UserStatus{UserID: "user", Status: "online"},
+	}
+}
+
+func TestEventOrdererAccept(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		received []*serializer.StatusEvent
+		accepted []bool
+		reasons  []string
+	}{
+		{
+			name: "newer events are accepted",
+			received: []*serializer.StatusEvent{
+				testStatusEvent("1", "a", "a1", 10),
+				testStatusEvent("2", "a", "a1", 11),
+			},
+			accepted: []bool{true, true},
+			reasons:  []string{"", ""},
+		},
+		{
+			name: "duplicate",
+			received: []*serializer.StatusEvent{
+				testStatusEvent("1", "a", "a1", 10),
+				testStatusEvent("1", "a", "a1", 10),
+			},
+			accepted: []bool{true, false},
+			reasons:  []string{"", discardReasonDuplicate},
+		},
+		{
+			name: "stale",
+			received: []*serializer.StatusEvent{
+				testStatusEvent("1", "a", "a1", 10),
+				testStatusEvent("2", "b", "b1", 12),
+				testStatusEvent("3", "a", "a1", 11),
+			},
+			accepted: []bool{true, true, false},
+			reasons:  []string{"", "", discardReasonStale},
+		},
+		{
+			name: "same timestamp is ordered by origin",
+			received: []*serializer.StatusEvent{
+				testStatusEvent("1", "b", "b1", 10),
+				testStatusEvent("2", "a", "a1", 11),
+				testStatusEvent("3", "c", "c1", 11),
+				testStatusEvent("4", "b", "b1", 11),
+			},
+			accepted: []bool{true, true, true, false},
+			reasons:  []string{"", "", "", discardReasonStale},
+		},
+		{
+			name: "first event of a restarted server is accepted",
+			received: []*serializer.StatusEvent{
+				testStatusEvent("1", "a", "a1", 100),
+				testStatusEvent("2", "a", "a2", 5),
+				testStatusEvent("3", "a", "a2", 6),
+				testStatusEvent("4", "a", "a2", 4),
+			},
+			accepted: []bool{true, true, true, false},
+			reasons:  []string{"", "", "", discardReasonStale},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := newTestEventOrderer("receiver", 0)
+			for i, event := range test.received {
+				accepted, reason := o.accept(event)
+				if accepted != test.accepted[i] || reason != test.reasons[i] {
+					t.Errorf("event %d: got (%t, %q), want (%t, %q)", i, accepted, reason, test.accepted[i], test.reasons[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEventOrdererStamp(t *testing.T) {
+	t.Run("the clock follows the wall clock", func(t *testing.T) {
+		o := newTestEventOrderer("a", 1000)
+		if event := o.stamp(&serializer.UserStatus{UserID: "user"}); event.Timestamp != 1000 {
+			t.Errorf("got timestamp %d, want 1000", event.Timestamp)
+		}
+		if event := o.stamp(&serializer.UserStatus{UserID: "user"}); event.Timestamp != 1001 {
+			t.Errorf("got timestamp %d, want 1001", event.Timestamp)
+		}
+	})
+
+	t.Run("the clock is advanced past the received events", func(t *testing.T) {
+		o := newTestEventOrderer("a", 1000)
+		o.accept(testStatusEvent("1", "b", "b1", 5000))
+		if event := o.stamp(&serializer.UserStatus{UserID: "user"}); event.Timestamp != 5001 {
+			t.Errorf("got timestamp %d, want 5001", event.Timestamp)
+		}
+	})
+
+	t.Run("the events of a restarted server are accepted", func(t *testing.T) {
+		receiver := newTestEventOrderer("b", 1000)
+		before := newTestEventOrderer("a", 1000)
+		for i := 0; i < 3; i++ {
+			if accepted, reason := receiver.accept(before.stamp(&serializer.UserStatus{UserID: "user"})); !accepted {
+				t.Fatalf("event %d before the restart was discarded: %s", i, reason)
+			}
+		}
+
+		after := newTestEventOrderer("a", 2000)
+		if accepted, reason := receiver.accept(after.stamp(&serializer.UserStatus{UserID: "user"})); !accepted {
+			t.Errorf("event after the restart was discarded: %s", reason)
+		}
+
+		// Even if the wall clock of the restarted server went back
+		skewed := newTestEventOrderer("a", 10)
+		if accepted, reason := receiver.accept(skewed.stamp(&serializer.UserStatus{UserID: "user"})); !accepted {
+			t.Errorf("event after the restart with a skewed clock was discarded: %s", reason)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// statusEncoder writes the users' statuses in one of the supported export formats.
+type statusEncoder interface {
+	Encode(status *serializer.UserStatus) error
+	Flush() error
+}
+
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonEncoder) Encode(status *serializer.UserStatus) error {
+	// json.Encoder terminates every value with a newline
+	return e.encoder.Encode(status)
+}
+
+func (e *ndjsonEncoder) Flush() error {
+	return nil
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+// The CSV columns are the fields of the NDJSON format. The times are left empty if they are not known.
+func newCSVEncoder(w io.Writer) (*csvEncoder, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"user_id", "email", "sip_uri", "status", "last_activity_at", "status_since", "override_reason"}); err != nil {
+		return nil, err
+	}
+
+	return &csvEncoder{writer: writer}, nil
+}
+
+func (e *csvEncoder) Encode(status *serializer.UserStatus) error {
+	return e.writer.Write([]string{
+		status.UserID,
+		status.Email,
+		status.SIPURI,
+		status.Status,
+		formatCSVMillis(status.LastActivityAt),
+		formatCSVMillis(status.StatusSince),
+		status.OverrideReason,
+	})
+}
+
+func formatCSVMillis(millis int64) string {
+	if millis == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(millis, 10)
+}
+
+func (e *csvEncoder) Flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// ExportStatuses streams the statuses of all the active users as NDJSON or CSV depending on the "Accept" header.
+// The users are paged over the directory snapshot taken when the export starts, using the ID of the last user of the page
+// as the cursor, so that the users created or removed during the export don't shift the pages. The statuses are read
+// and flushed to the client in batches.
+func (p *Plugin) ExportStatuses(w http.ResponseWriter, r *http.Request) {
+	contentType := constants.ContentTypeNDJSON
+	if strings.Contains(r.Header.Get("Accept"), constants.ContentTypeCSV) {
+		contentType = constants.ContentTypeCSV
+	}
+
+	var out io.Writer = w
+	var gzipWriter *gzip.Writer
+	if acceptsEncoding(r.Header.Values("Accept-Encoding"), constants.EncodingGzip) {
+		gzipWriter = gzip.NewWriter(w)
+		defer gzipWriter.Close()
+
+		w.Header().Set("Content-Encoding", constants.EncodingGzip)
+		out = gzipWriter
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+
+	var encoder statusEncoder = &ndjsonEncoder{encoder: json.NewEncoder(out)}
+	if contentType == constants.ContentTypeCSV {
+		csvEnc, err := newCSVEncoder(out)
+		if err != nil {
+			p.API.LogError("Error in writing the CSV header", "Error", err.Error())
+			return
+		}
+		encoder = csvEnc
+	}
+
+	allUsers, err := p.directory.getUsers()
+	if err != nil {
+		// The response has already started, so the error can't be sent to the client
+		p.API.LogError("Error in exporting the statuses", "Error", err.Error())
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for cursor := ""; ; {
+		users, nextCursor := pageUsers(allUsers, cursorIndex(allUsers, cursor), constants.UsersBatchSize)
+		if err = p.exportStatusesPage(encoder, users); err != nil {
+			p.API.LogError("Error in exporting the statuses", "Cursor", cursor, "Error", err.Error())
+			return
+		}
+
+		if err = encoder.Flush(); err != nil {
+			p.API.LogError("Error in exporting the statuses", "Cursor", cursor, "Error", err.Error())
+			return
+		}
+
+		if gzipWriter != nil {
+			if err = gzipWriter.Flush(); err != nil {
+				p.API.LogError("Error in exporting the statuses", "Cursor", cursor, "Error", err.Error())
+				return
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if nextCursor == "" {
+			return
+		}
+		cursor = nextCursor
+	}
+}
+
+// exportStatusesPage writes the statuses for a single page of users.
+func (p *Plugin) exportStatusesPage(encoder statusEncoder, users []*model.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	userIds := make([]string, len(users))
+	userMap := make(map[string]*model.User)
+	for index, user := range users {
+		userIds[index] = user.Id
+		userMap[user.Id] = user
+	}
+
+	statusArr, statusErr := p.API.GetUserStatusesByIds(userIds)
+	if statusErr != nil {
+		return errors.Wrap(statusErr, "failed to get statuses")
+	}
+
+	for _, status := range statusArr {
+		user := userMap[status.UserId]
+		userStatus := p.newUserStatusFromModel(user, status)
+		if !p.applyPresencePolicy(user, userStatus) {
+			continue
+		}
+
+		if err := encoder.Encode(userStatus); err != nil {
+			return errors.Wrap(err, "failed to write the status")
+		}
+	}
+
+	return nil
+}
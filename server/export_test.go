@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+)
+
+func TestExportStatusesCSV(t *testing.T) {
+	first := &model.User{Id: "a" + model.NewId()[1:], Email: "first@example.com"}
+	second := &model.User{Id: "b" + model.NewId()[1:], Email: "second@example.com"}
+	api := newTestAPI(second, first)
+	api.statuses[first.Id] = &model.Status{UserId: first.Id, Status: model.StatusOnline, LastActivityAt: 1000}
+
+	p := newTestPolicyPlugin(t, api, &configuration{})
+	p.directory = newUserDirectory(api)
+	p.statusDamper = newStatusDamper()
+	p.statusDamper.published(first.Id, model.StatusOnline, 2000)
+
+	r := httptest.NewRequest(http.MethodGet, "/status/export", nil)
+	r.Header.Set("Accept", constants.ContentTypeCSV)
+	w := httptest.NewRecorder()
+	p.ExportStatuses(w, r)
+
+	records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"user_id", "email", "sip_uri", "status", "last_activity_at", "status_since", "override_reason"},
+		{first.Id, first.Email, "", model.StatusOnline, "1000", "2000", ""},
+		{second.Id, second.Email, "", model.StatusOffline, "", "", ""},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("got %v, want %v", records, expected)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// getUserIdentity returns the value used to identify the user in the presence data, as configured by the admin.
+// It falls back to the user's email if the configured attribute is not set for the user.
+func (p *Plugin) getUserIdentity(user *model.User) string {
+	config := p.getConfiguration()
+
+	identity := ""
+	switch config.IdentityAttribute {
+	case constants.IdentityAttributeUsername:
+		identity = user.Username
+	case constants.IdentityAttributeAuthData:
+		identity = p.directory.getAuthData(user)
+	case constants.IdentityAttributeCustom:
+		identity = user.Props[config.IdentityCustomAttribute]
+	}
+
+	if identity == "" {
+		return user.Email
+	}
+
+	return identity
+}
+
+// getSIPURI builds the SIP URI for the user from the template configured by the admin.
+// It returns an empty string if no template is configured.
+func (p *Plugin) getSIPURI(user *model.User, identity string) string {
+	template := p.getConfiguration().SIPURITemplate
+	if template == "" {
+		return ""
+	}
+
+	return strings.NewReplacer(
+		"{user_id}", user.Id,
+		"{username}", user.Username,
+		"{email}", user.Email,
+		"{identity}", identity,
+	).Replace(template)
+}
+
+// newUserStatus creates the status sent to the clients for the given user.
+func (p *Plugin) newUserStatus(user *model.User, status string) *serializer.UserStatus {
+	identity := p.getUserIdentity(user)
+	return &serializer.UserStatus{
+		UserID: user.Id,
+		Email:  identity,
+		SIPURI: p.getSIPURI(user, identity),
+		Status: status,
+	}
+}
+
+// newUserStatusFromModel creates the status sent to the clients from the status of the user stored by Mattermost.
+func (p *Plugin) newUserStatusFromModel(user *model.User, status *model.Status) *serializer.UserStatus {
+	userStatus := p.newUserStatus(user, status.Status)
+	userStatus.LastActivityAt = status.LastActivityAt
+	return userStatus
+}
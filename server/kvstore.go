@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+)
+
+// kvGetJSON loads the JSON value stored against the key into v. It returns false if the key is not present.
+func (p *Plugin) kvGetJSON(key string, v interface{}) (bool, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return false, errors.Wrapf(appErr, "failed to get the value for key %s", key)
+	}
+
+	if data == nil {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, errors.Wrapf(err, "failed to unmarshal the value for key %s", key)
+	}
+
+	return true, nil
+}
+
+// kvSetJSON stores v as JSON against the key.
+func (p *Plugin) kvSetJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal the value for key %s", key)
+	}
+
+	if appErr := p.API.KVSet(key, data); appErr != nil {
+		return errors.Wrapf(appErr, "failed to set the value for key %s", key)
+	}
+
+	return nil
+}
+
+// kvSetJSONWithExpiry stores v as JSON against the key, which is deleted after the given number of seconds.
+func (p *Plugin) kvSetJSONWithExpiry(key string, v interface{}, expireInSeconds int64) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal the value for key %s", key)
+	}
+
+	if _, appErr := p.API.KVSetWithOptions(key, data, model.PluginKVSetOptions{ExpireInSeconds: expireInSeconds}); appErr != nil {
+		return errors.Wrapf(appErr, "failed to set the value for key %s", key)
+	}
+
+	return nil
+}
+
+func (p *Plugin) kvDelete(key string) error {
+	if appErr := p.API.KVDelete(key); appErr != nil {
+		return errors.Wrapf(appErr, "failed to delete the value for key %s", key)
+	}
+
+	return nil
+}
+
+// kvListKeys returns all the keys with the given prefix.
+func (p *Plugin) kvListKeys(prefix string) ([]string, error) {
+	var keys []string
+	for page := 0; ; page++ {
+		pageKeys, appErr := p.API.KVList(page, constants.KVListPerPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to list the keys")
+		}
+
+		for _, key := range pageKeys {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+
+		if len(pageKeys) < constants.KVListPerPage {
+			return keys, nil
+		}
+	}
+}
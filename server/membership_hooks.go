@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
+)
+
+// The membership hooks keep the subscriptions of the websocket clients scoped to a team or channel up to date,
+// along with the team members cached for the presence policy.
+// There are no hooks for group membership, so the subscriptions of the clients scoped to a group are resolved only once when they connect.
+
+func (p *Plugin) UserHasJoinedTeam(c *plugin.Context, teamMember *model.TeamMember, actor *model.User) {
+	p.publishMembershipChange(&websocket.MembershipChange{
+		TeamID: teamMember.TeamId,
+		UserID: teamMember.UserId,
+		Joined: true,
+	})
+}
+
+func (p *Plugin) UserHasLeftTeam(c *plugin.Context, teamMember *model.TeamMember, actor *model.User) {
+	p.publishMembershipChange(&websocket.MembershipChange{
+		TeamID: teamMember.TeamId,
+		UserID: teamMember.UserId,
+	})
+}
+
+func (p *Plugin) UserHasJoinedChannel(c *plugin.Context, channelMember *model.ChannelMember, actor *model.User) {
+	p.publishMembershipChange(&websocket.MembershipChange{
+		ChannelID: channelMember.ChannelId,
+		UserID:    channelMember.UserId,
+		Joined:    true,
+	})
+}
+
+func (p *Plugin) UserHasLeftChannel(c *plugin.Context, channelMember *model.ChannelMember, actor *model.User) {
+	p.publishMembershipChange(&websocket.MembershipChange{
+		ChannelID: channelMember.ChannelId,
+		UserID:    channelMember.UserId,
+	})
+}
+
+// publishMembershipChange updates the subscriptions of the clients connected to this server
+// and publishes a cluster event so that the other servers can do the same.
+func (p *Plugin) publishMembershipChange(change *websocket.MembershipChange) {
+	p.policyMembership.invalidate(teamMembershipKey(change.TeamID))
+	p.wsPool.UpdateMembership(change)
+
+	if err := p.publishClusterEvent(constants.ClusterEventMembershipChanged, change); err != nil {
+		p.API.LogDebug("Error in publishing the membership change to clusters", "Error", err.Error())
+	}
+}
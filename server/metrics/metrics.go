@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "outlook_presence"
+
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+// Metrics holds the Prometheus metrics of the plugin. Every server in the cluster exposes its own metrics,
+// which are labeled with the name of the server so that they can be told apart once they are scraped.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	connectedClients   *prometheus.GaugeVec
+	eventsReceived     prometheus.Counter
+	eventsBroadcast    prometheus.Counter
+	eventsDropped      prometheus.Counter
+	eventsCoalesced    prometheus.Counter
+	writeErrors        prometheus.Counter
+	fanOutDuration     prometheus.Histogram
+	statusRequestTime  prometheus.Histogram
+	statusPageSize     prometheus.Histogram
+	clusterEventsCount *prometheus.CounterVec
+	clusterDiscarded   *prometheus.CounterVec
+}
+
+func New(node string) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		connectedClients: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connected_clients",
+			Help:      "The number of clients connected to this server, by type of connection.",
+		}, []string{"type"}),
+		eventsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_received_total",
+			Help:      "The number of status changed events received through the publish API.",
+		}),
+		eventsBroadcast: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_broadcast_total",
+			Help:      "The number of events broadcasted to the connected clients.",
+		}),
+		eventsDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_dropped_total",
+			Help:      "The number of events not sent to a client because its buffer was full.",
+		}),
+		eventsCoalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_coalesced_total",
+			Help:      "The number of events replaced by a newer event of the same user before a batch was sent to a client.",
+		}),
+		writeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "write_errors_total",
+			Help:      "The number of errors while writing an event to a client.",
+		}),
+		fanOutDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fan_out_duration_seconds",
+			Help:      "The time taken by a shard of the connection pool to send an event to its subscribed clients.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		statusRequestTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "status_request_duration_seconds",
+			Help:      "The time taken to serve a request to the status API.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		statusPageSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "status_page_size",
+			Help:      "The number of statuses returned by a request to the status API.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		clusterEventsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cluster_events_total",
+			Help:      "The number of cluster events sent and received by this server.",
+		}, []string{"event", "direction"}),
+		clusterDiscarded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cluster_status_events_discarded_total",
+			Help:      "The number of status events received from the other servers which were discarded, by reason.",
+		}, []string{"reason"}),
+	}
+
+	// The node label is added to all the metrics, including the process and Go metrics
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"node": node}, m.registry)
+	registerer.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: namespace}),
+		collectors.NewGoCollector(),
+		m.connectedClients,
+		m.eventsReceived,
+		m.eventsBroadcast,
+		m.eventsDropped,
+		m.eventsCoalesced,
+		m.writeErrors,
+		m.fanOutDuration,
+		m.statusRequestTime,
+		m.statusPageSize,
+		m.clusterEventsCount,
+		m.clusterDiscarded,
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// The methods below are safe to call on a nil *Metrics, which is useful for the code which runs without metrics, like the benchmarks.
+
+func (m *Metrics) AddConnectedClients(clientType string, delta int) {
+	if m != nil {
+		m.connectedClients.WithLabelValues(clientType).Add(float64(delta))
+	}
+}
+
+func (m *Metrics) IncEventsReceived() {
+	if m != nil {
+		m.eventsReceived.Inc()
+	}
+}
+
+func (m *Metrics) IncEventsBroadcast() {
+	if m != nil {
+		m.eventsBroadcast.Inc()
+	}
+}
+
+func (m *Metrics) IncEventsDropped() {
+	if m != nil {
+		m.eventsDropped.Inc()
+	}
+}
+
+func (m *Metrics) IncEventsCoalesced() {
+	if m != nil {
+		m.eventsCoalesced.Inc()
+	}
+}
+
+func (m *Metrics) IncWriteErrors() {
+	if m != nil {
+		m.writeErrors.Inc()
+	}
+}
+
+func (m *Metrics) ObserveFanOutDuration(d time.Duration) {
+	if m != nil {
+		m.fanOutDuration.Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) ObserveStatusRequest(d time.Duration, pageSize int) {
+	if m != nil {
+		m.statusRequestTime.Observe(d.Seconds())
+		m.statusPageSize.Observe(float64(pageSize))
+	}
+}
+
+func (m *Metrics) IncClusterEventsSent(event string) {
+	if m != nil {
+		m.clusterEventsCount.WithLabelValues(event, directionSent).Inc()
+	}
+}
+
+func (m *Metrics) IncClusterEventsReceived(event string) {
+	if m != nil {
+		m.clusterEventsCount.WithLabelValues(event, directionReceived).Inc()
+	}
+}
+
+func (m *Metrics) IncClusterEventsDiscarded(reason string) {
+	if m != nil {
+		m.clusterDiscarded.WithLabelValues(reason).Inc()
+	}
+}
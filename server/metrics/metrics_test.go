@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestNodeLabel(t *testing.T) {
+	m := New("node-1")
+	m.IncEventsReceived()
+
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(families) == 0 {
+		t.Fatal("no metrics were gathered")
+	}
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			node := ""
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "node" {
+					node = label.GetValue()
+				}
+			}
+
+			if node != "node-1" {
+				t.Errorf("got node %q for %s, want %q", node, family.GetName(), "node-1")
+			}
+		}
+	}
+}
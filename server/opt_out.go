@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// presenceOptOuts contains the IDs of the users who opted out of sharing their presence with the external clients.
+// The preferences are stored in the KV store and loaded when the plugin is activated, and the servers notify each other
+// of the changes, so that the users can be checked for every status change without reading the KV store.
+type presenceOptOuts struct {
+	lock  sync.RWMutex
+	users map[string]bool
+}
+
+func newPresenceOptOuts() *presenceOptOuts {
+	return &presenceOptOuts{
+		users: make(map[string]bool),
+	}
+}
+
+func (o *presenceOptOuts) isOptedOut(userID string) bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.users[userID]
+}
+
+// set records the preference of the user. It returns false if the preference did not change.
+func (o *presenceOptOuts) set(userID string, optedOut bool) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.users[userID] == optedOut {
+		return false
+	}
+
+	if optedOut {
+		o.users[userID] = true
+	} else {
+		delete(o.users, userID)
+	}
+	return true
+}
+
+// loadOptOuts loads the users who opted out from the KV store.
+func (p *Plugin) loadOptOuts() error {
+	keys, err := p.kvListKeys(constants.KeyPrefixOptOut)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		p.optOuts.set(strings.TrimPrefix(key, constants.KeyPrefixOptOut), true)
+	}
+
+	return nil
+}
+
+// setPresenceOptOut stores the preference of the user and publishes the resulting change of the user's presence
+// to the clients connected to all the servers and to the webhook targets.
+func (p *Plugin) setPresenceOptOut(userID string, optedOut bool) error {
+	key := constants.KeyPrefixOptOut + userID
+	if optedOut {
+		if err := p.kvSetJSON(key, &serializer.PresencePreference{OptedOut: true, UpdateAt: model.GetMillis()}); err != nil {
+			return err
+		}
+	} else if err := p.kvDelete(key); err != nil {
+		return err
+	}
+
+	change := &serializer.OptOutChange{
+		UserID:   userID,
+		OptedOut: optedOut,
+	}
+
+	event, err := p.applyOptOutChange(change)
+	if err != nil {
+		return err
+	}
+
+	if event != nil {
+		eventName := event.Event
+		if eventName == "" {
+			eventName = constants.EventStatusChanged
+		}
+
+		p.publishWebhookEvent(&webhookEvent{
+			Event:  eventName,
+			UserID: event.UserID,
+			Status: event.Status,
+			Data:   event,
+		})
+	}
+
+	if err = p.publishClusterEvent(constants.ClusterEventOptOutChanged, change); err != nil {
+		p.API.LogDebug("Error in publishing the opt-out change to clusters", "Error", err.Error())
+	}
+
+	return nil
+}
+
+// applyOptOutChange records the preference of the user and sends the change of the user's presence to the clients
+// connected to this server. A user who opts out is reported as offline, or removed if the admin chose to omit such users,
+// while a user who opts back in is reported with their current status, as decided by the presence policy. It returns the event sent to the clients,
+// or nil if the preference did not change.
+func (p *Plugin) applyOptOutChange(change *serializer.OptOutChange) (*serializer.UserStatus, error) {
+	if !p.optOuts.set(change.UserID, change.OptedOut) {
+		return nil, nil
+	}
+
+	user, appErr := p.API.GetUser(change.UserID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get the user")
+	}
+
+	event := p.newUserStatus(user, model.StatusOffline)
+	if !change.OptedOut {
+		userStatus, statusErr := p.API.GetUserStatus(user.Id)
+		if statusErr != nil {
+			return nil, errors.Wrap(statusErr, "failed to get the status")
+		}
+		event = p.newUserStatusFromModel(user, userStatus)
+	}
+
+	if !change.OptedOut && !p.applyPresencePolicy(user, event) {
+		// The user is still omitted by a rule of the presence policy
+		return nil, nil
+	}
+
+	if p.getConfiguration().OptOutBehavior == constants.OptOutBehaviorOmit {
+		event.Event = constants.EventUserAdded
+		if change.OptedOut {
+			event.Event = constants.EventUserRemoved
+		}
+	}
+
+	p.BroadcastEvent(event)
+	return event, nil
+}
+
+func (p *Plugin) handleOptOutClusterEvent(data []byte) {
+	var change *serializer.OptOutChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	if _, err := p.applyOptOutChange(change); err != nil {
+		p.API.LogError("Unable to apply the opt-out change", "UserID", change.UserID, "Error", err.Error())
+	}
+}
+
+func (p *Plugin) handleGetPresencePreference(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get(constants.HeaderMattermostUserID)
+	p.writeJSON(w, &serializer.PresencePreference{OptedOut: p.optOuts.isOptedOut(userID)})
+}
+
+func (p *Plugin) handleUpdatePresencePreference(w http.ResponseWriter, r *http.Request) {
+	preference, err := serializer.PresencePreferenceFromJSON(r.Body)
+	if err != nil || preference == nil {
+		p.writeError(w, "Error in deserializing the request body.", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Header.Get(constants.HeaderMattermostUserID)
+	if err = p.setPresenceOptOut(userID, preference.OptedOut); err != nil {
+		p.writeError(w, fmt.Sprintf("Error in saving the preference. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, &serializer.PresencePreference{OptedOut: preference.OptedOut})
+}
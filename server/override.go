@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// presenceOverrides contains the overrides set by the admins, including the ones which haven't started yet.
+// The overrides are stored in the KV store and loaded when the plugin is activated, and the servers notify each other
+// of the changes, so that the overrides can be checked for every status sent to the clients without reading the KV store.
+type presenceOverrides struct {
+	lock      sync.Mutex
+	overrides map[string]*serializer.PresenceOverride
+
+	// active contains the users whose override was in effect when it was last checked,
+	// so that the start and the end of the overrides are detected
+	active map[string]bool
+}
+
+func newPresenceOverrides() *presenceOverrides {
+	return &presenceOverrides{
+		overrides: make(map[string]*serializer.PresenceOverride),
+		active:    make(map[string]bool),
+	}
+}
+
+// get returns the override of the user in effect at the given time, if any.
+func (o *presenceOverrides) get(userID string, now int64) *serializer.PresenceOverride {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if override, ok := o.overrides[userID]; ok && override.IsInEffect(now) {
+		return override
+	}
+	return nil
+}
+
+func (o *presenceOverrides) list(now int64) []*serializer.PresenceOverride {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	overrides := make([]*serializer.PresenceOverride, 0, len(o.overrides))
+	for _, override := range o.overrides {
+		listed := *override
+		listed.Active = override.IsInEffect(now)
+		overrides = append(overrides, &listed)
+	}
+
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].StartAt < overrides[j].StartAt
+	})
+	return overrides
+}
+
+// set replaces the override of the user, or removes it if the override is nil. It returns true if the status shown
+// for the user might have changed, which is the case if either the previous or the new override is in effect.
+func (o *presenceOverrides) set(userID string, override *serializer.PresenceOverride, now int64) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	wasActive := o.active[userID]
+	delete(o.active, userID)
+	delete(o.overrides, userID)
+
+	if override == nil || now >= override.EndAt {
+		return wasActive
+	}
+
+	o.overrides[userID] = override
+	if override.IsInEffect(now) {
+		o.active[userID] = true
+		return true
+	}
+	return wasActive
+}
+
+// check returns the overrides which started or ended since they were last checked, and removes the ended overrides.
+func (o *presenceOverrides) check(now int64) []*serializer.PresenceOverride {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var changed []*serializer.PresenceOverride
+	for userID, override := range o.overrides {
+		if now >= override.EndAt {
+			delete(o.overrides, userID)
+		}
+
+		inEffect := override.IsInEffect(now)
+		if inEffect == o.active[userID] {
+			continue
+		}
+
+		if inEffect {
+			o.active[userID] = true
+		} else {
+			delete(o.active, userID)
+		}
+		changed = append(changed, override)
+	}
+
+	return changed
+}
+
+// overrideWatcher publishes the status of the users whose override started or ended. Every server in the cluster
+// checks the overrides for its own clients, and one of them delivers the change to the webhook targets.
+type overrideWatcher struct {
+	p    *Plugin
+	stop chan struct{}
+}
+
+func newOverrideWatcher(p *Plugin) *overrideWatcher {
+	return &overrideWatcher{
+		p:    p,
+		stop: make(chan struct{}),
+	}
+}
+
+func (w *overrideWatcher) Start() {
+	go w.run()
+}
+
+func (w *overrideWatcher) Stop() {
+	close(w.stop)
+}
+
+func (w *overrideWatcher) run() {
+	ticker := time.NewTicker(constants.OverrideCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *overrideWatcher) check() {
+	now := model.GetMillis()
+	for _, override := range w.p.overrides.check(now) {
+		event, err := w.p.broadcastCurrentPresence(override.UserID)
+		if err != nil {
+			w.p.API.LogError("Unable to publish the status of the overridden user", "UserID", override.UserID, "Error", err.Error())
+			continue
+		}
+
+		// The claim expires once all the servers have checked the overrides
+		transition := fmt.Sprintf("%s:%d:%d:%t", override.UserID, override.StartAt, override.EndAt, override.IsInEffect(now))
+		claimed, err := w.p.claimClusterEvent(constants.KeyPrefixOverrideEvent, transition, 2*constants.OverrideCheckInterval)
+		if err != nil {
+			w.p.API.LogWarn("Unable to claim the override change", "UserID", override.UserID, "Error", err.Error())
+			continue
+		}
+
+		if claimed && event != nil {
+			w.p.publishStatusWebhookEvent(event)
+		}
+	}
+}
+
+// loadOverrides loads the overrides from the KV store. The ended overrides are expired by the KV store.
+func (p *Plugin) loadOverrides() error {
+	keys, err := p.kvListKeys(constants.KeyPrefixOverride)
+	if err != nil {
+		return err
+	}
+
+	now := model.GetMillis()
+	for _, key := range keys {
+		var override *serializer.PresenceOverride
+		if _, err = p.kvGetJSON(key, &override); err != nil || override == nil {
+			continue
+		}
+		p.overrides.set(override.UserID, override, now)
+	}
+
+	return nil
+}
+
+// setPresenceOverride stores the override of the user, or removes it if the override is nil, and publishes the resulting
+// change of the user's presence to the clients connected to all the servers and to the webhook targets.
+func (p *Plugin) setPresenceOverride(userID string, override *serializer.PresenceOverride) error {
+	key := constants.KeyPrefixOverride + userID
+	if override != nil {
+		// The override is deleted by the KV store once it ends
+		expiry := (override.EndAt-model.GetMillis())/1000 + 1
+		if err := p.kvSetJSONWithExpiry(key, override, expiry); err != nil {
+			return err
+		}
+	} else if err := p.kvDelete(key); err != nil {
+		return err
+	}
+
+	change := &serializer.OverrideChange{
+		UserID:   userID,
+		Override: override,
+	}
+
+	event, err := p.applyOverrideChange(change)
+	if err != nil {
+		return err
+	}
+
+	if event != nil {
+		p.publishStatusWebhookEvent(event)
+	}
+
+	if err = p.publishClusterEvent(constants.ClusterEventOverrideChanged, change); err != nil {
+		p.API.LogDebug("Error in publishing the override change to clusters", "Error", err.Error())
+	}
+
+	return nil
+}
+
+// applyOverrideChange records the override and sends the change of the user's presence to the clients connected
+// to this server, if the status shown for the user changed. It returns the event sent to the clients, if any.
+func (p *Plugin) applyOverrideChange(change *serializer.OverrideChange) (*serializer.UserStatus, error) {
+	if !p.overrides.set(change.UserID, change.Override, model.GetMillis()) {
+		return nil, nil
+	}
+
+	return p.broadcastCurrentPresence(change.UserID)
+}
+
+// broadcastCurrentPresence sends the current status of the user, as decided by the presence policy, to the clients
+// connected to this server. It returns the event sent to the clients, or nil if the user is omitted.
+func (p *Plugin) broadcastCurrentPresence(userID string) (*serializer.UserStatus, error) {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get the user")
+	}
+
+	status, appErr := p.API.GetUserStatus(userID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get the status")
+	}
+
+	event := p.newUserStatusFromModel(user, status)
+	if !p.applyPresencePolicy(user, event) {
+		return nil, nil
+	}
+
+	p.BroadcastEvent(event)
+	return event, nil
+}
+
+func (p *Plugin) publishStatusWebhookEvent(event *serializer.UserStatus) {
+	p.publishWebhookEvent(&webhookEvent{
+		Event:  constants.EventStatusChanged,
+		UserID: event.UserID,
+		Status: event.Status,
+		Data:   event,
+	})
+}
+
+func (p *Plugin) handleOverrideClusterEvent(data []byte) {
+	var change *serializer.OverrideChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	if _, err := p.applyOverrideChange(change); err != nil {
+		p.API.LogError("Unable to apply the override change", "UserID", change.UserID, "Error", err.Error())
+	}
+}
+
+// preparePresenceOverride validates an override set by an admin. The override starts immediately if no start is given.
+func preparePresenceOverride(override *serializer.PresenceOverride, createdBy string) error {
+	now := model.GetMillis()
+	if override.StartAt == 0 {
+		override.StartAt = now
+	}
+	override.CreatedBy = createdBy
+	override.CreateAt = now
+	override.Active = false
+	override.Reason = strings.TrimSpace(override.Reason)
+
+	if err := override.IsValid(); err != nil {
+		return err
+	}
+
+	if override.EndAt <= now {
+		return errors.New("the override must end in the future")
+	}
+
+	return nil
+}
+
+func (p *Plugin) handleGetOverrides(w http.ResponseWriter, r *http.Request) {
+	p.writeJSON(w, p.overrides.list(model.GetMillis()))
+}
+
+func (p *Plugin) handleSetOverride(w http.ResponseWriter, r *http.Request) {
+	override, err := serializer.PresenceOverrideFromJSON(r.Body)
+	if err != nil || override == nil {
+		p.writeError(w, "Error in deserializing the request body.", http.StatusBadRequest)
+		return
+	}
+
+	override.UserID = mux.Vars(r)[constants.UserID]
+	if err = preparePresenceOverride(override, r.Header.Get(constants.HeaderMattermostUserID)); err != nil {
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, appErr := p.API.GetUser(override.UserID); appErr != nil {
+		p.writeError(w, fmt.Sprintf("Unable to get user by id %s. Error: %s", override.UserID, appErr.Error()), appErr.StatusCode)
+		return
+	}
+
+	if err = p.setPresenceOverride(override.UserID, override); err != nil {
+		p.writeError(w, fmt.Sprintf("Error in saving the override. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	override.Active = override.IsInEffect(model.GetMillis())
+	p.writeJSON(w, override)
+}
+
+func (p *Plugin) handleRemoveOverride(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)[constants.UserID]
+	if !model.IsValidId(userID) {
+		p.writeError(w, "user_id is not valid", http.StatusBadRequest)
+		return
+	}
+
+	if err := p.setPresenceOverride(userID, nil); err != nil {
+		p.writeError(w, fmt.Sprintf("Error in removing the override. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	writeStatusOK(w)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+func newTestOverride(userID string, startAt, endAt int64) *serializer.PresenceOverride {
+	return &serializer.PresenceOverride{UserID: userID, Status: model.StatusDnd, StartAt: startAt, EndAt: endAt}
+}
+
+func TestPresenceOverridesSet(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		previous *serializer.PresenceOverride
+		override *serializer.PresenceOverride
+		changed  bool
+		inEffect bool
+	}{
+		{
+			name:     "override in effect",
+			override: newTestOverride("user", 0, 2000),
+			changed:  true,
+			inEffect: true,
+		},
+		{
+			name:     "override starting later",
+			override: newTestOverride("user", 2000, 3000),
+		},
+		{
+			name:     "ended override",
+			override: newTestOverride("user", 0, 1000),
+		},
+		{
+			name:     "override in effect removed",
+			previous: newTestOverride("user", 0, 2000),
+			changed:  true,
+		},
+		{
+			name:     "override starting later removed",
+			previous: newTestOverride("user", 2000, 3000),
+		},
+		{
+			name:     "override in effect replaced by a later override",
+			previous: newTestOverride("user", 0, 2000),
+			override: newTestOverride("user", 2000, 3000),
+			changed:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := newPresenceOverrides()
+			if test.previous != nil {
+				o.set("user", test.previous, 1000)
+			}
+
+			if changed := o.set("user", test.override, 1000); changed != test.changed {
+				t.Errorf("got changed %t, want %t", changed, test.changed)
+			}
+			if inEffect := o.get("user", 1000) != nil; inEffect != test.inEffect {
+				t.Errorf("got in effect %t, want %t", inEffect, test.inEffect)
+			}
+		})
+	}
+}
+
+func TestPresenceOverridesCheck(t *testing.T) {
+	o := newPresenceOverrides()
+	o.set("a", newTestOverride("a", 0, 2000), 1000)
+	o.set("b", newTestOverride("b", 1500, 3000), 1000)
+
+	changedUsers := func(now int64) []string {
+		users := []string{}
+		for _, override := range o.check(now) {
+			users = append(users, override.UserID)
+		}
+		return users
+	}
+
+	for _, test := range []struct {
+		now     int64
+		changed []string
+		listed  int
+	}{
+		{now: 1000, changed: []string{}, listed: 2},
+		{now: 1500, changed: []string{"b"}, listed: 2},
+		{now: 1600, changed: []string{}, listed: 2},
+		{now: 2000, changed: []string{"a"}, listed: 1},
+		{now: 3000, changed: []string{"b"}, listed: 0},
+	} {
+		if changed := changedUsers(test.now); !reflect.DeepEqual(changed, test.changed) {
+			t.Errorf("at %d: got %v changed, want %v", test.now, changed, test.changed)
+		}
+		if listed := len(o.list(test.now)); listed != test.listed {
+			t.Errorf("at %d: got %d overrides, want %d", test.now, listed, test.listed)
+		}
+	}
+}
+
+func TestPreparePresenceOverride(t *testing.T) {
+	now := model.GetMillis()
+	userID := model.NewId()
+
+	for _, test := range []struct {
+		name     string
+		override *serializer.PresenceOverride
+		valid    bool
+	}{
+		{
+			name:     "starts immediately",
+			override: &serializer.PresenceOverride{UserID: userID, Status: model.StatusDnd, EndAt: now + 60000},
+			valid:    true,
+		},
+		{
+			name:     "starts later",
+			override: &serializer.PresenceOverride{UserID: userID, Status: model.StatusAway, StartAt: now + 60000, EndAt: now + 120000},
+			valid:    true,
+		},
+		{
+			name:     "invalid user",
+			override: &serializer.PresenceOverride{UserID: "user", Status: model.StatusDnd, EndAt: now + 60000},
+		},
+		{
+			name:     "invalid status",
+			override: &serializer.PresenceOverride{UserID: userID, Status: "busy", EndAt: now + 60000},
+		},
+		{
+			name:     "ends before it starts",
+			override: &serializer.PresenceOverride{UserID: userID, Status: model.StatusDnd, StartAt: now + 60000, EndAt: now + 30000},
+		},
+		{
+			name:     "ended",
+			override: &serializer.PresenceOverride{UserID: userID, Status: model.StatusDnd, StartAt: now - 60000, EndAt: now - 30000},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.override.Active = true
+			test.override.Reason = "  on leave  "
+			err := preparePresenceOverride(test.override, "admin")
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v, want valid %t", err, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+
+			if test.override.StartAt == 0 || test.override.CreatedBy != "admin" || test.override.Active || test.override.Reason != "on leave" {
+				t.Errorf("the override was not prepared: %+v", test.override)
+			}
+		})
+	}
+}
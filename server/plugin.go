@@ -8,8 +8,10 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/pkg/errors"
 
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/metrics"
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
 )
@@ -26,33 +28,191 @@ type Plugin struct {
 	configuration *configuration
 	router        *mux.Router
 	wsPool        *websocket.Pool
+	directory     *userDirectory
+	metrics       *metrics.Metrics
+
+	// directoryWatcher detects the users which were created, deactivated or had their email changed
+	directoryWatcher *directoryWatcher
+
+	// optOuts contains the users who opted out of sharing their presence, and policyMembership caches
+	// the members of the teams and groups referenced by the presence policy
+	optOuts          *presenceOptOuts
+	policyMembership *policyMembership
+
+	// overrides contains the statuses set by the admins for the users, and overrideWatcher publishes their start and end
+	overrides       *presenceOverrides
+	overrideWatcher *overrideWatcher
+
+	// statusDamper holds back the status changes which must last for a minimum time before they are published
+	statusDamper *statusDamper
+
+	// aliasLock synchronizes the updates to the aliases of the users, and aliases caches the aliases of every user.
+	aliasLock sync.Mutex
+	aliases   *aliasCache
+
+	// webhooks caches the webhook targets, which are updated by all the servers
+	webhooks          *webhookCache
+	webhookDispatcher *webhookDispatcher
+
+	// nodeName identifies this server in the cluster
+	nodeName   string
+	registry   *connectionRegistry
+	eventOrder *eventOrderer
+
+	// clusterRequests contains the pending requests to the other servers, like the requests for their connected clients,
+	// by request ID. The reports of the servers are passed to the request through the channel.
+	clusterRequestsLock sync.Mutex
+	clusterRequests     map[string]chan interface{}
+
+	// presenceTrace keeps the latest status changes of every user handled by this server
+	presenceTrace *presenceTracer
 }
 
 // ServeHTTP handles HTTP requests
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
 	p.API.LogDebug("New plugin request:", "Host", r.Host, "RequestURI", r.RequestURI, "Method", r.Method)
-	p.router.ServeHTTP(w, r)
+	p.router.ServeHTTP(w, withPluginContext(r, c))
 }
 
 func (p *Plugin) OnPluginClusterEvent(c *plugin.Context, ev model.PluginClusterEvent) {
-	if ev.Id != constants.ClusterEvent {
-		return
+	p.metrics.IncClusterEventsReceived(ev.Id)
+
+	switch ev.Id {
+	case constants.ClusterEvent:
+		p.handleStatusClusterEvent(ev.Data)
+	case constants.ClusterEventMembershipChanged:
+		var change *websocket.MembershipChange
+		if err := json.Unmarshal(ev.Data, &change); err != nil {
+			p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+			return
+		}
+
+		p.policyMembership.invalidate(teamMembershipKey(change.TeamID))
+		p.wsPool.UpdateMembership(change)
+	case constants.ClusterEventClientsRequested:
+		p.handleClientsRequested(ev.Data)
+	case constants.ClusterEventClientsReported:
+		p.handleClientsReported(ev.Data)
+	case constants.ClusterEventDisconnectClient:
+		p.handleDisconnectClientRequested(ev.Data)
+	case constants.ClusterEventNodeSummary:
+		p.registry.handleNodeSummary(ev.Data)
+	case constants.ClusterEventUserAdded:
+		p.handleUserAddedClusterEvent(ev.Data)
+	case constants.ClusterEventOptOutChanged:
+		p.handleOptOutClusterEvent(ev.Data)
+	case constants.ClusterEventOverrideChanged:
+		p.handleOverrideClusterEvent(ev.Data)
+	case constants.ClusterEventStatusPending:
+		p.handlePendingStatusClusterEvent(ev.Data)
+	case constants.ClusterEventWebhooksChanged:
+		p.webhooks.invalidate()
+	case constants.ClusterEventAliasesChanged:
+		p.handleAliasesClusterEvent(ev.Data)
+	case constants.ClusterEventTraceRequested:
+		p.handleTraceRequested(ev.Data)
+	case constants.ClusterEventTraceReported:
+		p.handleTraceReported(ev.Data)
 	}
+}
 
-	var event *serializer.UserStatus
-	if err := json.Unmarshal(ev.Data, &event); err != nil {
+// handleStatusClusterEvent broadcasts a status change published by another server, unless it is duplicated
+// or older than the latest status change of the user.
+func (p *Plugin) handleStatusClusterEvent(data []byte) {
+	var event *serializer.StatusEvent
+	if err := json.Unmarshal(data, &event); err != nil {
 		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
 		return
 	}
 
-	// Broadcast the event for all the clusters
-	p.BroadcastEvent(event)
+	// The servers running an older version of the plugin publish the status change without an event
+	if event.Status == nil {
+		var status *serializer.UserStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+			return
+		}
+
+		// The presence policy is applied here, as the older servers don't apply it
+		user, appErr := p.API.GetUser(status.UserID)
+		if appErr != nil {
+			p.API.LogDebug("Unable to get the user of the status change", "UserID", status.UserID, "Error", appErr.Error())
+			return
+		}
+
+		trace := &serializer.ClusterEventTrace{
+			Status:         status.Status,
+			LegacyProtocol: true,
+		}
+		defer p.presenceTrace.recordClusterEvent(status.UserID, trace)
+
+		if p.applyPresencePolicy(user, status) {
+			trace.Accepted = true
+			p.BroadcastEvent(status)
+		} else {
+			trace.DiscardReason = discardReasonOmitted
+		}
+		return
+	}
+
+	trace := &serializer.ClusterEventTrace{
+		EventID:     event.ID,
+		Origin:      event.Origin,
+		LogicalTime: event.Timestamp,
+		Status:      event.Status.Status,
+	}
+	defer p.presenceTrace.recordClusterEvent(event.Status.UserID, trace)
+
+	// The user might have opted out after the status change was published
+	if p.optOuts.isOptedOut(event.Status.UserID) {
+		trace.DiscardReason = discardReasonOptedOut
+		return
+	}
+
+	if ok, reason := p.eventOrder.accept(event); !ok {
+		trace.DiscardReason = reason
+		p.metrics.IncClusterEventsDiscarded(reason)
+		p.API.LogDebug("Discarding the status event", "EventID", event.ID, "Origin", event.Origin, "Reason", reason)
+		return
+	}
+
+	trace.Accepted = true
+	since := event.Status.StatusSince
+	if since == 0 {
+		// The servers running an older version of the plugin don't send the time
+		since = model.GetMillis()
+	}
+	p.statusDamper.published(event.Status.UserID, event.Status.Status, since)
+	p.broadcastEventAt(event.Status, event.Timestamp)
+}
+
+// publishClusterEvent publishes an event which is handled by all the other servers in the cluster (not the current server).
+func (p *Plugin) publishClusterEvent(id string, data interface{}) error {
+	eventBytes, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the cluster event")
+	}
+
+	p.metrics.IncClusterEventsSent(id)
+	return p.API.PublishPluginClusterEvent(model.PluginClusterEvent{
+		Id:   id,
+		Data: eventBytes,
+	}, model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable})
 }
 
-func (p *Plugin) RegisterClient(client *websocket.Client) {
-	p.wsPool.Register <- client
+func (p *Plugin) RegisterClient(client *websocket.Client) *websocket.Resume {
+	return p.wsPool.Register(client)
 }
 
+// BroadcastEvent sends a change detected by this server to its clients, at the current logical time.
 func (p *Plugin) BroadcastEvent(event *serializer.UserStatus) {
-	p.wsPool.Broadcast <- event
+	p.broadcastEventAt(event, p.eventOrder.tick())
+}
+
+// broadcastEventAt sends a change to the clients of this server. The status events published to all the servers
+// are sent with the logical time of the event, so that the clients can resume their stream from any server.
+func (p *Plugin) broadcastEventAt(event *serializer.UserStatus, logicalTime uint64) {
+	for _, e := range p.expandAliases(event) {
+		p.wsPool.Broadcast(e, logicalTime)
+	}
 }
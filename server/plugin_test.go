@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+)
+
+// testAPI is an in-memory implementation of the parts of the plugin API used by the tests.
+// The other methods panic, as they are not implemented by the embedded interface.
+type testAPI struct {
+	plugin.API
+
+	lock  sync.Mutex
+	kv    map[string][]byte
+	users []*model.User
+
+	// statuses contains the statuses of the users, who are offline if their status is not set
+	statuses map[string]*model.Status
+
+	// teams contains the IDs of the members of every team, and teamLoads counts the requests for the teams
+	teams     map[string][]string
+	teamLoads int
+
+	// kvErr is returned by the KV store if it is set
+	kvErr *model.AppError
+
+	// config is the configuration of the server
+	config *model.Config
+
+	// beforeCompareAndSet is called before a value is compared and set, to change the value in between
+	beforeCompareAndSet func(key string)
+
+	// clusterEvents contains the published cluster events
+	clusterEvents []model.PluginClusterEvent
+}
+
+func newTestAPI(users ...*model.User) *testAPI {
+	return &testAPI{
+		kv:       make(map[string][]byte),
+		users:    users,
+		statuses: make(map[string]*model.Status),
+		teams:    make(map[string][]string),
+	}
+}
+
+func newTestPlugin(api *testAPI) *Plugin {
+	p := &Plugin{}
+	p.SetAPI(api)
+	return p
+}
+
+func (a *testAPI) LogDebug(msg string, keyValuePairs ...interface{}) {}
+func (a *testAPI) LogInfo(msg string, keyValuePairs ...interface{})  {}
+func (a *testAPI) LogWarn(msg string, keyValuePairs ...interface{})  {}
+func (a *testAPI) LogError(msg string, keyValuePairs ...interface{}) {}
+
+func (a *testAPI) GetConfig() *model.Config {
+	return a.config
+}
+
+func (a *testAPI) KVGet(key string) ([]byte, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.kvErr != nil {
+		return nil, a.kvErr
+	}
+	return a.kv[key], nil
+}
+
+func (a *testAPI) KVSet(key string, value []byte) *model.AppError {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.kvErr != nil {
+		return a.kvErr
+	}
+	a.kv[key] = value
+	return nil
+}
+
+func (a *testAPI) KVSetWithOptions(key string, value []byte, options model.PluginKVSetOptions) (bool, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.kvErr != nil {
+		return false, a.kvErr
+	}
+	if options.Atomic && string(a.kv[key]) != string(options.OldValue) {
+		return false, nil
+	}
+
+	if value == nil {
+		delete(a.kv, key)
+	} else {
+		a.kv[key] = value
+	}
+	return true, nil
+}
+
+func (a *testAPI) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+	if a.beforeCompareAndSet != nil {
+		a.beforeCompareAndSet(key)
+	}
+	return a.KVSetWithOptions(key, newValue, model.PluginKVSetOptions{Atomic: true, OldValue: oldValue})
+}
+
+func (a *testAPI) KVDelete(key string) *model.AppError {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.kvErr != nil {
+		return a.kvErr
+	}
+	delete(a.kv, key)
+	return nil
+}
+
+func (a *testAPI) KVList(page, perPage int) ([]string, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.kvErr != nil {
+		return nil, a.kvErr
+	}
+
+	keys := make([]string, 0, len(a.kv))
+	for key := range a.kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if page*perPage >= len(keys) {
+		return []string{}, nil
+	}
+	keys = keys[page*perPage:]
+	if len(keys) > perPage {
+		keys = keys[:perPage]
+	}
+	return keys, nil
+}
+
+func (a *testAPI) PublishPluginClusterEvent(ev model.PluginClusterEvent, opts model.PluginClusterEventSendOptions) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.clusterEvents = append(a.clusterEvents, ev)
+	return nil
+}
+
+func (a *testAPI) findUser(match func(user *model.User) bool) (*model.User, *model.AppError) {
+	for _, user := range a.users {
+		if match(user) {
+			return user, nil
+		}
+	}
+	return nil, model.NewAppError("findUser", "user not found", nil, "", http.StatusNotFound)
+}
+
+func (a *testAPI) GetUser(userID string) (*model.User, *model.AppError) {
+	return a.findUser(func(user *model.User) bool { return user.Id == userID })
+}
+
+func (a *testAPI) GetUserByEmail(email string) (*model.User, *model.AppError) {
+	return a.findUser(func(user *model.User) bool { return user.Email == email })
+}
+
+func (a *testAPI) GetUserByUsername(username string) (*model.User, *model.AppError) {
+	return a.findUser(func(user *model.User) bool { return user.Username == username })
+}
+
+func (a *testAPI) GetTeam(teamID string) (*model.Team, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.teamLoads++
+	if _, ok := a.teams[teamID]; !ok {
+		return nil, model.NewAppError("GetTeam", "team not found", nil, "", http.StatusNotFound)
+	}
+	return &model.Team{Id: teamID}, nil
+}
+
+func (a *testAPI) GetTeamMembers(teamID string, page, perPage int) ([]*model.TeamMember, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var members []*model.TeamMember
+	for _, userID := range a.teams[teamID] {
+		members = append(members, &model.TeamMember{TeamId: teamID, UserId: userID})
+	}
+
+	if page*perPage >= len(members) {
+		return []*model.TeamMember{}, nil
+	}
+	members = members[page*perPage:]
+	if len(members) > perPage {
+		members = members[:perPage]
+	}
+	return members, nil
+}
+
+func (a *testAPI) GetUsers(options *model.UserGetOptions) ([]*model.User, *model.AppError) {
+	users := a.users
+	if options.Page*options.PerPage >= len(users) {
+		return []*model.User{}, nil
+	}
+	users = users[options.Page*options.PerPage:]
+	if len(users) > options.PerPage {
+		users = users[:options.PerPage]
+	}
+	return users, nil
+}
+
+func (a *testAPI) GetUserStatusesByIds(userIDs []string) ([]*model.Status, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	statuses := make([]*model.Status, 0, len(userIDs))
+	for _, userID := range userIDs {
+		status, ok := a.statuses[userID]
+		if !ok {
+			status = &model.Status{UserId: userID, Status: model.StatusOffline}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// userAttributes are the attributes of the users which can be matched by the policy rules.
+// The other attribute names are matched against the custom profile attributes of the users.
+var userAttributes = map[string]func(user *model.User) string{
+	"username":     func(user *model.User) string { return user.Username },
+	"position":     func(user *model.User) string { return user.Position },
+	"locale":       func(user *model.User) string { return user.Locale },
+	"auth_service": func(user *model.User) string { return user.AuthService },
+}
+
+// policyMembership caches the members of the teams and groups referenced by the policy rules,
+// as the rules are evaluated for every status sent to the clients.
+type policyMembership struct {
+	lock    sync.Mutex
+	members map[string]*membershipSnapshot
+}
+
+// membershipSnapshot contains the members of a team or group. The members are loaded without holding the lock
+// of the cache, and the evaluations needing them meanwhile wait until loaded is closed.
+type membershipSnapshot struct {
+	loaded   chan struct{}
+	userIDs  map[string]bool
+	loadedAt time.Time
+	err      error
+}
+
+func newPolicyMembership() *policyMembership {
+	return &policyMembership{
+		members: make(map[string]*membershipSnapshot),
+	}
+}
+
+// isMember checks if the user is a member of the team or group, loading its members if they are not cached.
+// The members are loaded once for all the concurrent evaluations, and a failed load is retried by the next evaluation.
+func (m *policyMembership) isMember(key, userID string, load func() (map[string]bool, *model.AppError)) (bool, error) {
+	m.lock.Lock()
+	snapshot, ok := m.members[key]
+	if ok && snapshot.isExpired() {
+		ok = false
+	}
+	if !ok {
+		snapshot = &membershipSnapshot{loaded: make(chan struct{})}
+		m.members[key] = snapshot
+	}
+	m.lock.Unlock()
+
+	if !ok {
+		m.load(key, snapshot, load)
+	}
+
+	<-snapshot.loaded
+	if snapshot.err != nil {
+		return false, snapshot.err
+	}
+	return snapshot.userIDs[userID], nil
+}
+
+func (m *policyMembership) load(key string, snapshot *membershipSnapshot, load func() (map[string]bool, *model.AppError)) {
+	defer close(snapshot.loaded)
+
+	userIDs, appErr := load()
+	snapshot.loadedAt = time.Now()
+	if appErr == nil {
+		snapshot.userIDs = userIDs
+		return
+	}
+
+	snapshot.err = appErr
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.members[key] == snapshot {
+		delete(m.members, key)
+	}
+}
+
+// isExpired checks if the members were loaded longer than the cache TTL ago. The members being loaded are not expired.
+func (s *membershipSnapshot) isExpired() bool {
+	select {
+	case <-s.loaded:
+		return time.Since(s.loadedAt) >= constants.DirectoryCacheTTL
+	default:
+		return false
+	}
+}
+
+// invalidate removes the cached members of a team, so that a membership change is reflected immediately.
+func (m *policyMembership) invalidate(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.members, key)
+}
+
+func teamMembershipKey(teamID string) string {
+	return "team:" + teamID
+}
+
+func groupMembershipKey(groupID string) string {
+	return "group:" + groupID
+}
+
+// evaluatePresencePolicy decides how the status of the user is shared with the external clients. The user's choice
+// to opt out is applied first, followed by the override set by an admin for the user and the first matching rule
+// of the policy configured by the admin. The real status is shared if no rule matches.
+func (p *Plugin) evaluatePresencePolicy(user *model.User, status string) *serializer.PolicyDecision {
+	config := p.getConfiguration()
+	decision := &serializer.PolicyDecision{
+		UserID:    user.Id,
+		RawStatus: status,
+		Status:    status,
+		Action:    serializer.PolicyActionShow,
+		RuleIndex: -1,
+	}
+
+	if p.optOuts.isOptedOut(user.Id) {
+		decision.OptedOut = true
+		decision.Action = serializer.PolicyActionOffline
+		if config.OptOutBehavior == constants.OptOutBehaviorOmit {
+			decision.Action = serializer.PolicyActionOmit
+		}
+		return applyPolicyAction(decision, nil)
+	}
+
+	if override := p.overrides.get(user.Id, model.GetMillis()); override != nil {
+		decision.Action = serializer.PolicyActionOverride
+		decision.Status = override.Status
+		decision.Override = override
+		return decision
+	}
+
+	for index, rule := range config.policyRules {
+		matches, err := p.policyRuleMatches(rule, user)
+		if err != nil {
+			// The policy fails closed, so the real status is not shared if a rule can't be evaluated
+			p.API.LogWarn("Unable to evaluate the presence policy", "UserID", user.Id, "Rule", rule.Name, "Error", err.Error())
+			decision.Rule = rule.Name
+			decision.RuleIndex = index
+			decision.Action = serializer.PolicyActionOffline
+			decision.Error = err.Error()
+			return applyPolicyAction(decision, nil)
+		}
+
+		if !matches {
+			continue
+		}
+
+		decision.Rule = rule.Name
+		decision.RuleIndex = index
+		decision.Action = rule.Action
+		return applyPolicyAction(decision, rule.StatusMap)
+	}
+
+	return decision
+}
+
+// applyPolicyAction sets the status shared with the clients according to the action of the decision.
+func applyPolicyAction(decision *serializer.PolicyDecision, statusMap map[string]string) *serializer.PolicyDecision {
+	switch decision.Action {
+	case serializer.PolicyActionOffline:
+		decision.Status = model.StatusOffline
+	case serializer.PolicyActionOmit:
+		decision.Status = ""
+		decision.Omitted = true
+	case serializer.PolicyActionMap:
+		if status, ok := statusMap[decision.RawStatus]; ok {
+			decision.Status = status
+		}
+	}
+
+	return decision
+}
+
+// applyPresencePolicy is used for every status sent to the clients, whether through the REST endpoints, the websocket
+// or the webhooks. It replaces the status according to the policy and the status changes held back by the damping,
+// and returns false if the user must be omitted.
+func (p *Plugin) applyPresencePolicy(user *model.User, status *serializer.UserStatus) bool {
+	decision := p.evaluatePresencePolicy(user, status.Status)
+	status.Status = decision.Status
+	switch decision.Action {
+	case serializer.PolicyActionShow, serializer.PolicyActionMap:
+		// The status shown to the clients is kept while a status change is held back
+		status.Status, status.StatusSince = p.shownStatus(user.Id, decision.Status)
+	case serializer.PolicyActionOverride:
+		status.OverrideReason = decision.Override.Reason
+		status.StatusSince = decision.Override.StartAt
+		status.LastActivityAt = 0
+	default:
+		// The activity of the users who are reported as offline or omitted is not revealed
+		status.StatusSince = 0
+		status.LastActivityAt = 0
+	}
+	return !decision.Omitted
+}
+
+// filterOmittedUsers removes the users omitted by the presence policy. The users are removed before paging over them,
+// so that the pages keep their size. The omission of a user does not depend on the status, so the statuses are not needed.
+func (p *Plugin) filterOmittedUsers(users []*model.User) []*model.User {
+	filtered := make([]*model.User, 0, len(users))
+	for _, user := range users {
+		if !p.evaluatePresencePolicy(user, "").Omitted {
+			filtered = append(filtered, user)
+		}
+	}
+
+	return filtered
+}
+
+// policyRuleMatches checks if the rule applies to the user. It returns an error if the members of the teams
+// or groups of the rule can't be loaded.
+func (p *Plugin) policyRuleMatches(rule *serializer.PolicyRule, user *model.User) (bool, error) {
+	if rule.Bot != nil && *rule.Bot != user.IsBot {
+		return false, nil
+	}
+
+	if len(rule.Roles) > 0 && !containsAny(rule.Roles, strings.Fields(user.Roles)) {
+		return false, nil
+	}
+
+	for name, value := range rule.Attributes {
+		attribute := user.Props[name]
+		if getAttribute, ok := userAttributes[name]; ok {
+			attribute = getAttribute(user)
+		}
+
+		if !strings.EqualFold(attribute, value) {
+			return false, nil
+		}
+	}
+
+	if len(rule.TeamIDs) > 0 {
+		if member, err := p.isMemberOfAny(rule.TeamIDs, user.Id, teamMembershipKey, p.getTeamMemberIDs); err != nil || !member {
+			return false, err
+		}
+	}
+
+	if len(rule.GroupIDs) > 0 {
+		if member, err := p.isMemberOfAny(rule.GroupIDs, user.Id, groupMembershipKey, p.getGroupMemberIDs); err != nil || !member {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// isMemberOfAny checks if the user is a member of any of the teams or groups. It returns an error if the user
+// is not a member of the teams or groups whose members were loaded, and the members of another one can't be loaded.
+func (p *Plugin) isMemberOfAny(ids []string, userID string, key func(id string) string, load func(id string) (map[string]bool, *model.AppError)) (bool, error) {
+	var loadErr error
+	for _, id := range ids {
+		id := id
+		member, err := p.policyMembership.isMember(key(id), userID, func() (map[string]bool, *model.AppError) {
+			return load(id)
+		})
+		if err != nil {
+			loadErr = errors.Wrapf(err, "failed to get the members of %s", id)
+			continue
+		}
+
+		if member {
+			return true, nil
+		}
+	}
+
+	return false, loadErr
+}
+
+func containsAny(values, candidates []string) bool {
+	for _, candidate := range candidates {
+		if containsString(values, candidate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleEvaluatePresencePolicy is a dry run of the presence policy, which returns the decision for the given user
+// and status. The current status of the user is used if no status is given.
+func (p *Plugin) handleEvaluatePresencePolicy(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID := query.Get(constants.UserID)
+	if !model.IsValidId(userID) {
+		p.writeError(w, "user_id is not valid", http.StatusBadRequest)
+		return
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.writeError(w, fmt.Sprintf("Unable to get user by id %s. Error: %s", userID, appErr.Error()), appErr.StatusCode)
+		return
+	}
+
+	status := query.Get(constants.Status)
+	if status == "" {
+		userStatus, statusErr := p.API.GetUserStatus(userID)
+		if statusErr != nil {
+			p.writeError(w, fmt.Sprintf("Error in getting status. Error: %s", statusErr.Error()), statusErr.StatusCode)
+			return
+		}
+		status = userStatus.Status
+	}
+
+	if !serializer.IsValidStatus(status) {
+		p.writeError(w, "status is not valid", http.StatusBadRequest)
+		return
+	}
+
+	p.writeJSON(w, p.evaluatePresencePolicy(user, status))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+func newTestPolicyPlugin(t *testing.T, api *testAPI, config *configuration) *Plugin {
+	if err := config.ProcessConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(api)
+	p.setConfiguration(config)
+	p.optOuts = newPresenceOptOuts()
+	p.overrides = newPresenceOverrides()
+	p.policyMembership = newPolicyMembership()
+	return p
+}
+
+func TestEvaluatePresencePolicy(t *testing.T) {
+	teamID := model.NewId()
+	otherTeamID := model.NewId()
+	unknownTeamID := model.NewId()
+	user := &model.User{Id: model.NewId(), Roles: "system_user", Position: "Engineer"}
+	guest := &model.User{Id: model.NewId(), Roles: "system_guest"}
+	bot := &model.User{Id: model.NewId(), IsBot: true}
+
+	policy := fmt.Sprintf(`[
+		{"name": "bots", "bot": true, "action": "omit"},
+		{"name": "guests", "roles": ["system_guest"], "action": "offline"},
+		{"name": "team", "team_ids": ["%s", "%s"], "action": "map", "status_map": {"away": "online", "dnd": "online"}},
+		{"name": "engineers", "attributes": {"position": "engineer"}, "action": "offline"}
+	]`, otherTeamID, teamID)
+
+	override := &serializer.PresenceOverride{UserID: user.Id, Status: model.StatusAway, Reason: "On leave", StartAt: 1, EndAt: model.GetMillis() + 60000}
+
+	for _, test := range []struct {
+		name           string
+		user           *model.User
+		status         string
+		policy         string
+		optOutBehavior string
+		optedOut       bool
+		override       *serializer.PresenceOverride
+		teamMembers    []string
+		expectedAction string
+		expectedStatus string
+		expectedRule   int
+		expectedError  bool
+	}{
+		{
+			name:           "no rules",
+			user:           user,
+			status:         model.StatusAway,
+			expectedAction: serializer.PolicyActionShow,
+			expectedStatus: model.StatusAway,
+			expectedRule:   -1,
+		},
+		{
+			name:           "bot rule",
+			user:           bot,
+			status:         model.StatusOnline,
+			policy:         policy,
+			expectedAction: serializer.PolicyActionOmit,
+			expectedRule:   0,
+		},
+		{
+			name:           "role rule",
+			user:           guest,
+			status:         model.StatusOnline,
+			policy:         policy,
+			expectedAction: serializer.PolicyActionOffline,
+			expectedStatus: model.StatusOffline,
+			expectedRule:   1,
+		},
+		{
+			name:           "team rule maps the status",
+			user:           user,
+			status:         model.StatusDnd,
+			policy:         policy,
+			teamMembers:    []string{user.Id},
+			expectedAction: serializer.PolicyActionMap,
+			expectedStatus: model.StatusOnline,
+			expectedRule:   2,
+		},
+		{
+			name:           "unmapped status is kept",
+			user:           user,
+			status:         model.StatusOffline,
+			policy:         policy,
+			teamMembers:    []string{user.Id},
+			expectedAction: serializer.PolicyActionMap,
+			expectedStatus: model.StatusOffline,
+			expectedRule:   2,
+		},
+		{
+			name:           "first matching rule applies",
+			user:           user,
+			status:         model.StatusOnline,
+			policy:         policy,
+			teamMembers:    []string{model.NewId()},
+			expectedAction: serializer.PolicyActionOffline,
+			expectedStatus: model.StatusOffline,
+			expectedRule:   3,
+		},
+		{
+			name:           "opted out user is reported as offline",
+			user:           user,
+			status:         model.StatusOnline,
+			policy:         policy,
+			optedOut:       true,
+			override:       override,
+			expectedAction: serializer.PolicyActionOffline,
+			expectedStatus: model.StatusOffline,
+			expectedRule:   -1,
+		},
+		{
+			name:           "opted out user is omitted",
+			user:           user,
+			status:         model.StatusOnline,
+			optOutBehavior: constants.OptOutBehaviorOmit,
+			optedOut:       true,
+			expectedAction: serializer.PolicyActionOmit,
+			expectedRule:   -1,
+		},
+		{
+			name:           "override before the rules",
+			user:           user,
+			status:         model.StatusOnline,
+			policy:         policy,
+			override:       override,
+			expectedAction: serializer.PolicyActionOverride,
+			expectedStatus: model.StatusAway,
+			expectedRule:   -1,
+		},
+		{
+			name:           "membership error fails closed",
+			user:           user,
+			status:         model.StatusOnline,
+			policy:         fmt.Sprintf(`[{"name": "team", "team_ids": ["%s"], "action": "show"}, {"name": "all", "action": "show"}]`, unknownTeamID),
+			expectedAction: serializer.PolicyActionOffline,
+			expectedStatus: model.StatusOffline,
+			expectedRule:   0,
+			expectedError:  true,
+		},
+		{
+			name:           "membership error ignored if the user is a member of another team",
+			user:           user,
+			status:         model.StatusOnline,
+			policy:         fmt.Sprintf(`[{"name": "team", "team_ids": ["%s", "%s"], "action": "show"}]`, unknownTeamID, teamID),
+			teamMembers:    []string{user.Id},
+			expectedAction: serializer.PolicyActionShow,
+			expectedStatus: model.StatusOnline,
+			expectedRule:   0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			api := newTestAPI(user, guest, bot)
+			api.teams[teamID] = test.teamMembers
+			api.teams[otherTeamID] = nil
+
+			optOutBehavior := test.optOutBehavior
+			if optOutBehavior == "" {
+				optOutBehavior = constants.OptOutBehaviorOffline
+			}
+			p := newTestPolicyPlugin(t, api, &configuration{PresencePolicy: test.policy, OptOutBehavior: optOutBehavior})
+			p.optOuts.set(test.user.Id, test.optedOut)
+			if test.override != nil {
+				p.overrides.set(test.user.Id, test.override, model.GetMillis())
+			}
+
+			decision := p.evaluatePresencePolicy(test.user, test.status)
+			if decision.Action != test.expectedAction || decision.Status != test.expectedStatus || decision.RuleIndex != test.expectedRule {
+				t.Errorf("got action %q, status %q and rule %d, want action %q, status %q and rule %d",
+					decision.Action, decision.Status, decision.RuleIndex, test.expectedAction, test.expectedStatus, test.expectedRule)
+			}
+
+			if (decision.Error != "") != test.expectedError {
+				t.Errorf("got error %q", decision.Error)
+			}
+			if decision.Omitted != (test.expectedAction == serializer.PolicyActionOmit) {
+				t.Errorf("got omitted %t for action %q", decision.Omitted, decision.Action)
+			}
+		})
+	}
+}
+
+func TestPolicyMembership(t *testing.T) {
+	teamID := model.NewId()
+	userID := model.NewId()
+
+	t.Run("concurrent evaluations load the members once", func(t *testing.T) {
+		api := newTestAPI()
+		api.teams[teamID] = []string{userID}
+		p := newTestPolicyPlugin(t, api, &configuration{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if member, err := p.policyMembership.isMember(teamMembershipKey(teamID), userID, func() (map[string]bool, *model.AppError) {
+					return p.getTeamMemberIDs(teamID)
+				}); err != nil || !member {
+					t.Errorf("got (%t, %v), want (true, nil)", member, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if api.teamLoads != 1 {
+			t.Errorf("got %d loads, want 1", api.teamLoads)
+		}
+	})
+
+	t.Run("failed load is retried", func(t *testing.T) {
+		api := newTestAPI()
+		p := newTestPolicyPlugin(t, api, &configuration{})
+		load := func() (map[string]bool, *model.AppError) {
+			return p.getTeamMemberIDs(teamID)
+		}
+
+		if _, err := p.policyMembership.isMember(teamMembershipKey(teamID), userID, load); err == nil {
+			t.Fatal("the load did not fail")
+		}
+
+		api.teams[teamID] = []string{userID}
+		if member, err := p.policyMembership.isMember(teamMembershipKey(teamID), userID, load); err != nil || !member {
+			t.Errorf("got (%t, %v), want (true, nil)", member, err)
+		}
+		if api.teamLoads != 2 {
+			t.Errorf("got %d loads, want 2", api.teamLoads)
+		}
+	})
+
+	t.Run("invalidated members are reloaded", func(t *testing.T) {
+		api := newTestAPI()
+		api.teams[teamID] = []string{}
+		p := newTestPolicyPlugin(t, api, &configuration{})
+		load := func() (map[string]bool, *model.AppError) {
+			return p.getTeamMemberIDs(teamID)
+		}
+
+		if member, _ := p.policyMembership.isMember(teamMembershipKey(teamID), userID, load); member {
+			t.Fatal("the user is a member before joining")
+		}
+
+		api.teams[teamID] = []string{userID}
+		p.policyMembership.invalidate(teamMembershipKey(teamID))
+		if member, _ := p.policyMembership.isMember(teamMembershipKey(teamID), userID, load); !member {
+			t.Error("the user is not a member after joining")
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// pluginContextKey is the key of the plugin context in the context of the requests
+type pluginContextKey struct{}
+
+// getPluginContext returns the context passed by the server to ServeHTTP, which identifies the session of the request.
+func getPluginContext(r *http.Request) *plugin.Context {
+	c, _ := r.Context().Value(pluginContextKey{}).(*plugin.Context)
+	if c == nil {
+		return &plugin.Context{}
+	}
+	return c
+}
+
+func withPluginContext(r *http.Request, c *plugin.Context) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pluginContextKey{}, c))
+}
+
+// presenceTracer keeps the last status change of every user relayed through the publish endpoint of this server,
+// and the last status change of every user received from the other servers. Only the last ones are kept,
+// as they are enough to explain the status shown by the clients.
+type presenceTracer struct {
+	lock          sync.Mutex
+	publishes     map[string]*serializer.PublishTrace
+	clusterEvents map[string]*serializer.ClusterEventTrace
+}
+
+func newPresenceTracer() *presenceTracer {
+	return &presenceTracer{
+		publishes:     make(map[string]*serializer.PublishTrace),
+		clusterEvents: make(map[string]*serializer.ClusterEventTrace),
+	}
+}
+
+func (t *presenceTracer) recordPublish(userID string, trace *serializer.PublishTrace) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	trace.Timestamp = model.GetMillis()
+	t.publishes[userID] = trace
+}
+
+func (t *presenceTracer) recordClusterEvent(userID string, trace *serializer.ClusterEventTrace) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	trace.ReceivedAt = model.GetMillis()
+	t.clusterEvents[userID] = trace
+}
+
+func (t *presenceTracer) get(userID string) (*serializer.PublishTrace, *serializer.ClusterEventTrace) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.publishes[userID], t.clusterEvents[userID]
+}
+
+// traceRequest is sent to the other servers in the cluster to get their traces of a user
+type traceRequest struct {
+	RequestID string `json:"request_id"`
+	UserID    string `json:"user_id"`
+}
+
+// traceReport is the response of a server to a traceRequest
+type traceReport struct {
+	RequestID string                `json:"request_id"`
+	Trace     *serializer.NodeTrace `json:"trace"`
+}
+
+// nodeTrace returns the trace of the user kept by this server.
+func (p *Plugin) nodeTrace(userID string) *serializer.NodeTrace {
+	lastPublish, lastClusterEvent := p.presenceTrace.get(userID)
+	events, clients := p.wsPool.TraceUser(userID)
+	return &serializer.NodeTrace{
+		Node:             p.nodeName,
+		LastPublish:      lastPublish,
+		LastClusterEvent: lastClusterEvent,
+		Events:           events,
+		Clients:          clients,
+	}
+}
+
+// explainPresence collects the traces of the user kept by all the servers in the cluster, along with the status
+// stored by Mattermost and the decision of the presence policy for it.
+func (p *Plugin) explainPresence(user *model.User) (*serializer.PresenceExplanation, *model.AppError) {
+	status, appErr := p.API.GetUserStatus(user.Id)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	explanation := &serializer.PresenceExplanation{
+		UserID:         user.Id,
+		Status:         status.Status,
+		Manual:         status.Manual,
+		LastActivityAt: status.LastActivityAt,
+		Policy:         p.evaluatePresencePolicy(user, status.Status),
+		Nodes:          []*serializer.NodeTrace{p.nodeTrace(user.Id)},
+	}
+
+	if !p.isClusterEnabled() {
+		return explanation, nil
+	}
+
+	requestID := model.NewId()
+	if err := p.awaitClusterReports(requestID, constants.ClusterEventTraceRequested, &traceRequest{RequestID: requestID, UserID: user.Id}, func(report interface{}) {
+		explanation.Nodes = append(explanation.Nodes, report.(*serializer.NodeTrace))
+	}); err != nil {
+		p.API.LogError("Error in requesting the traces from the other servers", "Error", err.Error())
+	}
+
+	return explanation, nil
+}
+
+// handleTraceRequested reports the trace of the user kept by this server to the server which requested it.
+func (p *Plugin) handleTraceRequested(data []byte) {
+	var request *traceRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	if err := p.publishClusterEvent(constants.ClusterEventTraceReported, &traceReport{
+		RequestID: request.RequestID,
+		Trace:     p.nodeTrace(request.UserID),
+	}); err != nil {
+		p.API.LogError("Error in reporting the trace to the other servers", "Error", err.Error())
+	}
+}
+
+// handleTraceReported passes the trace reported by another server to the pending request, if it was made by this server.
+func (p *Plugin) handleTraceReported(data []byte) {
+	var report *traceReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	if report.Trace != nil {
+		p.deliverClusterReport(report.RequestID, report.Trace)
+	}
+}
+
+// handleExplainPresence explains the status of a user shown by the clients, from the status stored by Mattermost
+// to the last status written to every client subscribed to the user.
+func (p *Plugin) handleExplainPresence(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)[constants.UserID]
+	if !model.IsValidId(userID) {
+		p.writeError(w, "user_id is not valid", http.StatusBadRequest)
+		return
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.writeError(w, fmt.Sprintf("Unable to get user by id %s. Error: %s", userID, appErr.Error()), appErr.StatusCode)
+		return
+	}
+
+	explanation, appErr := p.explainPresence(user)
+	if appErr != nil {
+		p.writeError(w, fmt.Sprintf("Error in getting status. Error: %s", appErr.Error()), appErr.StatusCode)
+		return
+	}
+
+	p.writeJSON(w, explanation)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// connectionRegistry keeps the summaries of the clients connected to all the servers in the cluster.
+// Every server periodically publishes its summary as a cluster event, and stores it in the KV store with an expiry,
+// so that a server which was just started can load the summaries of the other servers.
+type connectionRegistry struct {
+	p *Plugin
+
+	lock      sync.Mutex
+	summaries map[string]*serializer.NodeSummary
+
+	stop chan struct{}
+}
+
+func newConnectionRegistry(p *Plugin) *connectionRegistry {
+	return &connectionRegistry{
+		p:         p,
+		summaries: make(map[string]*serializer.NodeSummary),
+		stop:      make(chan struct{}),
+	}
+}
+
+func getNodeSummaryKey(node string) string {
+	hash := sha256.Sum256([]byte(node))
+	return constants.KeyPrefixNodeSummary + hex.EncodeToString(hash[:])[:32]
+}
+
+// Start loads the summaries of the other servers and starts publishing the summary of this server.
+func (r *connectionRegistry) Start() {
+	keys, err := r.p.kvListKeys(constants.KeyPrefixNodeSummary)
+	if err != nil {
+		r.p.API.LogError("Unable to load the summaries of the servers", "Error", err.Error())
+	}
+
+	for _, key := range keys {
+		var summary *serializer.NodeSummary
+		if _, err = r.p.kvGetJSON(key, &summary); err != nil || summary == nil {
+			continue
+		}
+		r.update(summary)
+	}
+
+	go r.run()
+}
+
+// Stop stops publishing the summary of this server and removes it, as its clients are disconnected.
+func (r *connectionRegistry) Stop() {
+	close(r.stop)
+	if err := r.p.kvDelete(getNodeSummaryKey(r.p.nodeName)); err != nil {
+		r.p.API.LogWarn("Unable to delete the summary of the server", "Error", err.Error())
+	}
+}
+
+func (r *connectionRegistry) run() {
+	ticker := time.NewTicker(constants.NodeSummaryInterval)
+	defer ticker.Stop()
+
+	r.publish()
+	for {
+		select {
+		case <-ticker.C:
+			r.publish()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// publish sends the summary of the clients connected to this server to the other servers.
+func (r *connectionRegistry) publish() {
+	summary := serializer.NewNodeSummary(r.p.nodeName, r.p.wsPool.ListClients(), model.GetMillis())
+	r.update(summary)
+
+	if err := r.p.kvSetJSONWithExpiry(getNodeSummaryKey(summary.Node), summary, int64(constants.NodeSummaryTTL.Seconds())); err != nil {
+		r.p.API.LogError("Unable to store the summary of the server", "Error", err.Error())
+	}
+
+	if err := r.p.publishClusterEvent(constants.ClusterEventNodeSummary, summary); err != nil {
+		r.p.API.LogError("Unable to publish the summary of the server", "Error", err.Error())
+	}
+}
+
+func (r *connectionRegistry) update(summary *serializer.NodeSummary) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if existing, ok := r.summaries[summary.Node]; ok && existing.UpdatedAt > summary.UpdatedAt {
+		return
+	}
+	r.summaries[summary.Node] = summary
+}
+
+// handleNodeSummary stores the summary published by another server.
+func (r *connectionRegistry) handleNodeSummary(data []byte) {
+	var summary *serializer.NodeSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		r.p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	r.update(summary)
+}
+
+// getClusterSummary returns the summaries of the servers which published them recently, ordered by the name of the server.
+func (r *connectionRegistry) getClusterSummary() *serializer.ClusterSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	expiredAt := model.GetMillis() - constants.NodeSummaryTTL.Milliseconds()
+	nodes := make([]*serializer.NodeSummary, 0, len(r.summaries))
+	for node, summary := range r.summaries {
+		if summary.UpdatedAt < expiredAt {
+			delete(r.summaries, node)
+			continue
+		}
+		nodes = append(nodes, summary)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node < nodes[j].Node
+	})
+
+	return serializer.NewClusterSummary(nodes)
+}
+
+func (p *Plugin) handleGetClientsSummary(w http.ResponseWriter, r *http.Request) {
+	p.writeJSON(w, p.registry.getClusterSummary())
+}
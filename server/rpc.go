@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
+)
+
+// HandleRPC handles the requests sent by the websocket clients, so that a client can get the statuses
+// through the same authenticated connection used for the status changes. A scoped client only gets the statuses
+// of the users in its scope, like with the REST endpoints.
+func (p *Plugin) HandleRPC(client *websocket.Client, method string, params json.RawMessage) (interface{}, *serializer.RPCError) {
+	switch method {
+	case serializer.RPCMethodGetStatus:
+		var getStatusParams serializer.GetStatusParams
+		if rpcErr := decodeRPCParams(params, &getStatusParams); rpcErr != nil {
+			return nil, rpcErr
+		}
+		return p.rpcGetStatus(client, &getStatusParams)
+	case serializer.RPCMethodLookup:
+		var lookupParams serializer.LookupParams
+		if rpcErr := decodeRPCParams(params, &lookupParams); rpcErr != nil {
+			return nil, rpcErr
+		}
+		return p.rpcLookup(client, &lookupParams)
+	case serializer.RPCMethodSearchUsers:
+		var searchParams serializer.SearchUsersParams
+		if rpcErr := decodeRPCParams(params, &searchParams); rpcErr != nil {
+			return nil, rpcErr
+		}
+		return p.rpcSearchUsers(client, &searchParams)
+	default:
+		return nil, serializer.NewRPCError(serializer.RPCErrorMethodNotFound, fmt.Sprintf("unknown method %q", method))
+	}
+}
+
+func decodeRPCParams(params json.RawMessage, v interface{}) *serializer.RPCError {
+	if len(params) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(params, v); err != nil {
+		return serializer.NewRPCError(serializer.RPCErrorBadRequest, fmt.Sprintf("invalid params. Error: %s", err.Error()))
+	}
+	return nil
+}
+
+// newRPCError converts the error returned by the plugin API to the error sent to the websocket client.
+func newRPCError(message string, appErr *model.AppError) *serializer.RPCError {
+	code := serializer.RPCErrorInternal
+	switch appErr.StatusCode {
+	case http.StatusNotFound:
+		code = serializer.RPCErrorNotFound
+	case http.StatusBadRequest:
+		code = serializer.RPCErrorBadRequest
+	}
+
+	return serializer.NewRPCError(code, fmt.Sprintf("%s. Error: %s", message, appErr.Error()))
+}
+
+// isInClientScope checks if the user is in the scope of the client. The users outside the scope are reported
+// as not found, like the users omitted by the presence policy.
+func (p *Plugin) isInClientScope(client *websocket.Client, userID string) bool {
+	return p.wsPool.SubscribedUsers(client, []string{userID})[userID]
+}
+
+func (p *Plugin) rpcGetStatus(client *websocket.Client, params *serializer.GetStatusParams) (interface{}, *serializer.RPCError) {
+	if !model.IsValidId(params.UserID) {
+		return nil, serializer.NewRPCError(serializer.RPCErrorBadRequest, "user_id is not valid")
+	}
+
+	if !p.isInClientScope(client, params.UserID) {
+		return nil, serializer.NewRPCError(serializer.RPCErrorNotFound, "user not found")
+	}
+
+	user, appErr := p.API.GetUser(params.UserID)
+	if appErr != nil {
+		return nil, newRPCError("Unable to get user", appErr)
+	}
+
+	status, appErr := p.API.GetUserStatus(user.Id)
+	if appErr != nil {
+		return nil, newRPCError("Error in getting status", appErr)
+	}
+
+	userStatus := p.newUserStatusFromModel(user, status)
+	if !p.applyPresencePolicy(user, userStatus) {
+		return nil, serializer.NewRPCError(serializer.RPCErrorNotFound, "user not found")
+	}
+
+	return userStatus, nil
+}
+
+func (p *Plugin) rpcLookup(client *websocket.Client, params *serializer.LookupParams) (interface{}, *serializer.RPCError) {
+	if params.Email == "" {
+		return nil, serializer.NewRPCError(serializer.RPCErrorBadRequest, "email is required")
+	}
+
+	userStatus, appErr := p.lookupStatus(params.Email)
+	if appErr != nil {
+		return nil, newRPCError(fmt.Sprintf("Unable to look up the status of %s", params.Email), appErr)
+	}
+
+	if !p.isInClientScope(client, userStatus.UserID) {
+		return nil, serializer.NewRPCError(serializer.RPCErrorNotFound, fmt.Sprintf("Unable to look up the status of %s. Error: user not found", params.Email))
+	}
+
+	return userStatus, nil
+}
+
+func (p *Plugin) rpcSearchUsers(client *websocket.Client, params *serializer.SearchUsersParams) (interface{}, *serializer.RPCError) {
+	if params.Term == "" {
+		return nil, serializer.NewRPCError(serializer.RPCErrorBadRequest, "term is required")
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = constants.DefaultSearchUsersLimit
+	}
+	if limit > constants.MaxSearchUsersLimit {
+		limit = constants.MaxSearchUsersLimit
+	}
+
+	// The search is restricted to the team or channel of the client, and the results are checked against the subscription,
+	// which is the only way to restrict them to the members of a group
+	users, appErr := p.API.SearchUsers(&model.UserSearch{
+		Term:        params.Term,
+		TeamId:      client.Scope.TeamID,
+		InChannelId: client.Scope.ChannelID,
+		Limit:       limit,
+	})
+	if appErr != nil {
+		return nil, newRPCError("Error in searching users", appErr)
+	}
+
+	userStatuses := []*serializer.UserStatus{}
+	if len(users) == 0 {
+		return userStatuses, nil
+	}
+
+	foundIDs := make([]string, len(users))
+	for index, user := range users {
+		foundIDs[index] = user.Id
+	}
+
+	subscribed := p.wsPool.SubscribedUsers(client, foundIDs)
+	userIDs := make([]string, 0, len(subscribed))
+	userMap := make(map[string]*model.User, len(subscribed))
+	for _, user := range users {
+		if subscribed[user.Id] {
+			userIDs = append(userIDs, user.Id)
+			userMap[user.Id] = user
+		}
+	}
+	if len(userIDs) == 0 {
+		return userStatuses, nil
+	}
+
+	statuses, appErr := p.API.GetUserStatusesByIds(userIDs)
+	if appErr != nil {
+		return nil, newRPCError("Error in getting statuses", appErr)
+	}
+
+	for _, status := range statuses {
+		user := userMap[status.UserId]
+		userStatus := p.newUserStatusFromModel(user, status)
+		if p.applyPresencePolicy(user, userStatus) {
+			userStatuses = append(userStatuses, userStatus)
+		}
+	}
+
+	return userStatuses, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
+)
+
+// parseScope reads the team, channel or group filter from the request. At most one filter is allowed.
+func parseScope(r *http.Request) (websocket.Scope, error) {
+	query := r.URL.Query()
+	scope := websocket.Scope{
+		TeamID:    query.Get(constants.TeamID),
+		ChannelID: query.Get(constants.ChannelID),
+		GroupID:   query.Get(constants.GroupID),
+	}
+
+	count := 0
+	for name, id := range map[string]string{
+		constants.TeamID:    scope.TeamID,
+		constants.ChannelID: scope.ChannelID,
+		constants.GroupID:   scope.GroupID,
+	} {
+		if id == "" {
+			continue
+		}
+
+		if !model.IsValidId(id) {
+			return scope, fmt.Errorf("%s is not valid", name)
+		}
+		count++
+	}
+
+	if count > 1 {
+		return scope, fmt.Errorf("only one of %s, %s and %s can be provided", constants.TeamID, constants.ChannelID, constants.GroupID)
+	}
+
+	return scope, nil
+}
+
+// getScopeUserIDs returns the IDs of the members of the team, channel or group in the scope.
+// It returns nil if the scope is empty, which means that all the users are in scope.
+func (p *Plugin) getScopeUserIDs(scope websocket.Scope) (map[string]bool, *model.AppError) {
+	switch {
+	case scope.TeamID != "":
+		return p.getTeamMemberIDs(scope.TeamID)
+	case scope.ChannelID != "":
+		return p.getChannelMemberIDs(scope.ChannelID)
+	case scope.GroupID != "":
+		return p.getGroupMemberIDs(scope.GroupID)
+	default:
+		return nil, nil
+	}
+}
+
+func (p *Plugin) getTeamMemberIDs(teamID string) (map[string]bool, *model.AppError) {
+	if _, err := p.API.GetTeam(teamID); err != nil {
+		return nil, err
+	}
+
+	userIDs := make(map[string]bool)
+	for page := 0; ; page++ {
+		members, err := p.API.GetTeamMembers(teamID, page, constants.UsersBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range members {
+			if member.DeleteAt == 0 {
+				userIDs[member.UserId] = true
+			}
+		}
+
+		if len(members) < constants.UsersBatchSize {
+			return userIDs, nil
+		}
+	}
+}
+
+func (p *Plugin) getChannelMemberIDs(channelID string) (map[string]bool, *model.AppError) {
+	if _, err := p.API.GetChannel(channelID); err != nil {
+		return nil, err
+	}
+
+	userIDs := make(map[string]bool)
+	for page := 0; ; page++ {
+		members, err := p.API.GetChannelMembers(channelID, page, constants.UsersBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range members {
+			userIDs[member.UserId] = true
+		}
+
+		if len(members) < constants.UsersBatchSize {
+			return userIDs, nil
+		}
+	}
+}
+
+func (p *Plugin) getGroupMemberIDs(groupID string) (map[string]bool, *model.AppError) {
+	if _, err := p.API.GetGroup(groupID); err != nil {
+		return nil, err
+	}
+
+	userIDs := make(map[string]bool)
+	for page := 0; ; page++ {
+		users, err := p.API.GetGroupMemberUsers(groupID, page, constants.UsersBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range users {
+			userIDs[user.Id] = true
+		}
+
+		if len(users) < constants.UsersBatchSize {
+			return userIDs, nil
+		}
+	}
+}
+
+// filterUsersInScope returns the users present in the given set of user IDs.
+// All the users are returned if the set is nil.
+func filterUsersInScope(users []*model.User, userIDs map[string]bool) []*model.User {
+	if userIDs == nil {
+		return users
+	}
+
+	filtered := make([]*model.User, 0, len(userIDs))
+	for _, user := range users {
+		if userIDs[user.Id] {
+			filtered = append(filtered, user)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,31 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Alias maps an additional email address to a user
+type Alias struct {
+	Alias  string `json:"alias"`
+	UserID string `json:"user_id"`
+	Source string `json:"source"`
+}
+
+// AliasesChange is sent to the other servers when the aliases of a user change
+type AliasesChange struct {
+	UserID string `json:"user_id"`
+}
+
+type AliasImportResult struct {
+	Imported int      `json:"imported"`
+	Errors   []string `json:"errors"`
+}
+
+func AliasFromJSON(data io.Reader) (*Alias, error) {
+	var a *Alias
+	if err := json.NewDecoder(data).Decode(&a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
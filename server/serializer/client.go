@@ -0,0 +1,39 @@
+package serializer
+
+import "strings"
+
+// ClientInfo describes a client connected to one of the servers in the cluster
+type ClientInfo struct {
+	ID         string `json:"id"`
+	Node       string `json:"node"`
+	Type       string `json:"type"`
+	RemoteAddr string `json:"remote_addr"`
+	UserAgent  string `json:"user_agent"`
+	Credential string `json:"credential"`
+	TeamID     string `json:"team_id,omitempty"`
+	ChannelID  string `json:"channel_id,omitempty"`
+	GroupID    string `json:"group_id,omitempty"`
+
+	// The protocol version and the details sent by the client in its hello frame, if any
+	ProtocolVersion int      `json:"protocol_version"`
+	ClientName      string   `json:"client_name,omitempty"`
+	ClientVersion   string   `json:"client_version,omitempty"`
+	OS              string   `json:"os,omitempty"`
+	MachineID       string   `json:"machine_id,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+
+	// SubscriptionSize is the number of users whose status changes are sent to the client, or -1 if the client is not scoped
+	SubscriptionSize int    `json:"subscription_size"`
+	ConnectedAt      int64  `json:"connected_at"`
+	MessagesSent     uint64 `json:"messages_sent"`
+	LastWriteError   string `json:"last_write_error,omitempty"`
+}
+
+// VersionName returns the name and version sent by the client in its hello frame, or "unknown" if it did not send them
+func (c *ClientInfo) VersionName() string {
+	if c.ClientName == "" {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(c.ClientName + " " + c.ClientVersion)
+}
@@ -0,0 +1,66 @@
+package serializer
+
+import "encoding/json"
+
+// Types of the frames exchanged with the websocket clients which negotiated a protocol version using envelopes
+const (
+	FrameTypeHello = "hello"
+	FrameTypeEvent = "event"
+	FrameTypeBatch = "batch"
+
+	FrameTypeRequest  = "request"
+	FrameTypeResponse = "response"
+)
+
+// Frame contains the type of a frame received from a websocket client, which decides how the rest of the frame is decoded
+type Frame struct {
+	Type string `json:"type"`
+}
+
+// ClientHello is sent by a websocket client to identify itself and to request the capabilities it supports
+type ClientHello struct {
+	Type          string   `json:"type"`
+	ClientName    string   `json:"client_name"`
+	ClientVersion string   `json:"client_version"`
+	OS            string   `json:"os"`
+	MachineID     string   `json:"machine_id"`
+	Capabilities  []string `json:"capabilities"`
+}
+
+// ServerHello is the response to a ClientHello. Capabilities contains all the capabilities supported by the server,
+// while Enabled contains the ones requested by the client which are enabled for its connection.
+type ServerHello struct {
+	Type            string   `json:"type"`
+	ProtocolVersion int      `json:"protocol_version"`
+	ServerVersion   string   `json:"server_version"`
+	Node            string   `json:"node"`
+	ClientID        string   `json:"client_id"`
+	Capabilities    []string `json:"capabilities"`
+	Enabled         []string `json:"enabled"`
+
+	// The batch settings used for the clients which enabled the batching capability
+	BatchIntervalMilliseconds int64 `json:"batch_interval_ms"`
+	MaxEventsPerSecond        int   `json:"max_events_per_second"`
+}
+
+// EventFrame wraps a status change or a directory change sent to the websocket clients using envelopes
+type EventFrame struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Data  *UserStatus `json:"data"`
+}
+
+// BatchFrame contains multiple status changes sent to the websocket clients using envelopes
+type BatchFrame struct {
+	Type   string        `json:"type"`
+	Events []*EventFrame `json:"events"`
+}
+
+func ClientHelloFromJSON(data []byte) (*ClientHello, error) {
+	var h *ClientHello
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,60 @@
+package serializer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// PresenceOverride replaces the status of a user set by an admin, like for a user on leave, regardless of the user's
+// activity in Mattermost. The override is in effect from StartAt until EndAt, which are in milliseconds.
+type PresenceOverride struct {
+	UserID  string `json:"user_id"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	StartAt int64  `json:"start_at"`
+	EndAt   int64  `json:"end_at"`
+
+	CreatedBy string `json:"created_by,omitempty"`
+	CreateAt  int64  `json:"create_at,omitempty"`
+
+	// Active is set in the responses of the API if the override is in effect
+	Active bool `json:"active,omitempty"`
+}
+
+// OverrideChange is sent to the other servers when an override is set or removed. Override is nil if it was removed.
+type OverrideChange struct {
+	UserID   string            `json:"user_id"`
+	Override *PresenceOverride `json:"override,omitempty"`
+}
+
+func PresenceOverrideFromJSON(data io.Reader) (*PresenceOverride, error) {
+	var o *PresenceOverride
+	if err := json.NewDecoder(data).Decode(&o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// IsInEffect checks if the override applies at the given time, in milliseconds
+func (o *PresenceOverride) IsInEffect(now int64) bool {
+	return o.StartAt <= now && now < o.EndAt
+}
+
+func (o *PresenceOverride) IsValid() error {
+	if !model.IsValidId(o.UserID) {
+		return fmt.Errorf("user id is not valid")
+	}
+
+	if !validStatus[o.Status] {
+		return fmt.Errorf("status is not valid")
+	}
+
+	if o.EndAt <= o.StartAt {
+		return fmt.Errorf("the override must end after it starts")
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package serializer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// The actions of the presence policy rules
+const (
+	// PolicyActionShow shares the real status of the user
+	PolicyActionShow = "show"
+
+	// PolicyActionOffline always reports the user as offline
+	PolicyActionOffline = "offline"
+
+	// PolicyActionOmit leaves the user out of the statuses and the events
+	PolicyActionOmit = "omit"
+
+	// PolicyActionMap replaces the statuses of the user using the status map of the rule
+	PolicyActionMap = "map"
+
+	// PolicyActionOverride is the action of the decisions for the users whose status is overridden by an admin.
+	// It can't be used by the rules.
+	PolicyActionOverride = "override"
+)
+
+// PolicyRule is a rule of the presence policy configured by the admin. A rule matches a user if the user matches
+// all the conditions set on the rule, and a condition listing multiple values matches if any of the values match.
+// A rule without conditions matches all the users.
+type PolicyRule struct {
+	Name string `json:"name"`
+
+	Roles    []string `json:"roles,omitempty"`
+	TeamIDs  []string `json:"team_ids,omitempty"`
+	GroupIDs []string `json:"group_ids,omitempty"`
+
+	// Attributes matches the user attributes like "position" or "auth_service", or the custom profile attributes
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Bot matches either the bots or the other users if it is set
+	Bot *bool `json:"bot,omitempty"`
+
+	Action    string            `json:"action"`
+	StatusMap map[string]string `json:"status_map,omitempty"`
+}
+
+// PolicyDecision is the result of evaluating the presence policy for a user
+type PolicyDecision struct {
+	UserID    string `json:"user_id"`
+	RawStatus string `json:"raw_status"`
+	Status    string `json:"status,omitempty"`
+	Omitted   bool   `json:"omitted"`
+	OptedOut  bool   `json:"opted_out"`
+	Action    string `json:"action"`
+
+	// Rule is the name of the matching rule, and RuleIndex is its position in the policy. RuleIndex is -1 if no rule matched.
+	Rule      string `json:"rule,omitempty"`
+	RuleIndex int    `json:"rule_index"`
+
+	// Override is the override in effect for the user, if any
+	Override *PresenceOverride `json:"override,omitempty"`
+
+	// Error is set if the rule at RuleIndex could not be evaluated, in which case the user is reported as offline
+	Error string `json:"error,omitempty"`
+}
+
+// PolicyRulesFromJSON parses the rules configured by the admin. An empty policy contains no rules.
+func PolicyRulesFromJSON(data string) ([]*PolicyRule, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+
+	var rules []*PolicyRule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (r *PolicyRule) IsValid() error {
+	for _, id := range append(append([]string{}, r.TeamIDs...), r.GroupIDs...) {
+		if !model.IsValidId(id) {
+			return fmt.Errorf("id %s is not valid", id)
+		}
+	}
+
+	switch r.Action {
+	case PolicyActionShow, PolicyActionOffline, PolicyActionOmit:
+	case PolicyActionMap:
+		if len(r.StatusMap) == 0 {
+			return fmt.Errorf("the status map is required for the %s action", PolicyActionMap)
+		}
+
+		for from, to := range r.StatusMap {
+			if !validStatus[from] || !validStatus[to] {
+				return fmt.Errorf("the status map from %s to %s is not valid", from, to)
+			}
+		}
+	default:
+		return fmt.Errorf("action %q is not valid", r.Action)
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// PresencePreference is the choice of a user about sharing their presence with the external clients
+type PresencePreference struct {
+	OptedOut bool  `json:"opted_out"`
+	UpdateAt int64 `json:"update_at,omitempty"`
+}
+
+// OptOutChange is sent to the other servers when a user opts out of sharing their presence or opts back in
+type OptOutChange struct {
+	UserID   string `json:"user_id"`
+	OptedOut bool   `json:"opted_out"`
+}
+
+func PresencePreferenceFromJSON(data io.Reader) (*PresencePreference, error) {
+	var p *PresencePreference
+	if err := json.NewDecoder(data).Decode(&p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
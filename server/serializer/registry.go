@@ -0,0 +1,58 @@
+package serializer
+
+// NodeSummary describes the clients connected to one of the servers in the cluster
+type NodeSummary struct {
+	Node    string `json:"node"`
+	Clients int    `json:"clients"`
+
+	// ClientsByType contains the number of clients by type of connection, and ClientsByVersion contains the number
+	// of clients by the name and version sent in their hello frame
+	ClientsByType    map[string]int `json:"clients_by_type"`
+	ClientsByVersion map[string]int `json:"clients_by_version"`
+	UpdatedAt        int64          `json:"updated_at"`
+}
+
+// ClusterSummary aggregates the summaries of all the servers in the cluster
+type ClusterSummary struct {
+	Clients          int            `json:"clients"`
+	ClientsByType    map[string]int `json:"clients_by_type"`
+	ClientsByVersion map[string]int `json:"clients_by_version"`
+	Nodes            []*NodeSummary `json:"nodes"`
+}
+
+func NewNodeSummary(node string, clients []*ClientInfo, updatedAt int64) *NodeSummary {
+	summary := &NodeSummary{
+		Node:             node,
+		Clients:          len(clients),
+		ClientsByType:    make(map[string]int),
+		ClientsByVersion: make(map[string]int),
+		UpdatedAt:        updatedAt,
+	}
+
+	for _, client := range clients {
+		summary.ClientsByType[client.Type]++
+		summary.ClientsByVersion[client.VersionName()]++
+	}
+
+	return summary
+}
+
+func NewClusterSummary(nodes []*NodeSummary) *ClusterSummary {
+	summary := &ClusterSummary{
+		ClientsByType:    make(map[string]int),
+		ClientsByVersion: make(map[string]int),
+		Nodes:            nodes,
+	}
+
+	for _, node := range nodes {
+		summary.Clients += node.Clients
+		for clientType, count := range node.ClientsByType {
+			summary.ClientsByType[clientType] += count
+		}
+		for version, count := range node.ClientsByVersion {
+			summary.ClientsByVersion[version] += count
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,74 @@
+package serializer
+
+import "encoding/json"
+
+// Methods which can be called by the websocket clients using request frames
+const (
+	RPCMethodPing        = "ping"
+	RPCMethodGetStatus   = "get_status"
+	RPCMethodLookup      = "lookup"
+	RPCMethodSearchUsers = "search_users"
+)
+
+// Codes of the errors returned to the requests of the websocket clients
+const (
+	RPCErrorBadRequest     = "bad_request"
+	RPCErrorNotFound       = "not_found"
+	RPCErrorMethodNotFound = "method_not_found"
+	RPCErrorInternal       = "internal_error"
+)
+
+// RPCRequest is sent by a websocket client to call a method. The ID is sent back in the response.
+type RPCRequest struct {
+	Type   string          `json:"type"`
+	ID     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// RPCResponse contains either the result of the request or the error
+type RPCResponse struct {
+	Type   string      `json:"type"`
+	ID     string      `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *RPCError   `json:"error,omitempty"`
+}
+
+type RPCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+func NewRPCError(code, message string) *RPCError {
+	return &RPCError{Code: code, Message: message}
+}
+
+type PingResult struct {
+	Node       string `json:"node"`
+	ServerTime int64  `json:"server_time"`
+}
+
+type GetStatusParams struct {
+	UserID string `json:"user_id"`
+}
+
+type LookupParams struct {
+	Email string `json:"email"`
+}
+
+type SearchUsersParams struct {
+	Term  string `json:"term"`
+	Limit int    `json:"limit"`
+}
+
+func RPCRequestFromJSON(data []byte) (*RPCRequest, error) {
+	var r *RPCRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
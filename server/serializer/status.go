@@ -15,10 +15,70 @@ var validStatus = map[string]bool{
 	model.StatusOffline: true,
 }
 
+// UserStatus is sent to the clients whenever the status of a user changes. It is also used for the directory changes,
+// in which case Event contains the type of the change and OldEmail contains the user's previous email for an update.
+// Event is empty for the status changes, so the older clients keep receiving the same objects.
+// OverrideReason is the reason of the override set by an admin, if the status is overridden.
+// LastActivityAt is the last activity of the user recorded by Mattermost, and StatusSince is the time since which
+// the status is shown, if it is known. They are in milliseconds.
 type UserStatus struct {
+	UserID         string `json:"user_id"`
+	Email          string `json:"email"`
+	SIPURI         string `json:"sip_uri,omitempty"`
+	Status         string `json:"status"`
+	LastActivityAt int64  `json:"last_activity_at,omitempty"`
+	StatusSince    int64  `json:"status_since,omitempty"`
+	OverrideReason string `json:"override_reason,omitempty"`
+	Event          string `json:"event,omitempty"`
+	OldEmail       string `json:"old_email,omitempty"`
+}
+
+// StatusEvent wraps a status change sent to the other servers in the cluster. The events of a user are ordered
+// by the logical timestamp, and the events with the same timestamp are ordered by the name of the origin server.
+// Instance identifies the run of the plugin on the origin server, which changes whenever the plugin is restarted.
+type StatusEvent struct {
+	ID        string      `json:"id"`
+	Origin    string      `json:"origin"`
+	Instance  string      `json:"instance,omitempty"`
+	Timestamp uint64      `json:"timestamp"`
+	Status    *UserStatus `json:"status"`
+}
+
+// IsNewerThan checks if the event happened after the other event
+func (e *StatusEvent) IsNewerThan(other *StatusEvent) bool {
+	if e.Timestamp != other.Timestamp {
+		return e.Timestamp > other.Timestamp
+	}
+
+	return e.Origin > other.Origin
+}
+
+// PendingStatus is sent to the other servers when a status change made at Since is held back until Until, in milliseconds,
+// as it must last for a minimum time before it is published. Status is empty if the held back change was dropped.
+type PendingStatus struct {
 	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	Status string `json:"status,omitempty"`
+	Since  int64  `json:"since,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+
+	// RawStatus is the status received from Mattermost, before the presence policy was applied
+	RawStatus string `json:"raw_status,omitempty"`
+
+	// LastActivityAt is the last activity of the user when the change was held back
+	LastActivityAt int64 `json:"last_activity_at,omitempty"`
+}
+
+// ShownStatus is the last status of a user published to the clients, and the time since which it is shown in milliseconds.
+// It is stored in the KV store, so that the time is still known after the plugin is restarted.
+type ShownStatus struct {
 	Status string `json:"status"`
+	Since  int64  `json:"since"`
+}
+
+// PollResponse contains the status changes since the cursor sent by the client, and the cursor for the next request
+type PollResponse struct {
+	Events []*UserStatus `json:"events"`
+	Cursor string        `json:"cursor"`
 }
 
 func UserStatusFromJSON(data io.Reader) (*UserStatus, error) {
@@ -29,6 +89,10 @@ func UserStatusFromJSON(data io.Reader) (*UserStatus, error) {
 	return s, nil
 }
 
+func IsValidStatus(status string) bool {
+	return validStatus[status]
+}
+
 func (s *UserStatus) PrePublish() error {
 	if !model.IsValidId(s.UserID) {
 		return fmt.Errorf("user id is not valid")
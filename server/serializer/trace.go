@@ -0,0 +1,83 @@
+package serializer
+
+// PresenceExplanation describes how the presence of a user was determined and delivered, to diagnose the differences
+// between the status in Mattermost and the status shown by the external clients
+type PresenceExplanation struct {
+	UserID string `json:"user_id"`
+
+	// The status stored by Mattermost, and the decision of the presence policy for it
+	Status         string          `json:"status"`
+	Manual         bool            `json:"manual"`
+	LastActivityAt int64           `json:"last_activity_at"`
+	Policy         *PolicyDecision `json:"policy"`
+
+	// Nodes contains the traces kept by the servers in the cluster which responded in time
+	Nodes []*NodeTrace `json:"nodes"`
+}
+
+// NodeTrace is the trace of the latest presence events of a user kept by a server
+type NodeTrace struct {
+	Node string `json:"node"`
+
+	// LastPublish is the last status change of the user relayed through this server's publish endpoint
+	LastPublish *PublishTrace `json:"last_publish,omitempty"`
+
+	// LastClusterEvent is the last status change of the user received from another server
+	LastClusterEvent *ClusterEventTrace `json:"last_cluster_event,omitempty"`
+
+	// Events are the latest events of the user broadcasted to the clients of this server, the latest event first
+	Events []*EventTrace `json:"events"`
+
+	// Clients are the clients of this server subscribed to the user, with the last event of the user written to them
+	Clients []*ClientDelivery `json:"clients"`
+}
+
+// PublishTrace records a status change received by the publish endpoint, along with the session which sent it
+type PublishTrace struct {
+	Status       string `json:"status"`
+	SharedStatus string `json:"shared_status,omitempty"`
+	Published    bool   `json:"published"`
+	EventID      string `json:"event_id,omitempty"`
+
+	// DampedUntil is set if the status change was held back, as it must last until then before it is published
+	DampedUntil int64 `json:"damped_until,omitempty"`
+
+	SessionID     string `json:"session_id,omitempty"`
+	RequestUserID string `json:"request_user_id,omitempty"`
+	IPAddress     string `json:"ip_address,omitempty"`
+	UserAgent     string `json:"user_agent,omitempty"`
+
+	// ClusterError is the error in publishing the status change to the other servers, if any
+	ClusterError string `json:"cluster_error,omitempty"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// ClusterEventTrace records a status change received from another server, and whether it was broadcasted
+type ClusterEventTrace struct {
+	EventID        string `json:"event_id,omitempty"`
+	Origin         string `json:"origin,omitempty"`
+	LogicalTime    uint64 `json:"logical_time,omitempty"`
+	Status         string `json:"status"`
+	Accepted       bool   `json:"accepted"`
+	DiscardReason  string `json:"discard_reason,omitempty"`
+	ReceivedAt     int64  `json:"received_at"`
+	LegacyProtocol bool   `json:"legacy_protocol,omitempty"`
+}
+
+// EventTrace is an event broadcasted to the clients of a server
+type EventTrace struct {
+	ID          string `json:"id"`
+	Event       string `json:"event"`
+	Email       string `json:"email"`
+	Status      string `json:"status"`
+	BroadcastAt int64  `json:"broadcast_at"`
+}
+
+// ClientDelivery is the last event of a user written to a client. Event is nil if no event of the user
+// was written to the client, or if the event is older than the events kept in the trace.
+type ClientDelivery struct {
+	ClientID   string      `json:"client_id"`
+	Type       string      `json:"type"`
+	ClientName string      `json:"client_name,omitempty"`
+	Event      *EventTrace `json:"event,omitempty"`
+}
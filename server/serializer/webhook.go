@@ -0,0 +1,58 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Webhook is an outbound webhook target which receives the presence events.
+// The filters are optional and an event is delivered only if it matches all the provided filters.
+// Only the status changes are delivered to the targets which don't filter the events by type.
+type Webhook struct {
+	ID       string   `json:"id"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret,omitempty"`
+	UserIDs  []string `json:"user_ids,omitempty"`
+	TeamIDs  []string `json:"team_ids,omitempty"`
+	Statuses []string `json:"statuses,omitempty"`
+	Events   []string `json:"events,omitempty"`
+	CreateAt int64    `json:"create_at"`
+}
+
+// WebhookPayload is the body of the requests sent to the webhook targets
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is a pending or dead-lettered delivery of a payload to a webhook target
+type WebhookDelivery struct {
+	ID            string          `json:"id"`
+	WebhookID     string          `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt int64           `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	CreateAt      int64           `json:"create_at"`
+}
+
+// WebhookDeliveryLog records a single attempt to deliver a payload to a webhook target
+type WebhookDeliveryLog struct {
+	DeliveryID string `json:"delivery_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Result     string `json:"result"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+func WebhookFromJSON(data io.Reader) (*Webhook, error) {
+	var w *Webhook
+	if err := json.NewDecoder(data).Decode(&w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// statusDamper holds back the status changes which must last for a minimum time before they are published,
+// like the automatic away of the users who come back shortly after. A held back change is dropped if the user goes back
+// to the status shown to the clients before the dwell time elapses. The servers notify each other of the held back changes,
+// so that all of them keep showing the previous status in the REST endpoints until the change is published.
+// The time since which the status is shown is kept along with it, which is the time of the change that was held back
+// for the published changes which were held back.
+type statusDamper struct {
+	lock  sync.Mutex
+	users map[string]*dampedStatus
+
+	// timers publish the held back changes once their dwell time elapses. A timer is stopped when the change
+	// is dropped, replaced or published, and all of them are stopped when the plugin is deactivated.
+	timers  map[string]*time.Timer
+	stopped bool
+}
+
+type dampedStatus struct {
+	// shown is the last status of the user published to the clients, since the given time in milliseconds
+	shown string
+	since int64
+
+	// pending is the status held back until pendingUntil, in milliseconds. It is empty if no status is held back.
+	pending      string
+	pendingSince int64
+	pendingUntil int64
+
+	// savedSince is the time of the shown status stored in the KV store
+	savedSince int64
+}
+
+func newStatusDamper() *statusDamper {
+	return &statusDamper{
+		users:  make(map[string]*dampedStatus),
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// observe decides if a status change received by this server is published immediately, using the minimum time
+// for which the change from the status shown to the clients must last. If the change is held back, or a held back change
+// is dropped, it also returns the pending status to send to the other servers.
+func (d *statusDamper) observe(userID, status string, getDwellTime func(from, to string) time.Duration, now int64) (bool, *serializer.PendingStatus) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	user, ok := d.users[userID]
+	if !ok {
+		d.users[userID] = &dampedStatus{shown: status, since: now}
+		return true, nil
+	}
+
+	hasPending := user.pending != "" && now < user.pendingUntil
+	if status == user.shown && hasPending {
+		user.pending = ""
+		d.stopTimer(userID)
+		return false, &serializer.PendingStatus{UserID: userID}
+	}
+
+	dwellTime := getDwellTime(user.shown, status)
+	if status == user.shown || dwellTime <= 0 {
+		if status != user.shown {
+			user.shown = status
+			user.since = now
+		}
+		user.pending = ""
+		d.stopTimer(userID)
+		return true, nil
+	}
+
+	// The dwell time is counted from the first change to the status
+	if hasPending && user.pending == status {
+		return false, nil
+	}
+
+	d.stopTimer(userID)
+	user.pending = status
+	user.pendingSince = now
+	user.pendingUntil = now + dwellTime.Milliseconds()
+	return false, &serializer.PendingStatus{UserID: userID, Status: status, Since: now, Until: user.pendingUntil}
+}
+
+// setPending records a status held back or dropped by another server. It returns false if the status shown
+// for the user is not known, in which case the status held back is not shown either.
+func (d *statusDamper) setPending(pending *serializer.PendingStatus) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	user, ok := d.users[pending.UserID]
+	if !ok {
+		return false
+	}
+
+	d.stopTimer(pending.UserID)
+	user.pending = pending.Status
+	user.pendingSince = pending.Since
+	user.pendingUntil = pending.Until
+	return true
+}
+
+// isPending checks if the status is still held back for the user.
+func (d *statusDamper) isPending(pending *serializer.PendingStatus) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	user, ok := d.users[pending.UserID]
+	return ok && user.pending == pending.Status && user.pendingUntil == pending.Until
+}
+
+// published records a status of the user published to the clients, either by this server or by another one.
+// The time since which the status is shown is kept if the status did not change.
+func (d *statusDamper) published(userID, status string, since int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.stopTimer(userID)
+	if user, ok := d.users[userID]; ok && user.shown == status {
+		user.pending = ""
+		return
+	}
+
+	d.users[userID] = &dampedStatus{shown: status, since: since}
+}
+
+// schedule calls publish once the dwell time of the held back change elapses, replacing the timer of the previous
+// change of the user. The timer is not started once the damper is stopped.
+func (d *statusDamper) schedule(pending *serializer.PendingStatus, delay time.Duration, publish func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.stopped {
+		return
+	}
+
+	d.stopTimer(pending.UserID)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		d.lock.Lock()
+		if d.timers[pending.UserID] == timer {
+			delete(d.timers, pending.UserID)
+		}
+		d.lock.Unlock()
+
+		publish()
+	})
+	d.timers[pending.UserID] = timer
+}
+
+// stopTimer stops the timer publishing the held back change of the user, if any. The lock must be held.
+func (d *statusDamper) stopTimer(userID string) {
+	if timer, ok := d.timers[userID]; ok {
+		timer.Stop()
+		delete(d.timers, userID)
+	}
+}
+
+// Stop stops the timers of all the held back changes, which are then published by the other servers.
+func (d *statusDamper) Stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.stopped = true
+	for userID := range d.timers {
+		d.stopTimer(userID)
+	}
+}
+
+// isKnown checks if the status shown for the user is known, either because it was published since the plugin
+// was started or because it was restored from the KV store.
+func (d *statusDamper) isKnown(userID string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, ok := d.users[userID]
+	return ok
+}
+
+// restore records the status shown for the user loaded from the KV store, unless a status of the user was published
+// meanwhile. The status is empty if it was not stored, so that it is not loaded again.
+func (d *statusDamper) restore(userID, status string, since int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.users[userID]; !ok {
+		d.users[userID] = &dampedStatus{shown: status, since: since, savedSince: since}
+	}
+}
+
+// markSaved checks if the time since which the status of the user is shown must be stored, which is the case
+// once for every change of the status, and records that it is stored.
+func (d *statusDamper) markSaved(userID string, since int64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	user, ok := d.users[userID]
+	if !ok || user.savedSince == since {
+		return false
+	}
+
+	user.savedSince = since
+	return true
+}
+
+// shownStatus returns the status shown to the clients while a status change of the user is held back,
+// or the given status otherwise, along with the time since which the status is shown. The time is 0 if it is not known,
+// like for the statuses which haven't changed since the plugin was activated.
+func (d *statusDamper) shownStatus(userID, status string, now int64) (string, int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	user, ok := d.users[userID]
+	if !ok {
+		return status, 0
+	}
+
+	if user.pending != "" && now < user.pendingUntil {
+		return user.shown, user.since
+	}
+
+	if user.shown == status {
+		return status, user.since
+	}
+	return status, 0
+}
+
+// shownStatus returns the status shown for the user and the time since which it is shown, like statusDamper.shownStatus.
+// The status shown before the plugin was started is loaded from the KV store.
+func (p *Plugin) shownStatus(userID, status string) (string, int64) {
+	p.loadShownStatus(userID)
+	return p.statusDamper.shownStatus(userID, status, model.GetMillis())
+}
+
+// loadShownStatus restores the status shown for the user from the KV store, if it is not known yet.
+func (p *Plugin) loadShownStatus(userID string) {
+	if p.statusDamper.isKnown(userID) {
+		return
+	}
+
+	var shown *serializer.ShownStatus
+	if _, err := p.kvGetJSON(constants.KeyPrefixStatusSince+userID, &shown); err != nil {
+		p.API.LogWarn("Unable to load the time of the status", "UserID", userID, "Error", err.Error())
+		return
+	}
+
+	if shown == nil {
+		shown = &serializer.ShownStatus{}
+	}
+	p.statusDamper.restore(userID, shown.Status, shown.Since)
+}
+
+// saveShownStatus stores the published status of the user with the time since which it is shown, unless it is already stored.
+func (p *Plugin) saveShownStatus(userID, status string, since int64) {
+	if since == 0 || !p.statusDamper.markSaved(userID, since) {
+		return
+	}
+
+	if err := p.kvSetJSON(constants.KeyPrefixStatusSince+userID, &serializer.ShownStatus{Status: status, Since: since}); err != nil {
+		p.API.LogWarn("Unable to store the time of the status", "UserID", userID, "Error", err.Error())
+	}
+}
+
+// holdStatus sends a status held back or dropped by this server to the other servers, and publishes it
+// once its dwell time elapses.
+func (p *Plugin) holdStatus(pending *serializer.PendingStatus) {
+	if pending.Status != "" {
+		p.schedulePendingStatus(pending)
+	}
+
+	if err := p.publishClusterEvent(constants.ClusterEventStatusPending, pending); err != nil {
+		p.API.LogDebug("Error in publishing the pending status to clusters", "Error", err.Error())
+	}
+}
+
+// schedulePendingStatus publishes the status once its dwell time elapses, unless it was dropped or replaced meanwhile.
+// All the servers which know about the status try to publish it, so that it is published even if the server
+// which received it is stopped, and one of them is elected to publish it.
+func (p *Plugin) schedulePendingStatus(pending *serializer.PendingStatus) {
+	p.statusDamper.schedule(pending, time.Duration(pending.Until-model.GetMillis())*time.Millisecond, func() {
+		if !p.statusDamper.isPending(pending) {
+			return
+		}
+
+		if p.isClusterEnabled() {
+			claimed, err := p.claimClusterEvent(constants.KeyPrefixPendingStatus, fmt.Sprintf("%s:%s:%d", pending.UserID, pending.Status, pending.Until), time.Minute)
+			if err != nil {
+				p.API.LogWarn("Unable to claim the pending status", "UserID", pending.UserID, "Error", err.Error())
+				return
+			}
+
+			if !claimed {
+				return
+			}
+		}
+
+		p.publishPendingStatus(pending)
+	})
+}
+
+// publishPendingStatus publishes a status held back until its dwell time elapsed. The presence policy is applied again
+// to the status received from Mattermost, as the user might have opted out or got their status overridden meanwhile.
+func (p *Plugin) publishPendingStatus(pending *serializer.PendingStatus) {
+	user, appErr := p.API.GetUser(pending.UserID)
+	if appErr != nil {
+		p.API.LogError("Unable to get the user of the pending status", "UserID", pending.UserID, "Error", appErr.Error())
+		return
+	}
+
+	decision := p.evaluatePresencePolicy(user, pending.RawStatus)
+	if decision.Action != serializer.PolicyActionShow && decision.Action != serializer.PolicyActionMap {
+		return
+	}
+
+	p.statusDamper.published(user.Id, decision.Status, pending.Since)
+	if _, err := p.publishStatus(user, decision.Status, pending.LastActivityAt); err != nil {
+		p.API.LogDebug("Error in publishing the event to clusters", "Error", err.Error())
+	}
+}
+
+func (p *Plugin) handlePendingStatusClusterEvent(data []byte) {
+	var pending *serializer.PendingStatus
+	if err := json.Unmarshal(data, &pending); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	if p.statusDamper.setPending(pending) && pending.Status != "" {
+		p.schedulePendingStatus(pending)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// testDwellTime holds back the changes from online to away for a minute and to offline for 30 seconds
+func testDwellTime(from, to string) time.Duration {
+	switch {
+	case from == model.StatusOnline && to == model.StatusAway:
+		return time.Minute
+	case from == model.StatusOnline && to == model.StatusOffline:
+		return 30 * time.Second
+	default:
+		return 0
+	}
+}
+
+type observedStatus struct {
+	status  string
+	now     int64
+	publish bool
+	pending *serializer.PendingStatus
+}
+
+func TestStatusDamperObserve(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		observed      []observedStatus
+		checkAt       int64
+		expectedShown string
+		expectedSince int64
+	}{
+		{
+			name: "first status is published",
+			observed: []observedStatus{
+				{status: model.StatusOnline, now: 1000, publish: true},
+			},
+			checkAt:       2000,
+			expectedShown: model.StatusOnline,
+			expectedSince: 1000,
+		},
+		{
+			name: "change is held back",
+			observed: []observedStatus{
+				{status: model.StatusOnline, now: 0, publish: true},
+				{status: model.StatusAway, now: 1000, pending: &serializer.PendingStatus{UserID: "user", Status: model.StatusAway, Since: 1000, Until: 61000}},
+			},
+			checkAt:       2000,
+			expectedShown: model.StatusOnline,
+			expectedSince: 0,
+		},
+		{
+			name: "held back change is dropped",
+			observed: []observedStatus{
+				{status: model.StatusOnline, now: 0, publish: true},
+				{status: model.StatusAway, now: 1000, pending: &serializer.PendingStatus{UserID: "user", Status: model.StatusAway, Since: 1000, Until: 61000}},
+				{status: model.StatusOnline, now: 2000, pending: &serializer.PendingStatus{UserID: "user"}},
+			},
+			checkAt:       3000,
+			expectedShown: model.StatusOnline,
+			expectedSince: 0,
+		},
+		{
+			name: "held back change is replaced",
+			observed: []observedStatus{
+				{status: model.StatusOnline, now: 0, publish: true},
+				{status: model.StatusAway, now: 1000, pending: &serializer.PendingStatus{UserID: "user", Status: model.StatusAway, Since: 1000, Until: 61000}},
+				{status: model.StatusOffline, now: 2000, pending: &serializer.PendingStatus{UserID: "user", Status: model.StatusOffline, Since: 2000, Until: 32000}},
+			},
+			checkAt:       3000,
+			expectedShown: model.StatusOnline,
+			expectedSince: 0,
+		},
+		{
+			name: "dwell time counted from the first change",
+			observed: []observedStatus{
+				{status: model.StatusOnline, now: 0, publish: true},
+				{status: model.StatusAway, now: 1000, pending: &serializer.PendingStatus{UserID: "user", Status: model.StatusAway, Since: 1000, Until: 61000}},
+				{status: model.StatusAway, now: 5000},
+			},
+			checkAt:       6000,
+			expectedShown: model.StatusOnline,
+			expectedSince: 0,
+		},
+		{
+			name: "immediate transition replaces the held back change",
+			observed: []observedStatus{
+				{status: model.StatusOnline, now: 0, publish: true},
+				{status: model.StatusAway, now: 1000, pending: &serializer.PendingStatus{UserID: "user", Status: model.StatusAway, Since: 1000, Until: 61000}},
+				{status: model.StatusDnd, now: 2000, publish: true},
+			},
+			checkAt:       3000,
+			expectedShown: model.StatusDnd,
+			expectedSince: 2000,
+		},
+		{
+			name: "same status is published without changing the time",
+			observed: []observedStatus{
+				{status: model.StatusDnd, now: 0, publish: true},
+				{status: model.StatusDnd, now: 1000, publish: true},
+			},
+			checkAt:       2000,
+			expectedShown: model.StatusDnd,
+			expectedSince: 0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := newStatusDamper()
+			var last string
+			for i, observed := range test.observed {
+				publish, pending := d.observe("user", observed.status, testDwellTime, observed.now)
+				if publish != observed.publish {
+					t.Errorf("status %d: got publish %t, want %t", i, publish, observed.publish)
+				}
+				if (pending == nil) != (observed.pending == nil) || (pending != nil && *pending != *observed.pending) {
+					t.Errorf("status %d: got pending %+v, want %+v", i, pending, observed.pending)
+				}
+				last = observed.status
+			}
+
+			if shown, since := d.shownStatus("user", last, test.checkAt); shown != test.expectedShown || since != test.expectedSince {
+				t.Errorf("got shown status %q since %d, want %q since %d", shown, since, test.expectedShown, test.expectedSince)
+			}
+		})
+	}
+}
+
+// TestStatusDamperClusterPending checks the status shown by a server which is notified of the changes
+// held back by another server.
+func TestStatusDamperClusterPending(t *testing.T) {
+	d := newStatusDamper()
+	pending := &serializer.PendingStatus{UserID: "user", Status: model.StatusAway, Since: 1000, Until: 61000}
+	if d.setPending(pending) {
+		t.Error("a pending status was recorded for a user whose status is not known")
+	}
+
+	d.published("user", model.StatusOnline, 0)
+	for _, step := range []struct {
+		name          string
+		apply         func()
+		status        string
+		now           int64
+		expectedShown string
+		expectedSince int64
+		isPending     bool
+	}{
+		{
+			name:          "held back by another server",
+			apply:         func() { d.setPending(pending) },
+			status:        model.StatusAway,
+			now:           2000,
+			expectedShown: model.StatusOnline,
+			expectedSince: 0,
+			isPending:     true,
+		},
+		{
+			name:          "dwell time elapsed",
+			apply:         func() {},
+			status:        model.StatusAway,
+			now:           62000,
+			expectedShown: model.StatusAway,
+			expectedSince: 0,
+			isPending:     true,
+		},
+		{
+			name:          "published by another server",
+			apply:         func() { d.published("user", model.StatusAway, 1000) },
+			status:        model.StatusAway,
+			now:           62000,
+			expectedShown: model.StatusAway,
+			expectedSince: 1000,
+		},
+		{
+			name: "dropped by another server",
+			apply: func() {
+				d.setPending(&serializer.PendingStatus{UserID: "user", Status: model.StatusOffline, Since: 63000, Until: 93000})
+				d.setPending(&serializer.PendingStatus{UserID: "user"})
+			},
+			status:        model.StatusAway,
+			now:           64000,
+			expectedShown: model.StatusAway,
+			expectedSince: 1000,
+		},
+	} {
+		step.apply()
+		if shown, since := d.shownStatus("user", step.status, step.now); shown != step.expectedShown || since != step.expectedSince {
+			t.Errorf("%s: got shown status %q since %d, want %q since %d", step.name, shown, since, step.expectedShown, step.expectedSince)
+		}
+		if d.isPending(pending) != step.isPending {
+			t.Errorf("%s: got pending %t, want %t", step.name, !step.isPending, step.isPending)
+		}
+	}
+}
+
+func TestStatusDamperTimers(t *testing.T) {
+	pending := &serializer.PendingStatus{UserID: "user", Status: model.StatusAway, Since: 1000, Until: 61000}
+	newDamper := func() *statusDamper {
+		d := newStatusDamper()
+		d.published("user", model.StatusOnline, 0)
+		return d
+	}
+	failIfPublished := func() {
+		t.Error("the held back change was published")
+	}
+
+	for _, test := range []struct {
+		name  string
+		apply func(d *statusDamper)
+	}{
+		{
+			name: "dropped",
+			apply: func(d *statusDamper) {
+				d.observe("user", model.StatusOnline, testDwellTime, 2000)
+			},
+		},
+		{
+			name: "immediate transition",
+			apply: func(d *statusDamper) {
+				d.observe("user", model.StatusDnd, testDwellTime, 2000)
+			},
+		},
+		{
+			name: "published by another server",
+			apply: func(d *statusDamper) {
+				d.published("user", model.StatusAway, 1000)
+			},
+		},
+		{
+			name: "dropped by another server",
+			apply: func(d *statusDamper) {
+				d.setPending(&serializer.PendingStatus{UserID: "user"})
+			},
+		},
+		{
+			name: "stopped",
+			apply: func(d *statusDamper) {
+				d.Stop()
+				d.schedule(pending, time.Millisecond, failIfPublished)
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDamper()
+			d.observe("user", model.StatusAway, testDwellTime, 1000)
+			d.schedule(pending, 10*time.Millisecond, failIfPublished)
+
+			test.apply(d)
+			if len(d.timers) != 0 {
+				t.Errorf("got %d timers, want 0", len(d.timers))
+			}
+			time.Sleep(20 * time.Millisecond)
+		})
+	}
+
+	t.Run("replaced", func(t *testing.T) {
+		d := newDamper()
+		published := make(chan string, 2)
+		d.schedule(pending, 10*time.Millisecond, func() { published <- model.StatusAway })
+		d.schedule(&serializer.PendingStatus{UserID: "user", Status: model.StatusOffline}, 10*time.Millisecond, func() { published <- model.StatusOffline })
+
+		if status := <-published; status != model.StatusOffline {
+			t.Errorf("got %q published, want %q", status, model.StatusOffline)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if len(published) != 0 || len(d.timers) != 0 {
+			t.Errorf("got %d more published and %d timers, want none", len(published), len(d.timers))
+		}
+	})
+}
+
+func TestShownStatusPersistence(t *testing.T) {
+	api := newTestAPI()
+	newRestartedPlugin := func() *Plugin {
+		p := newTestPlugin(api)
+		p.statusDamper = newStatusDamper()
+		return p
+	}
+
+	p := newRestartedPlugin()
+	if _, since := p.shownStatus("user", model.StatusOnline); since != 0 {
+		t.Errorf("got since %d for a status which was never stored, want 0", since)
+	}
+	if !p.statusDamper.isKnown("user") {
+		t.Error("the missing status was not recorded, so it would be loaded again")
+	}
+
+	p.statusDamper.published("user", model.StatusAway, 1000)
+	p.saveShownStatus("user", model.StatusAway, 1000)
+
+	// The same time is only stored once
+	delete(api.kv, constants.KeyPrefixStatusSince+"user")
+	p.saveShownStatus("user", model.StatusAway, 1000)
+	if _, ok := api.kv[constants.KeyPrefixStatusSince+"user"]; ok {
+		t.Error("the time of the status was stored again")
+	}
+	p.saveShownStatus("user", model.StatusAway, 2000)
+
+	for _, test := range []struct {
+		name   string
+		status string
+		since  int64
+	}{
+		{
+			name:   "unchanged status is shown since the stored time",
+			status: model.StatusAway,
+			since:  2000,
+		},
+		{
+			name:   "status changed while the plugin was stopped",
+			status: model.StatusOnline,
+			since:  0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			restarted := newRestartedPlugin()
+			if status, since := restarted.shownStatus("user", test.status); status != test.status || since != test.since {
+				t.Errorf("got (%q, %d), want (%q, %d)", status, since, test.status, test.since)
+			}
+		})
+	}
+
+	t.Run("the status is loaded again after an error", func(t *testing.T) {
+		restarted := newRestartedPlugin()
+		api.kvErr = &model.AppError{Message: "failed"}
+		restarted.loadShownStatus("user")
+		api.kvErr = nil
+
+		if restarted.statusDamper.isKnown("user") {
+			t.Fatal("the status was recorded after an error")
+		}
+		if _, since := restarted.shownStatus("user", model.StatusAway); since != 2000 {
+			t.Errorf("got since %d, want 2000", since)
+		}
+	})
+}
+
+func TestPublishPendingStatus(t *testing.T) {
+	user := &model.User{Id: model.NewId(), Roles: "system_user"}
+	pending := &serializer.PendingStatus{UserID: user.Id, Status: model.StatusDnd, RawStatus: model.StatusAway, Since: 1000, Until: 61000}
+
+	for _, test := range []struct {
+		name     string
+		optedOut bool
+		shown    string
+	}{
+		{
+			name:  "policy is applied once to the received status",
+			shown: model.StatusDnd,
+		},
+		{
+			name:     "user opted out meanwhile",
+			optedOut: true,
+			shown:    model.StatusOnline,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestBroadcastPlugin(t, newTestAPI(user), &configuration{
+				PresencePolicy: `[{"name": "users", "roles": ["system_user"], "action": "map", "status_map": {"away": "dnd", "dnd": "online"}}]`,
+			})
+			p.statusDamper.published(user.Id, model.StatusOnline, 0)
+			p.optOuts.set(user.Id, test.optedOut)
+
+			p.publishPendingStatus(pending)
+			if shown := p.statusDamper.users[user.Id].shown; shown != test.shown {
+				t.Errorf("got %q shown, want %q", shown, test.shown)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// UserHasBeenCreated publishes the new user right away, instead of waiting for the directory watcher to detect it.
+// The hook is only invoked on the server which created the user, so the other servers are notified with a cluster event,
+// unless the user is omitted by the presence policy.
+func (p *Plugin) UserHasBeenCreated(c *plugin.Context, user *model.User) {
+	p.directory.invalidate()
+
+	change := p.newUserStatus(user, model.StatusOffline)
+	change.Event = constants.EventUserAdded
+	if !p.directoryWatcher.markKnown(change) {
+		return
+	}
+
+	// The other servers apply the presence policy to the change themselves
+	clusterChange := *change
+	if !p.publishDirectoryChange(change) {
+		return
+	}
+
+	if err := p.publishClusterEvent(constants.ClusterEventUserAdded, &clusterChange); err != nil {
+		p.API.LogDebug("Error in publishing the new user to clusters", "Error", err.Error())
+	}
+}
+
+// handleUserAddedClusterEvent sends the user created on another server to the clients connected to this server,
+// unless the directory watcher of this server has already detected the user or the user is omitted by the presence policy.
+func (p *Plugin) handleUserAddedClusterEvent(data []byte) {
+	var change *serializer.UserStatus
+	if err := json.Unmarshal(data, &change); err != nil {
+		p.API.LogDebug("Error in unmarshaling the cluster event data", "Error", err.Error())
+		return
+	}
+
+	p.directory.invalidate()
+	if !p.directoryWatcher.markKnown(change) {
+		return
+	}
+
+	user, appErr := p.API.GetUser(change.UserID)
+	if appErr != nil {
+		p.API.LogWarn("Unable to get the user added on another server", "UserID", change.UserID, "Error", appErr.Error())
+		return
+	}
+
+	if p.applyPresencePolicy(user, change) {
+		p.BroadcastEvent(change)
+	}
+}
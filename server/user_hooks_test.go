@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/websocket"
+)
+
+// newTestBroadcastPlugin returns a plugin which broadcasts the events to a connection pool without clients.
+func newTestBroadcastPlugin(t *testing.T, api *testAPI, config *configuration) *Plugin {
+	p := newTestPolicyPlugin(t, api, config)
+	p.directory = newUserDirectory(api)
+	p.directoryWatcher = newDirectoryWatcher(p)
+	p.eventOrder = newEventOrderer("node")
+	p.statusDamper = newStatusDamper()
+	p.webhooks = newWebhookCache()
+	p.aliases = newAliasCache()
+	p.wsPool = websocket.NewShardedPool("node", "", nil, 1)
+	p.wsPool.Start(api)
+	t.Cleanup(p.wsPool.Close)
+	return p
+}
+
+func TestHandleUserAddedClusterEvent(t *testing.T) {
+	user := &model.User{Id: model.NewId(), Email: "user@example.com"}
+	bot := &model.User{Id: model.NewId(), Email: "bot@example.com", IsBot: true}
+
+	for _, test := range []struct {
+		name        string
+		user        *model.User
+		broadcasted bool
+	}{
+		{
+			name:        "user shown by the policy",
+			user:        user,
+			broadcasted: true,
+		},
+		{
+			name: "user omitted by the policy",
+			user: bot,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			api := newTestAPI(user, bot)
+			p := newTestBroadcastPlugin(t, api, &configuration{PresencePolicy: `[{"name": "bots", "bot": true, "action": "omit"}]`})
+
+			change := p.newUserStatus(test.user, model.StatusOffline)
+			change.Event = constants.EventUserAdded
+			data, err := json.Marshal(change)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lastEventID := p.wsPool.LastEventID()
+			p.handleUserAddedClusterEvent(data)
+			if broadcasted := p.wsPool.LastEventID() != lastEventID; broadcasted != test.broadcasted {
+				t.Errorf("got broadcasted %t, want %t", broadcasted, test.broadcasted)
+			}
+		})
+	}
+}
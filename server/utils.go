@@ -1,20 +1,110 @@
 package main
 
 import (
+	"compress/gzip"
 	"crypto/subtle"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
 )
 
+// maxInt is the largest value of an int
+const maxInt = int(^uint(0) >> 1)
+
 func (p *Plugin) writeError(w http.ResponseWriter, errorMessage string, statusCode int) {
 	p.API.LogError(errorMessage)
 	http.Error(w, errorMessage, statusCode)
 }
 
+func (p *Plugin) writeJSON(w http.ResponseWriter, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in marshaling the response. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(response); err != nil {
+		p.API.LogError("Error in writing the response", "Error", err.Error())
+	}
+}
+
+// writeEncoded writes the response, compressing it with gzip if the client accepts it and it is not smaller than the compression threshold.
+func (p *Plugin) writeEncoded(w http.ResponseWriter, r *http.Request, response []byte) error {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	config := p.getConfiguration()
+	if len(response) < config.CompressionThreshold || !acceptsEncoding(r.Header.Values("Accept-Encoding"), constants.EncodingGzip) {
+		_, err := w.Write(response)
+		return err
+	}
+
+	gzipWriter, err := gzip.NewWriterLevel(w, config.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", constants.EncodingGzip)
+	if _, err = gzipWriter.Write(response); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// acceptsEncoding checks if the Accept-Encoding headers allow the content encoding. An encoding is not acceptable
+// if its quality value is 0, and the quality value of "*" applies to the encodings which are not listed.
+func acceptsEncoding(headers []string, encoding string) bool {
+	wildcardAccepted := false
+	for _, header := range headers {
+		for _, value := range strings.Split(header, ",") {
+			params := strings.Split(value, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != encoding && name != "*" {
+				continue
+			}
+
+			quality := 1.0
+			for _, param := range params[1:] {
+				key, q := splitParam(param)
+				if key != "q" {
+					continue
+				}
+
+				parsed, err := strconv.ParseFloat(q, 64)
+				if err != nil {
+					parsed = 0
+				}
+				quality = parsed
+			}
+
+			if name == encoding {
+				return quality > 0
+			}
+			wildcardAccepted = quality > 0
+		}
+	}
+
+	return wildcardAccepted
+}
+
+// splitParam splits a "key=value" parameter of a header, ignoring the surrounding spaces.
+func splitParam(param string) (key, value string) {
+	parts := strings.SplitN(param, "=", 2)
+	key = strings.ToLower(strings.TrimSpace(parts[0]))
+	if len(parts) == 2 {
+		value = strings.TrimSpace(parts[1])
+	}
+	return key, value
+}
+
 func writeStatusOK(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	m := map[string]string{
@@ -53,3 +143,13 @@ func parseIntParamFromURL(u *url.URL, name string, defaultValue int) (int, error
 
 	return value, nil
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		headers []string
+		want    bool
+	}{
+		{name: "no header", want: false},
+		{name: "gzip", headers: []string{"gzip"}, want: true},
+		{name: "among other encodings", headers: []string{"deflate, gzip, br"}, want: true},
+		{name: "quality value", headers: []string{"gzip;q=0.5"}, want: true},
+		{name: "quality value with spaces", headers: []string{"deflate, gzip ; q = 0.8"}, want: true},
+		{name: "not acceptable", headers: []string{"gzip;q=0"}, want: false},
+		{name: "not acceptable with decimals", headers: []string{"gzip;q=0.000"}, want: false},
+		{name: "other encoding", headers: []string{"x-gzip, deflate"}, want: false},
+		{name: "upper case", headers: []string{"GZIP"}, want: true},
+		{name: "wildcard", headers: []string{"*"}, want: true},
+		{name: "wildcard not acceptable", headers: []string{"*;q=0"}, want: false},
+		{name: "gzip not acceptable despite the wildcard", headers: []string{"*, gzip;q=0"}, want: false},
+		{name: "gzip acceptable despite the wildcard", headers: []string{"*;q=0, gzip"}, want: true},
+		{name: "multiple headers", headers: []string{"deflate", "gzip"}, want: true},
+		{name: "invalid quality value", headers: []string{"gzip;q=abc"}, want: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := acceptsEncoding(test.headers, "gzip"); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// webhookDispatcher delivers the queued webhook payloads and retries the failed deliveries with an exponential backoff.
+// The queue is persisted in the KV store, so the pending deliveries survive a restart of the plugin.
+// Before every attempt, a lock is acquired in the KV store so that a delivery is not attempted by multiple servers at once.
+// The due deliveries are sent by a bounded number of workers, one per webhook target, so that a slow target
+// does not hold back the deliveries to the other targets.
+type webhookDispatcher struct {
+	p      *Plugin
+	client *http.Client
+
+	lock  sync.Mutex
+	queue map[string]*serializer.WebhookDelivery
+
+	// busy contains the webhook targets whose deliveries are being sent by a worker
+	busy    map[string]bool
+	workers chan struct{}
+
+	logLock sync.Mutex
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+func newWebhookDispatcher(p *Plugin) *webhookDispatcher {
+	return &webhookDispatcher{
+		p:       p,
+		client:  &http.Client{Timeout: constants.WebhookRequestTimeout},
+		queue:   make(map[string]*serializer.WebhookDelivery),
+		busy:    make(map[string]bool),
+		workers: make(chan struct{}, constants.WebhookWorkers),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start loads the pending deliveries from the KV store and starts delivering them.
+func (d *webhookDispatcher) Start() {
+	keys, err := d.p.kvListKeys(constants.KeyPrefixWebhookQueue)
+	if err != nil {
+		d.p.API.LogError("Unable to load the pending webhook deliveries", "Error", err.Error())
+	}
+
+	for _, key := range keys {
+		var delivery *serializer.WebhookDelivery
+		if _, err = d.p.kvGetJSON(key, &delivery); err != nil || delivery == nil {
+			continue
+		}
+		d.push(delivery)
+	}
+
+	go d.run()
+}
+
+func (d *webhookDispatcher) Stop() {
+	close(d.stop)
+}
+
+// enqueue persists a delivery of the event to the webhook target and schedules it to be delivered immediately.
+func (d *webhookDispatcher) enqueue(webhookID string, event *webhookEvent) error {
+	payload, err := json.Marshal(&serializer.WebhookPayload{
+		Event:     event.Event,
+		Timestamp: model.GetMillis(),
+		Data:      event.Data,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the webhook payload")
+	}
+
+	delivery := &serializer.WebhookDelivery{
+		ID:            model.NewId(),
+		WebhookID:     webhookID,
+		Event:         event.Event,
+		Payload:       payload,
+		NextAttemptAt: model.GetMillis(),
+		CreateAt:      model.GetMillis(),
+	}
+
+	if err = d.p.kvSetJSON(constants.KeyPrefixWebhookQueue+delivery.ID, delivery); err != nil {
+		return err
+	}
+
+	d.push(delivery)
+	return nil
+}
+
+func (d *webhookDispatcher) push(delivery *serializer.WebhookDelivery) {
+	d.lock.Lock()
+	d.queue[delivery.ID] = delivery
+	d.lock.Unlock()
+
+	d.notify()
+}
+
+// notify wakes the dispatcher to hand over the deliveries which are due.
+func (d *webhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+
+		next := d.deliverDue()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// deliverDue hands the deliveries which are due to the workers and returns the time after which the next delivery is due.
+// The deliveries to a target are handed over in the order of their creation, and are held back until the oldest one is due,
+// so that the target receives the events in order. The deliveries to the targets which are busy, or which can't get a worker,
+// are handed over once a worker is done.
+func (d *webhookDispatcher) deliverDue() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	pending := make(map[string][]*serializer.WebhookDelivery)
+	for _, delivery := range d.queue {
+		if !d.busy[delivery.WebhookID] {
+			pending[delivery.WebhookID] = append(pending[delivery.WebhookID], delivery)
+		}
+	}
+
+	now := model.GetMillis()
+	next := constants.WebhookMaxBackoff
+	for webhookID, deliveries := range pending {
+		sort.Slice(deliveries, func(i, j int) bool {
+			if deliveries[i].CreateAt != deliveries[j].CreateAt {
+				return deliveries[i].CreateAt < deliveries[j].CreateAt
+			}
+			return deliveries[i].ID < deliveries[j].ID
+		})
+
+		due := 0
+		for due < len(deliveries) && deliveries[due].NextAttemptAt <= now {
+			due++
+		}
+
+		if due == 0 {
+			if wait := time.Duration(deliveries[0].NextAttemptAt-now) * time.Millisecond; wait < next {
+				next = wait
+			}
+			continue
+		}
+
+		select {
+		case d.workers <- struct{}{}:
+		default:
+			continue
+		}
+
+		for _, delivery := range deliveries[:due] {
+			delete(d.queue, delivery.ID)
+		}
+
+		d.busy[webhookID] = true
+		go d.work(webhookID, deliveries[:due])
+	}
+
+	if next < 0 {
+		return 0
+	}
+
+	return next
+}
+
+// work attempts the deliveries to a webhook target one at a time, and wakes the dispatcher once it is done
+// so that the deliveries queued meanwhile are handed over. If a delivery is still pending after its attempt,
+// the later deliveries are queued again and wait for it, so that the target receives the events in order.
+func (d *webhookDispatcher) work(webhookID string, deliveries []*serializer.WebhookDelivery) {
+	defer func() {
+		d.lock.Lock()
+		delete(d.busy, webhookID)
+		d.lock.Unlock()
+
+		<-d.workers
+		d.notify()
+	}()
+
+	for i, delivery := range deliveries {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		if !d.attempt(delivery) {
+			for _, later := range deliveries[i+1:] {
+				d.push(later)
+			}
+			return
+		}
+	}
+}
+
+// attempt sends the delivery to the webhook target. It returns false if the delivery is still pending, either because
+// it failed and is retried later or because it could not be attempted now.
+func (d *webhookDispatcher) attempt(delivery *serializer.WebhookDelivery) bool {
+	lockKey := constants.KeyPrefixWebhookLock + delivery.ID
+	acquired, appErr := d.p.API.KVSetWithOptions(lockKey, []byte("1"), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: constants.WebhookLockExpiry,
+	})
+	if appErr != nil {
+		d.p.API.LogError("Unable to lock the webhook delivery", "DeliveryID", delivery.ID, "Error", appErr.Error())
+		d.retryLater(delivery)
+		return false
+	}
+
+	if !acquired {
+		// Another server is attempting this delivery. It is checked again later, in case the other server fails
+		// to complete it, and it is dropped then if the other server removed it from the queue in the KV store.
+		d.retryLater(delivery)
+		return false
+	}
+	defer func() {
+		_ = d.p.kvDelete(lockKey)
+	}()
+
+	queueKey := constants.KeyPrefixWebhookQueue + delivery.ID
+	var current *serializer.WebhookDelivery
+	if _, err := d.p.kvGetJSON(queueKey, &current); err != nil {
+		d.p.API.LogError("Unable to get the webhook delivery", "DeliveryID", delivery.ID, "Error", err.Error())
+		d.retryLater(delivery)
+		return false
+	}
+
+	if current == nil {
+		// The delivery was already completed by another server
+		return true
+	}
+
+	if current.NextAttemptAt > model.GetMillis() {
+		d.push(current)
+		return false
+	}
+
+	webhook, err := d.p.getWebhook(current.WebhookID)
+	if err != nil {
+		d.p.API.LogError("Unable to get the webhook", "WebhookID", current.WebhookID, "Error", err.Error())
+		d.retryLater(current)
+		return false
+	}
+
+	if webhook == nil {
+		_ = d.p.kvDelete(queueKey)
+		return true
+	}
+
+	current.Attempts++
+	entry := &serializer.WebhookDeliveryLog{
+		DeliveryID: current.ID,
+		Event:      current.Event,
+		Attempt:    current.Attempts,
+		Timestamp:  model.GetMillis(),
+	}
+
+	done := true
+	entry.StatusCode, err = d.send(webhook, current)
+	switch {
+	case err == nil:
+		entry.Result = constants.WebhookResultDelivered
+		_ = d.p.kvDelete(queueKey)
+	case current.Attempts >= constants.WebhookMaxAttempts:
+		entry.Result = constants.WebhookResultDeadLettered
+		entry.Error = err.Error()
+		current.LastError = err.Error()
+		if err = d.p.kvSetJSONWithExpiry(constants.KeyPrefixWebhookDeadLetter+current.ID, current, constants.WebhookDeadLetterExpiry); err != nil {
+			d.p.API.LogError("Unable to dead-letter the webhook delivery", "DeliveryID", current.ID, "Error", err.Error())
+		}
+		_ = d.p.kvDelete(queueKey)
+	default:
+		entry.Result = constants.WebhookResultRetrying
+		entry.Error = err.Error()
+		current.LastError = err.Error()
+		current.NextAttemptAt = model.GetMillis() + getWebhookBackoff(current.Attempts).Milliseconds()
+		if err = d.p.kvSetJSON(queueKey, current); err != nil {
+			d.p.API.LogError("Unable to update the webhook delivery", "DeliveryID", current.ID, "Error", err.Error())
+		}
+		d.push(current)
+		done = false
+	}
+
+	d.appendLog(webhook.ID, entry)
+	return done
+}
+
+// retryLater schedules the delivery again without counting it as a failed attempt.
+func (d *webhookDispatcher) retryLater(delivery *serializer.WebhookDelivery) {
+	delivery.NextAttemptAt = model.GetMillis() + constants.WebhookBaseBackoff.Milliseconds()
+	d.push(delivery)
+}
+
+// send posts the payload to the webhook target along with its HMAC-SHA256 signature.
+func (d *webhookDispatcher) send(webhook *serializer.Webhook, delivery *serializer.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create the request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(constants.HeaderEvent, delivery.Event)
+	req.Header.Set(constants.HeaderDeliveryID, delivery.ID)
+	req.Header.Set(constants.HeaderSignature, "sha256="+signWebhookPayload(webhook.Secret, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to send the request")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %s", strings.TrimSpace(resp.Status))
+	}
+
+	return resp.StatusCode, nil
+}
+
+// appendLog records the attempt in the delivery log of the webhook target, keeping only the latest entries.
+func (d *webhookDispatcher) appendLog(webhookID string, entry *serializer.WebhookDeliveryLog) {
+	d.logLock.Lock()
+	defer d.logLock.Unlock()
+
+	key := constants.KeyPrefixWebhookDeliveryLog + webhookID
+	logs := []*serializer.WebhookDeliveryLog{}
+	if _, err := d.p.kvGetJSON(key, &logs); err != nil {
+		d.p.API.LogError("Unable to get the webhook delivery log", "WebhookID", webhookID, "Error", err.Error())
+		return
+	}
+
+	logs = append([]*serializer.WebhookDeliveryLog{entry}, logs...)
+	if len(logs) > constants.WebhookDeliveryLogSize {
+		logs = logs[:constants.WebhookDeliveryLogSize]
+	}
+
+	if err := d.p.kvSetJSON(key, logs); err != nil {
+		d.p.API.LogError("Unable to update the webhook delivery log", "WebhookID", webhookID, "Error", err.Error())
+	}
+}
+
+func getWebhookBackoff(attempts int) time.Duration {
+	backoff := constants.WebhookBaseBackoff
+	for i := 1; i < attempts && backoff < constants.WebhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > constants.WebhookMaxBackoff {
+		return constants.WebhookMaxBackoff
+	}
+
+	return backoff
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
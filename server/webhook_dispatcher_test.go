@@ -0,0 +1,314 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+func newTestWebhookPlugin(t *testing.T, webhooks ...*serializer.Webhook) (*Plugin, *testAPI) {
+	api := newTestAPI()
+	p := newTestPlugin(api)
+	p.webhooks = newWebhookCache()
+	p.webhookDispatcher = newWebhookDispatcher(p)
+	if err := p.kvSetJSON(constants.KeyWebhooks, webhooks); err != nil {
+		t.Fatal(err)
+	}
+	return p, api
+}
+
+func TestWebhookDispatcherSlowTarget(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	delivered := make(chan string, 2)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.Header.Get(constants.HeaderDeliveryID)
+	}))
+	defer fast.Close()
+
+	p, _ := newTestWebhookPlugin(t,
+		&serializer.Webhook{ID: "slow", URL: slow.URL},
+		&serializer.Webhook{ID: "fast", URL: fast.URL},
+	)
+	d := p.webhookDispatcher
+	go d.run()
+	defer d.Stop()
+
+	event := &webhookEvent{Event: constants.EventStatusChanged, Data: map[string]string{}}
+	for _, webhookID := range []string{"slow", "slow", "fast", "fast"} {
+		if err := d.enqueue(webhookID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatalf("%d deliveries to the fast target while the slow target is busy, want 2", i)
+		}
+	}
+
+	d.lock.Lock()
+	busy := d.busy["slow"]
+	d.lock.Unlock()
+	if !busy {
+		t.Error("the slow target is not busy")
+	}
+}
+
+func TestWebhookDispatcherDeliverDue(t *testing.T) {
+	now := model.GetMillis()
+	for _, test := range []struct {
+		name       string
+		busy       []string
+		workers    int
+		queue      []*serializer.WebhookDelivery
+		handedOver int
+		next       time.Duration
+	}{
+		{
+			name: "due deliveries of an idle target are handed over",
+			queue: []*serializer.WebhookDelivery{
+				{ID: "1", WebhookID: "a", NextAttemptAt: now},
+				{ID: "2", WebhookID: "a", NextAttemptAt: now - 1},
+			},
+			handedOver: 2,
+			next:       constants.WebhookMaxBackoff,
+		},
+		{
+			name: "due deliveries of a busy target are kept",
+			busy: []string{"a"},
+			queue: []*serializer.WebhookDelivery{
+				{ID: "1", WebhookID: "a", NextAttemptAt: now},
+			},
+			next: constants.WebhookMaxBackoff,
+		},
+		{
+			name: "due deliveries wait for a worker",
+			busy: []string{"a"},
+			queue: []*serializer.WebhookDelivery{
+				{ID: "1", WebhookID: "b", NextAttemptAt: now},
+			},
+			workers: constants.WebhookWorkers,
+			next:    constants.WebhookMaxBackoff,
+		},
+		{
+			name: "next delivery of an idle target",
+			busy: []string{"a"},
+			queue: []*serializer.WebhookDelivery{
+				{ID: "1", WebhookID: "a", NextAttemptAt: now},
+				{ID: "2", WebhookID: "b", NextAttemptAt: now + time.Hour.Milliseconds()/2},
+			},
+			next: time.Hour / 2,
+		},
+		{
+			name: "later deliveries wait for the oldest one",
+			queue: []*serializer.WebhookDelivery{
+				{ID: "1", WebhookID: "a", NextAttemptAt: now + time.Hour.Milliseconds()/2, CreateAt: now - 2},
+				{ID: "2", WebhookID: "a", NextAttemptAt: now, CreateAt: now - 1},
+			},
+			next: time.Hour / 2,
+		},
+		{
+			name: "due deliveries before the one which is not due are handed over",
+			queue: []*serializer.WebhookDelivery{
+				{ID: "1", WebhookID: "a", NextAttemptAt: now, CreateAt: now - 2},
+				{ID: "2", WebhookID: "a", NextAttemptAt: now + time.Hour.Milliseconds()/2, CreateAt: now - 1},
+				{ID: "3", WebhookID: "a", NextAttemptAt: now, CreateAt: now},
+			},
+			handedOver: 1,
+			next:       constants.WebhookMaxBackoff,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, _ := newTestWebhookPlugin(t)
+			d := p.webhookDispatcher
+			for _, webhookID := range test.busy {
+				d.busy[webhookID] = true
+			}
+			for i := 0; i < test.workers; i++ {
+				d.workers <- struct{}{}
+			}
+			for _, delivery := range test.queue {
+				d.queue[delivery.ID] = delivery
+			}
+
+			next := d.deliverDue()
+			if handedOver := len(test.queue) - len(d.queue); handedOver != test.handedOver {
+				t.Errorf("got %d deliveries handed over, want %d", handedOver, test.handedOver)
+			}
+			if next > test.next || next < test.next-time.Second {
+				t.Errorf("got next delivery in %s, want %s", next, test.next)
+			}
+		})
+	}
+}
+
+func TestWebhookDispatcherWorkInOrder(t *testing.T) {
+	var received []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveryID := r.Header.Get(constants.HeaderDeliveryID)
+		received = append(received, deliveryID)
+		if deliveryID == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	p, api := newTestWebhookPlugin(t, &serializer.Webhook{ID: "a", URL: target.URL})
+	d := p.webhookDispatcher
+	now := model.GetMillis()
+	var deliveries []*serializer.WebhookDelivery
+	for i, id := range []string{"1", "2", "3"} {
+		delivery := &serializer.WebhookDelivery{ID: id, WebhookID: "a", NextAttemptAt: now, CreateAt: now + int64(i)}
+		if err := p.kvSetJSON(constants.KeyPrefixWebhookQueue+id, delivery); err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	// The fourth delivery is being attempted by another server
+	locked := &serializer.WebhookDelivery{ID: "4", WebhookID: "a", NextAttemptAt: now, CreateAt: now + 3}
+	api.kv[constants.KeyPrefixWebhookLock+locked.ID] = []byte("1")
+
+	d.busy["a"] = true
+	d.workers <- struct{}{}
+	d.work("a", deliveries)
+
+	if strings.Join(received, ",") != "1,2" {
+		t.Errorf("got deliveries %v, want [1 2]", received)
+	}
+	if _, ok := d.queue["1"]; ok {
+		t.Error("the delivered delivery was queued again")
+	}
+	for _, id := range []string{"2", "3"} {
+		if _, ok := d.queue[id]; !ok {
+			t.Errorf("the pending delivery %s was not queued again", id)
+		}
+	}
+	if d.queue["2"].NextAttemptAt <= now {
+		t.Error("the failed delivery was not retried later")
+	}
+
+	delete(d.queue, "2")
+	delete(d.queue, "3")
+	d.busy["a"] = true
+	d.workers <- struct{}{}
+	d.work("a", []*serializer.WebhookDelivery{locked})
+	if _, ok := d.queue[locked.ID]; !ok {
+		t.Error("the delivery attempted by another server was not queued again")
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	p, api := newTestWebhookPlugin(t, &serializer.Webhook{ID: "a"}, &serializer.Webhook{ID: "b"})
+	for _, delivery := range []*serializer.WebhookDelivery{{ID: "1", WebhookID: "a"}, {ID: "2", WebhookID: "b"}} {
+		if err := p.kvSetJSON(constants.KeyPrefixWebhookDeadLetter+delivery.ID, delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if deleted, err := p.deleteWebhook("a"); err != nil || !deleted {
+		t.Fatalf("got (%t, %v), want (true, nil)", deleted, err)
+	}
+
+	if _, ok := api.kv[constants.KeyPrefixWebhookDeadLetter+"1"]; ok {
+		t.Error("the dead letter of the removed webhook was kept")
+	}
+	if _, ok := api.kv[constants.KeyPrefixWebhookDeadLetter+"2"]; !ok {
+		t.Error("the dead letter of another webhook was removed")
+	}
+}
+
+func TestUpdateWebhooks(t *testing.T) {
+	p, api := newTestWebhookPlugin(t, &serializer.Webhook{ID: "a"})
+	if _, err := p.getWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another server registers a webhook target between the read and the update of the targets
+	api.beforeCompareAndSet = func(key string) {
+		api.beforeCompareAndSet = nil
+		if err := p.kvSetJSON(key, []*serializer.Webhook{{ID: "a"}, {ID: "b"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.saveWebhook(&serializer.Webhook{ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := []*serializer.Webhook{}
+	if _, err := p.kvGetJSON(constants.KeyWebhooks, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := p.getWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, webhooks := range map[string][]*serializer.Webhook{"stored": stored, "cached": cached} {
+		var ids []string
+		for _, webhook := range webhooks {
+			ids = append(ids, webhook.ID)
+		}
+		if strings.Join(ids, ",") != "a,b,c" {
+			t.Errorf("got %s webhooks %v, want [a b c]", name, ids)
+		}
+	}
+
+	if len(api.clusterEvents) != 1 || api.clusterEvents[0].Id != constants.ClusterEventWebhooksChanged {
+		t.Errorf("got cluster events %v, want the webhooks change", api.clusterEvents)
+	}
+
+	// The cache is loaded again once another server updates the targets
+	if err = p.kvSetJSON(constants.KeyWebhooks, []*serializer.Webhook{{ID: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	p.OnPluginClusterEvent(nil, model.PluginClusterEvent{Id: constants.ClusterEventWebhooksChanged})
+	if webhook, _ := p.getWebhook("d"); webhook == nil {
+		t.Error("the cache was not invalidated")
+	}
+}
+
+func TestWebhookMatchesTeams(t *testing.T) {
+	api := newTestAPI()
+	api.teams["team1"] = []string{"user1"}
+	api.teams["team2"] = []string{"user2"}
+	p := newTestPolicyPlugin(t, api, &configuration{})
+	webhook := &serializer.Webhook{ID: "a", TeamIDs: []string{"team1"}}
+
+	for _, test := range []struct {
+		userID string
+		want   bool
+	}{
+		{userID: "user1", want: true},
+		{userID: "user2", want: false},
+	} {
+		event := &webhookEvent{Event: constants.EventStatusChanged, UserID: test.userID, Status: "online"}
+		for i := 0; i < 2; i++ {
+			if got := p.webhookMatches(webhook, event); got != test.want {
+				t.Errorf("got %t for %s, want %t", got, test.userID, test.want)
+			}
+		}
+	}
+
+	// The members of the team are loaded once and then read from the cache
+	if api.teamLoads != 1 {
+		t.Errorf("got %d team loads, want 1", api.teamLoads)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/constants"
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// webhookEvent is an event which is delivered to all the webhook targets whose filters match it.
+type webhookEvent struct {
+	Event  string
+	UserID string
+	Status string
+	Data   interface{}
+}
+
+// webhookCache keeps the registered webhook targets in memory, so that they are not read from the KV store for every event.
+// The servers notify each other when the targets are updated, and the cache is loaded again on the next event.
+type webhookCache struct {
+	lock sync.RWMutex
+
+	// webhooks is nil if the targets have not been loaded
+	webhooks []*serializer.Webhook
+
+	// generation is incremented whenever the cache is invalidated, so that the targets loaded before are not cached
+	generation uint64
+}
+
+func newWebhookCache() *webhookCache {
+	return &webhookCache{}
+}
+
+// get returns the cached targets, along with the generation to cache the targets with if they are not cached.
+func (c *webhookCache) get() ([]*serializer.Webhook, uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.webhooks, c.generation
+}
+
+// set caches the targets, unless the cache was invalidated since they were loaded.
+func (c *webhookCache) set(webhooks []*serializer.Webhook, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.generation == generation {
+		c.webhooks = webhooks
+	}
+}
+
+func (c *webhookCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	c.webhooks = nil
+}
+
+// getWebhooks returns all the registered webhook targets. The returned targets are shared and must not be modified.
+func (p *Plugin) getWebhooks() ([]*serializer.Webhook, error) {
+	webhooks, generation := p.webhooks.get()
+	if webhooks != nil {
+		return webhooks, nil
+	}
+
+	webhooks = []*serializer.Webhook{}
+	if _, err := p.kvGetJSON(constants.KeyWebhooks, &webhooks); err != nil {
+		return nil, err
+	}
+
+	p.webhooks.set(webhooks, generation)
+	return webhooks, nil
+}
+
+func (p *Plugin) getWebhook(webhookID string) (*serializer.Webhook, error) {
+	webhooks, err := p.getWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, webhook := range webhooks {
+		if webhook.ID == webhookID {
+			return webhook, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// updateWebhooks replaces the stored webhook targets with the ones returned by update. The targets are compared and set,
+// so that the updates made at the same time by the other servers are not lost, and update is called again with the
+// latest targets if they were changed in between. It returns false if update does not change the targets.
+func (p *Plugin) updateWebhooks(update func(webhooks []*serializer.Webhook) ([]*serializer.Webhook, bool)) (bool, error) {
+	for i := 0; i < constants.WebhookUpdateAttempts; i++ {
+		oldData, appErr := p.API.KVGet(constants.KeyWebhooks)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to get the webhooks")
+		}
+
+		webhooks := []*serializer.Webhook{}
+		if oldData != nil {
+			if err := json.Unmarshal(oldData, &webhooks); err != nil {
+				return false, errors.Wrap(err, "failed to unmarshal the webhooks")
+			}
+		}
+
+		updated, changed := update(webhooks)
+		if !changed {
+			return false, nil
+		}
+
+		newData, err := json.Marshal(updated)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to marshal the webhooks")
+		}
+
+		saved, appErr := p.API.KVCompareAndSet(constants.KeyWebhooks, oldData, newData)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to set the webhooks")
+		}
+
+		if !saved {
+			continue
+		}
+
+		p.webhooks.invalidate()
+		if err = p.publishClusterEvent(constants.ClusterEventWebhooksChanged, struct{}{}); err != nil {
+			p.API.LogError("Unable to publish the webhooks change to the other servers", "Error", err.Error())
+		}
+		return true, nil
+	}
+
+	return false, errors.New("failed to update the webhooks, as they were updated concurrently")
+}
+
+func (p *Plugin) saveWebhook(webhook *serializer.Webhook) error {
+	_, err := p.updateWebhooks(func(webhooks []*serializer.Webhook) ([]*serializer.Webhook, bool) {
+		return append(webhooks, webhook), true
+	})
+	return err
+}
+
+// deleteWebhook removes the webhook target. It returns false if the webhook does not exist.
+func (p *Plugin) deleteWebhook(webhookID string) (bool, error) {
+	deleted, err := p.updateWebhooks(func(webhooks []*serializer.Webhook) ([]*serializer.Webhook, bool) {
+		remaining := make([]*serializer.Webhook, 0, len(webhooks))
+		for _, webhook := range webhooks {
+			if webhook.ID != webhookID {
+				remaining = append(remaining, webhook)
+			}
+		}
+
+		return remaining, len(remaining) != len(webhooks)
+	})
+	if err != nil || !deleted {
+		return false, err
+	}
+
+	if err = p.kvDelete(constants.KeyPrefixWebhookDeliveryLog + webhookID); err != nil {
+		return true, err
+	}
+
+	return true, p.deleteWebhookDeadLetters(webhookID)
+}
+
+// getWebhookDeadLetters returns the dead-lettered deliveries to the webhook target which haven't expired yet.
+func (p *Plugin) getWebhookDeadLetters(webhookID string) ([]*serializer.WebhookDelivery, error) {
+	keys, err := p.kvListKeys(constants.KeyPrefixWebhookDeadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []*serializer.WebhookDelivery{}
+	for _, key := range keys {
+		var delivery *serializer.WebhookDelivery
+		if _, err = p.kvGetJSON(key, &delivery); err != nil {
+			return nil, err
+		}
+
+		if delivery != nil && delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+// deleteWebhookDeadLetters removes the dead-lettered deliveries to a removed webhook target.
+func (p *Plugin) deleteWebhookDeadLetters(webhookID string) error {
+	deliveries, err := p.getWebhookDeadLetters(webhookID)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		if err = p.kvDelete(constants.KeyPrefixWebhookDeadLetter + delivery.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// webhookEvents are the types of the events which can be delivered to the webhook targets
+var webhookEvents = map[string]bool{
+	constants.EventStatusChanged: true,
+	constants.EventUserAdded:     true,
+	constants.EventUserRemoved:   true,
+	constants.EventUserUpdated:   true,
+}
+
+// webhookMatches checks if the event passes all the filters of the webhook target.
+// The statuses filter only applies to the status changes.
+func (p *Plugin) webhookMatches(webhook *serializer.Webhook, event *webhookEvent) bool {
+	if len(webhook.Events) == 0 && event.Event != constants.EventStatusChanged {
+		return false
+	}
+
+	if len(webhook.Events) > 0 && !containsString(webhook.Events, event.Event) {
+		return false
+	}
+
+	if len(webhook.UserIDs) > 0 && !containsString(webhook.UserIDs, event.UserID) {
+		return false
+	}
+
+	if event.Event == constants.EventStatusChanged && len(webhook.Statuses) > 0 && !containsString(webhook.Statuses, event.Status) {
+		return false
+	}
+
+	if len(webhook.TeamIDs) == 0 {
+		return true
+	}
+
+	member, err := p.isMemberOfAny(webhook.TeamIDs, event.UserID, teamMembershipKey, p.getTeamMemberIDs)
+	if err != nil {
+		p.API.LogError("Unable to check the teams of the user", "UserID", event.UserID, "WebhookID", webhook.ID, "Error", err.Error())
+		return false
+	}
+
+	return member
+}
+
+// publishWebhookEvent queues the event for delivery to all the matching webhook targets.
+// It must only be called on the server where the event originated, otherwise the event is delivered once per server.
+func (p *Plugin) publishWebhookEvent(event *webhookEvent) {
+	webhooks, err := p.getWebhooks()
+	if err != nil {
+		p.API.LogError("Unable to get the webhooks", "Error", err.Error())
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !p.webhookMatches(webhook, event) {
+			continue
+		}
+
+		if err = p.webhookDispatcher.enqueue(webhook.ID, event); err != nil {
+			p.API.LogError("Unable to queue the webhook delivery", "WebhookID", webhook.ID, "Error", err.Error())
+		}
+	}
+}
+
+func (p *Plugin) handleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := p.getWebhooks()
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in getting webhooks. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// The secret is only returned when the webhook target is registered
+	redacted := make([]*serializer.Webhook, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		listed := *webhook
+		listed.Secret = ""
+		redacted = append(redacted, &listed)
+	}
+
+	p.writeJSON(w, redacted)
+}
+
+func (p *Plugin) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := serializer.WebhookFromJSON(r.Body)
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in deserializing the request body. Error: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if u, parseErr := url.Parse(webhook.URL); parseErr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p.writeError(w, "url is not valid", http.StatusBadRequest)
+		return
+	}
+
+	for _, id := range append(append([]string{}, webhook.UserIDs...), webhook.TeamIDs...) {
+		if !model.IsValidId(id) {
+			p.writeError(w, fmt.Sprintf("id %s is not valid", id), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, status := range webhook.Statuses {
+		if !serializer.IsValidStatus(status) {
+			p.writeError(w, fmt.Sprintf("status %s is not valid", status), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, event := range webhook.Events {
+		if !webhookEvents[event] {
+			p.writeError(w, fmt.Sprintf("event %s is not valid", event), http.StatusBadRequest)
+			return
+		}
+	}
+
+	webhook.ID = model.NewId()
+	webhook.Secret = model.NewRandomString(constants.WebhookSecretLength)
+	webhook.CreateAt = model.GetMillis()
+	if err = p.saveWebhook(webhook); err != nil {
+		p.writeError(w, fmt.Sprintf("Error in saving the webhook. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, webhook)
+}
+
+func (p *Plugin) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	deleted, err := p.deleteWebhook(mux.Vars(r)[constants.WebhookID])
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in deleting the webhook. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if !deleted {
+		p.writeError(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	writeStatusOK(w)
+}
+
+func (p *Plugin) handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	logs := []*serializer.WebhookDeliveryLog{}
+	if _, err := p.kvGetJSON(constants.KeyPrefixWebhookDeliveryLog+mux.Vars(r)[constants.WebhookID], &logs); err != nil {
+		p.writeError(w, fmt.Sprintf("Error in getting the webhook deliveries. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, logs)
+}
+
+func (p *Plugin) handleGetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := p.getWebhookDeadLetters(mux.Vars(r)[constants.WebhookID])
+	if err != nil {
+		p.writeError(w, fmt.Sprintf("Error in getting the dead-lettered deliveries. Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, deliveries)
+}
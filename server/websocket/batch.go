@@ -0,0 +1,85 @@
+package websocket
+
+import "time"
+
+// DefaultBatchInterval is used until the pool receives the batch settings from the plugin configuration
+const DefaultBatchInterval = 250 * time.Millisecond
+
+// BatchSettings configures the batching of the events for the clients which enabled the batching capability
+type BatchSettings struct {
+	// Interval is the time for which the events are accumulated before being sent as a single frame
+	Interval time.Duration
+
+	// MaxEventsPerSecond limits the number of events sent to a client. The events are not limited if it is zero.
+	MaxEventsPerSecond int
+}
+
+// batch accumulates the events for a client, keeping only the latest event of every type for every address of a user.
+// It is only accessed by the pool.
+type batch struct {
+	events map[string]*Event
+	order  []string
+
+	// tokens is the number of events which can still be sent to the client, refilled at the rate of MaxEventsPerSecond
+	tokens     float64
+	refilledAt time.Time
+}
+
+func newBatch(settings BatchSettings, now time.Time) *batch {
+	return &batch{
+		events:     make(map[string]*Event),
+		tokens:     float64(settings.MaxEventsPerSecond),
+		refilledAt: now,
+	}
+}
+
+// add queues the event, replacing the queued event of the same type for the same user and address.
+// It returns true if an event was replaced.
+func (b *batch) add(event *Event) bool {
+	key := batchKey(event)
+	_, coalesced := b.events[key]
+	if !coalesced {
+		b.order = append(b.order, key)
+	}
+
+	b.events[key] = event
+	return coalesced
+}
+
+// batchKey identifies the events which replace each other. The events sent for the aliases of a user are kept separately,
+// and a directory change is not replaced by a status change of the same user.
+func batchKey(event *Event) string {
+	return event.Name() + ":" + event.Data.UserID + ":" + event.Data.Email
+}
+
+// take removes the events which can be sent to the client from the batch, in the order in which they were queued.
+// The events exceeding the rate limit are kept for the next interval, where they can still be replaced by newer events.
+func (b *batch) take(settings BatchSettings, now time.Time) []*Event {
+	count := len(b.order)
+	if count == 0 {
+		return nil
+	}
+
+	if settings.MaxEventsPerSecond > 0 {
+		limit := float64(settings.MaxEventsPerSecond)
+		b.tokens += now.Sub(b.refilledAt).Seconds() * limit
+		if b.tokens > limit {
+			b.tokens = limit
+		}
+		b.refilledAt = now
+
+		if int(b.tokens) < count {
+			count = int(b.tokens)
+		}
+		b.tokens -= float64(count)
+	}
+
+	events := make([]*Event, 0, count)
+	for _, key := range b.order[:count] {
+		events = append(events, b.events[key])
+		delete(b.events, key)
+	}
+	b.order = b.order[count:]
+
+	return events
+}
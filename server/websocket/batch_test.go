@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+func newTestBatchEvent(id, userID, status string) *Event {
+	return &Event{ID: id, Data: &serializer.UserStatus{UserID: userID, Status: status}}
+}
+
+func eventIDs(events []*Event) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestBatchAdd(t *testing.T) {
+	b := newBatch(BatchSettings{}, time.Now())
+	for _, test := range []struct {
+		event     *Event
+		coalesced bool
+	}{
+		{event: newTestBatchEvent("1", "a", "online")},
+		{event: newTestBatchEvent("2", "b", "online")},
+		{event: newTestBatchEvent("3", "a", "away"), coalesced: true},
+		{event: &Event{ID: "4", Data: &serializer.UserStatus{UserID: "a", Email: "alias@example.com", Status: "away"}}},
+		{event: &Event{ID: "5", Data: &serializer.UserStatus{UserID: "a", Event: "user_removed"}}},
+	} {
+		if coalesced := b.add(test.event); coalesced != test.coalesced {
+			t.Errorf("event %s: got coalesced %t, want %t", test.event.ID, coalesced, test.coalesced)
+		}
+	}
+
+	// The replaced event keeps the position of the first event of the user
+	if got, want := eventIDs(b.take(BatchSettings{}, time.Now())), []string{"3", "2", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBatchTake(t *testing.T) {
+	start := time.Now()
+	limited := BatchSettings{MaxEventsPerSecond: 2}
+
+	for _, test := range []struct {
+		name     string
+		settings BatchSettings
+		queued   []string
+		takes    []time.Duration
+		want     [][]string
+	}{
+		{
+			name:     "not limited",
+			settings: BatchSettings{},
+			queued:   []string{"a", "b", "c"},
+			takes:    []time.Duration{0},
+			want:     [][]string{{"a", "b", "c"}},
+		},
+		{
+			name:     "empty batch",
+			settings: limited,
+			takes:    []time.Duration{0},
+			want:     [][]string{{}},
+		},
+		{
+			name:     "the events exceeding the limit are kept",
+			settings: limited,
+			queued:   []string{"a", "b", "c", "d", "e"},
+			takes:    []time.Duration{0, 0, time.Second},
+			want:     [][]string{{"a", "b"}, {}, {"c", "d"}},
+		},
+		{
+			name:     "the tokens are refilled gradually",
+			settings: limited,
+			queued:   []string{"a", "b", "c", "d"},
+			takes:    []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond},
+			want:     [][]string{{"a", "b"}, {}, {"c"}},
+		},
+		{
+			name:     "the tokens do not exceed the limit",
+			settings: limited,
+			queued:   []string{"a", "b", "c", "d"},
+			takes:    []time.Duration{time.Minute},
+			want:     [][]string{{"a", "b"}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBatch(test.settings, start)
+			for _, userID := range test.queued {
+				b.add(newTestBatchEvent(userID, userID, "online"))
+			}
+
+			for i, elapsed := range test.takes {
+				if got := eventIDs(b.take(test.settings, start.Add(elapsed))); !reflect.DeepEqual(got, test.want[i]) {
+					t.Errorf("take %d: got %v, want %v", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -1,19 +1,180 @@
 package websocket
 
 import (
+	"encoding/json"
+	"net/http"
+
 	"github.com/gorilla/websocket"
+	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+const (
+	ClientTypeWebsocket = "websocket"
+	ClientTypeSSE       = "sse"
+	ClientTypePoll      = "poll"
 )
 
 type Client struct {
-	Conn *websocket.Conn
-	Pool *Pool
+	ID          string
+	Type        string
+	RemoteAddr  string
+	UserAgent   string
+	Credential  string
+	ConnectedAt int64
+
+	Conn   *websocket.Conn
+	Writer EventWriter
+	Pool   *Pool
+	Scope  Scope
+
+	// LastEventID is the ID of the last event received by the client before reconnecting.
+	// The events broadcasted after it are sent to the client when it is registered, if they are still in the pool's history.
+	LastEventID string
+
+	// Subscription contains the IDs of the users whose status changes are sent to the client.
+	// It is nil if the client is not scoped, and must only be accessed by the pool after the client is registered.
+	Subscription map[string]bool
+
+	// ProtocolVersion is the protocol version negotiated with a websocket client
+	ProtocolVersion int
+
+	// The details sent by the client in its hello frame, and the capabilities enabled for the client.
+	// They are only accessed by the pool.
+	hello        *serializer.ClientHello
+	capabilities map[string]bool
+
+	// batch accumulates the events for a client which enabled the batching capability. It is only accessed by the pool.
+	batch *batch
+
+	// replayedSequence is the sequence of the latest event broadcasted when the client was registered.
+	// The events up to it were either replayed or broadcasted before the client connected, so they are not sent again.
+	replayedSequence uint64
+
+	// The events after startSequence are sent to the client, and writtenSequence is the sequence of the latest event
+	// written to the client. They are used to explain which status of a user was last sent to the client.
+	startSequence   uint64
+	writtenSequence uint64
+
+	// The statistics are only accessed by the pool
+	messagesSent   uint64
+	lastWriteError string
+}
+
+// NewClient creates a client for a request, which still needs to be registered with the pool.
+func NewClient(r *http.Request, clientType, credential string, writer EventWriter, pool *Pool) *Client {
+	return &Client{
+		ID:          model.NewId(),
+		Type:        clientType,
+		RemoteAddr:  r.RemoteAddr,
+		UserAgent:   r.UserAgent(),
+		Credential:  credential,
+		ConnectedAt: model.GetMillis(),
+		Writer:      writer,
+		Pool:        pool,
+	}
+}
+
+func (c *Client) info(node string) *serializer.ClientInfo {
+	subscriptionSize := -1
+	if c.Subscription != nil {
+		subscriptionSize = len(c.Subscription)
+	}
+
+	info := &serializer.ClientInfo{
+		ID:               c.ID,
+		Node:             node,
+		Type:             c.Type,
+		RemoteAddr:       c.RemoteAddr,
+		UserAgent:        c.UserAgent,
+		Credential:       c.Credential,
+		TeamID:           c.Scope.TeamID,
+		ChannelID:        c.Scope.ChannelID,
+		GroupID:          c.Scope.GroupID,
+		ProtocolVersion:  c.ProtocolVersion,
+		Capabilities:     c.enabledCapabilities(),
+		SubscriptionSize: subscriptionSize,
+		ConnectedAt:      c.ConnectedAt,
+		MessagesSent:     c.messagesSent,
+		LastWriteError:   c.lastWriteError,
+	}
+
+	if c.hello != nil {
+		info.ClientName = c.hello.ClientName
+		info.ClientVersion = c.hello.ClientVersion
+		info.OS = c.hello.OS
+		info.MachineID = c.hello.MachineID
+	}
+
+	return info
+}
+
+// HasCapability checks if the capability is enabled for the client
+func (c *Client) HasCapability(capability string) bool {
+	return c.capabilities[capability]
+}
+
+// enabledCapabilities returns the enabled capabilities in the order in which they are listed in Capabilities
+func (c *Client) enabledCapabilities() []string {
+	var enabled []string
+	for _, capability := range Capabilities {
+		if c.capabilities[capability] {
+			enabled = append(enabled, capability)
+		}
+	}
+	return enabled
+}
+
+// negotiateCapabilities enables the capabilities which are requested by the client and supported by the server
+func (c *Client) negotiateCapabilities(requested []string) {
+	if c.capabilities == nil {
+		c.capabilities = make(map[string]bool)
+	}
+
+	for _, capability := range requested {
+		for _, supported := range Capabilities {
+			if capability == supported {
+				c.capabilities[capability] = true
+			}
+		}
+	}
+}
+
+// IsSubscribedTo checks if the status changes of the given user should be sent to the client.
+func (c *Client) IsSubscribedTo(userID string) bool {
+	return c.Subscription == nil || c.Subscription[userID]
+}
+
+func (c *Client) subscribedUsers(userIDs []string) map[string]bool {
+	subscribed := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if c.IsSubscribedTo(userID) {
+			subscribed[userID] = true
+		}
+	}
+	return subscribed
+}
+
+// updateSubscription applies the membership change to the subscription. It returns true if the subscription was changed.
+func (c *Client) updateSubscription(change *MembershipChange) bool {
+	if c.Subscription == nil || !c.Scope.Matches(change) || c.Subscription[change.UserID] == change.Joined {
+		return false
+	}
+
+	if change.Joined {
+		c.Subscription[change.UserID] = true
+	} else {
+		delete(c.Subscription, change.UserID)
+	}
+	return true
 }
 
 func (c *Client) Read(api plugin.API) {
 	defer func() {
-		c.Pool.Unregister <- c
-		c.Conn.Close()
+		c.Pool.Unregister(c)
+		c.Writer.Close()
 	}()
 
 	for {
@@ -23,6 +184,33 @@ func (c *Client) Read(api plugin.API) {
 			return
 		}
 
+		c.handleFrame(api, content)
+	}
+}
+
+func (c *Client) handleFrame(api plugin.API, content []byte) {
+	var frame serializer.Frame
+	if err := json.Unmarshal(content, &frame); err != nil {
+		api.LogInfo("Message received through the websocket.", "Message", string(content))
+		return
+	}
+
+	switch frame.Type {
+	case serializer.FrameTypeHello:
+		hello, err := serializer.ClientHelloFromJSON(content)
+		if err != nil {
+			api.LogDebug("Error in decoding the hello frame.", "Error", err.Error())
+			return
+		}
+		c.Pool.hello(c, hello)
+	case serializer.FrameTypeRequest:
+		request, err := serializer.RPCRequestFromJSON(content)
+		if err != nil {
+			api.LogDebug("Error in decoding the request frame.", "Error", err.Error())
+			return
+		}
+		c.handleRequest(request)
+	default:
 		api.LogInfo("Message received through the websocket.", "Message", string(content))
 	}
 }
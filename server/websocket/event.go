@@ -0,0 +1,268 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// Event is a status change broadcasted by the pool. The ID is used by the clients to resume a stream after reconnecting.
+type Event struct {
+	ID   string
+	Data *serializer.UserStatus
+
+	sequence    uint64
+	logicalTime uint64
+
+	// plain and envelope contain the event serialized for the websocket clients, without and with an envelope.
+	// They are shared by all the shards of the pool.
+	plain    preparedMessage
+	envelope preparedMessage
+}
+
+// Name returns the type of the event, which is a status change unless the event is a directory change.
+func (e *Event) Name() string {
+	if e.Data.Event != "" {
+		return e.Data.Event
+	}
+
+	return eventName
+}
+
+// tracedEvent is an event kept in the trace of a user
+type tracedEvent struct {
+	sequence uint64
+	trace    *serializer.EventTrace
+}
+
+// preparedMessage is serialized by the first shard sending it to a client
+type preparedMessage struct {
+	once    sync.Once
+	message *websocket.PreparedMessage
+	size    int
+	err     error
+}
+
+// preparedMessage returns the event serialized as a websocket message, which can be sent to any number of clients
+// using the same frame format, along with the size of the uncompressed message. The message is only serialized once,
+// and is compressed once for every compression level.
+func (e *Event) preparedMessage(envelope bool) (*websocket.PreparedMessage, int, error) {
+	prepared := &e.plain
+	if envelope {
+		prepared = &e.envelope
+	}
+
+	prepared.once.Do(func() {
+		var frame interface{} = e.Data
+		if envelope {
+			frame = newEventFrame(e)
+		}
+
+		var data []byte
+		data, prepared.err = json.Marshal(frame)
+		if prepared.err != nil {
+			return
+		}
+
+		prepared.size = len(data)
+		prepared.message, prepared.err = websocket.NewPreparedMessage(websocket.TextMessage, data)
+	})
+
+	return prepared.message, prepared.size, prepared.err
+}
+
+// EventWriter sends the events to a client, for example through a websocket or a Server-Sent Events stream.
+// Close disconnects the client.
+type EventWriter interface {
+	WriteEvent(event *Event) error
+	Close() error
+}
+
+// ConnWriter sends the events to a websocket client as JSON messages. The frames are serialized by the pool and queued
+// for the goroutine running Serve, so that a client which does not read its frames can't block the pool.
+type ConnWriter struct {
+	Conn *websocket.Conn
+
+	// Envelope wraps the events in an EventFrame. It is enabled by protocol version 2, or by the client's hello frame.
+	Envelope bool
+
+	// CompressionThreshold is the size in bytes below which the frames are sent uncompressed.
+	// It has no effect if the client did not negotiate the permessage-deflate compression.
+	CompressionThreshold int
+
+	frames    chan func() error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConnWriter(conn *websocket.Conn, envelope bool, compressionThreshold int) *ConnWriter {
+	return &ConnWriter{
+		Conn:                 conn,
+		Envelope:             envelope,
+		CompressionThreshold: compressionThreshold,
+		frames:               make(chan func() error, connQueueSize),
+		done:                 make(chan struct{}),
+	}
+}
+
+func (w *ConnWriter) WriteEvent(event *Event) error {
+	message, size, err := event.preparedMessage(w.Envelope)
+	if err != nil {
+		return err
+	}
+
+	return w.queue(func() error {
+		w.Conn.EnableWriteCompression(size >= w.CompressionThreshold)
+		return w.Conn.WritePreparedMessage(message)
+	})
+}
+
+// WriteBatch sends the events as a single frame. Without envelopes, the frame is a JSON array of the status changes.
+func (w *ConnWriter) WriteBatch(events []*Event) error {
+	if !w.Envelope {
+		statuses := make([]*serializer.UserStatus, 0, len(events))
+		for _, event := range events {
+			statuses = append(statuses, event.Data)
+		}
+		return w.writeJSON(statuses)
+	}
+
+	frame := &serializer.BatchFrame{
+		Type:   serializer.FrameTypeBatch,
+		Events: make([]*serializer.EventFrame, 0, len(events)),
+	}
+	for _, event := range events {
+		frame.Events = append(frame.Events, newEventFrame(event))
+	}
+	return w.writeJSON(frame)
+}
+
+// WriteFrame sends a frame other than an event to the client
+func (w *ConnWriter) WriteFrame(frame interface{}) error {
+	return w.writeJSON(frame)
+}
+
+func (w *ConnWriter) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return w.queue(func() error {
+		w.Conn.EnableWriteCompression(len(data) >= w.CompressionThreshold)
+		return w.Conn.WriteMessage(websocket.TextMessage, data)
+	})
+}
+
+// queue adds the frame to the frames written by Serve without blocking the pool.
+func (w *ConnWriter) queue(write func() error) error {
+	select {
+	case <-w.done:
+		return errClosed
+	default:
+	}
+
+	select {
+	case w.frames <- write:
+		return nil
+	default:
+		return errBufferFull
+	}
+}
+
+// Serve writes the queued frames to the connection until the writer is closed. The connection is closed
+// if a frame can't be written within the write timeout, which ends the goroutine reading from the client.
+func (w *ConnWriter) Serve() error {
+	for {
+		select {
+		case <-w.done:
+			return nil
+		case write := <-w.frames:
+			if err := w.Conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+				_ = w.Close()
+				return err
+			}
+
+			if err := write(); err != nil {
+				_ = w.Close()
+				return err
+			}
+		}
+	}
+}
+
+func (w *ConnWriter) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.Conn.Close()
+	})
+	return err
+}
+
+func newEventFrame(event *Event) *serializer.EventFrame {
+	return &serializer.EventFrame{
+		Type:  serializer.FrameTypeEvent,
+		ID:    event.ID,
+		Event: event.Name(),
+		Data:  event.Data,
+	}
+}
+
+const (
+	// connQueueSize is the number of frames queued for a websocket client before the client is disconnected
+	connQueueSize = 256
+
+	// writeTimeout is the time after which a websocket client which does not receive its frames is disconnected
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	errBufferFull = errors.New("the event buffer of the client is full")
+	errClosed     = errors.New("the client is disconnected")
+)
+
+// ChannelWriter queues the events for a client which is served by the goroutine handling its request.
+type ChannelWriter struct {
+	events    chan *Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewChannelWriter(size int) *ChannelWriter {
+	return &ChannelWriter{
+		events: make(chan *Event, size),
+		done:   make(chan struct{}),
+	}
+}
+
+// WriteEvent queues the event without blocking the pool, so a slow client can't delay the other clients.
+func (w *ChannelWriter) WriteEvent(event *Event) error {
+	select {
+	case w.events <- event:
+		return nil
+	default:
+		return errBufferFull
+	}
+}
+
+func (w *ChannelWriter) Events() <-chan *Event {
+	return w.events
+}
+
+// Close signals the goroutine serving the client to end the request.
+func (w *ChannelWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	return nil
+}
+
+func (w *ChannelWriter) Done() <-chan struct{} {
+	return w.done
+}
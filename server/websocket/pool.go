@@ -1,49 +1,420 @@
 package websocket
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
 
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/metrics"
 	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
 )
 
+const (
+	// HistorySize is the number of recent events kept to resume the streams of the reconnecting clients
+	HistorySize = 1000
+
+	// TraceSize is the number of recent events of every user kept to explain the statuses sent to the clients
+	TraceSize = 4
+
+	// eventName is the type of the events which are not directory changes
+	eventName = "status_change"
+
+	// resyncEventName is the type of the event sent to a Server-Sent Events client which can't resume its stream
+	resyncEventName = "resync"
+)
+
+// Pool distributes the clients over a number of shards, each of which is served by its own goroutine.
+// A status change is passed to all the shards, which send it to their subscribed clients in parallel.
 type Pool struct {
-	Register   chan *Client
-	Unregister chan *Client
-	Clients    map[*Client]bool
-	Broadcast  chan *serializer.UserStatus
+	// Node is the name of the server running the pool, and ServerVersion is the version of the plugin
+	Node          string
+	ServerVersion string
+	Metrics       *metrics.Metrics
+
+	// RPCHandler handles the requests of the websocket clients
+	RPCHandler RPCHandler
+
+	shards []*shard
+
+	// The event IDs contain the ID of the pool, the sequence of the event and its logical time. The sequence restarts
+	// whenever the plugin is restarted, so it is only used to resume the streams of the clients which were connected
+	// to this pool. The other clients resume their stream from the logical time of their last event, which is the same
+	// on all the servers for the status changes published to all of them.
+	id          string
+	startedAt   uint64
+	eventsLock  sync.Mutex
+	sequence    uint64
+	history     []*Event
+	lastEventID atomic.Value
+
+	// evictedTime is the latest logical time of the events removed from the history
+	evictedTime uint64
+
+	// userEvents contains the latest events of every user, which are kept for longer than the history
+	userEvents map[string][]*tracedEvent
+
+	// dispatchLock makes all the shards receive the events in the same order. It is separate from the events lock,
+	// as the shards use the history while the events are being passed to them.
+	dispatchLock sync.Mutex
+
+	// closed is closed once the shards are stopped, after which the operations of the pool do nothing
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func NewPool() *Pool {
-	return &Pool{
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Clients:    make(map[*Client]bool),
-		Broadcast:  make(chan *serializer.UserStatus),
+// NewPool creates a pool with a shard for every CPU.
+func NewPool(node, serverVersion string, m *metrics.Metrics) *Pool {
+	return NewShardedPool(node, serverVersion, m, runtime.NumCPU())
+}
+
+func NewShardedPool(node, serverVersion string, m *metrics.Metrics, shards int) *Pool {
+	if shards < 1 {
+		shards = 1
 	}
+
+	p := &Pool{
+		Node:          node,
+		ServerVersion: serverVersion,
+		Metrics:       m,
+		id:            model.NewId(),
+		startedAt:     uint64(model.GetMillis()),
+		userEvents:    make(map[string][]*tracedEvent),
+		closed:        make(chan struct{}),
+	}
+
+	for i := 0; i < shards; i++ {
+		p.shards = append(p.shards, newShard(p))
+	}
+
+	return p
 }
 
+// Start starts the goroutines serving the shards.
 func (p *Pool) Start(api plugin.API) {
-	for {
+	for _, s := range p.shards {
+		go s.run(api)
+	}
+}
+
+// Close disconnects all the clients and stops the goroutines serving the shards. It is safe to call multiple times.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		done := make(chan struct{}, len(p.shards))
+		for _, s := range p.shards {
+			s.do(func(s *shard) {
+				s.disconnectAll()
+				done <- struct{}{}
+			})
+		}
+		for range p.shards {
+			<-done
+		}
+
+		close(p.closed)
+	})
+}
+
+// shardFor returns the shard serving the client with the given ID.
+func (p *Pool) shardFor(clientID string) *shard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(clientID))
+	return p.shards[hash.Sum32()%uint32(len(p.shards))]
+}
+
+// Resume contains the events to send to a client resuming its stream, before the events queued for the client by the pool.
+type Resume struct {
+	// Events contains the events broadcasted after the client's last event to which the client is subscribed
+	Events []*Event
+
+	// Resync is set if the events after the client's last event are not known anymore, for example if they were
+	// broadcasted before this server was started. The client must then take a fresh snapshot of the statuses.
+	Resync bool
+
+	// LastEventID is the ID of the latest event broadcasted when the client was registered
+	LastEventID string
+}
+
+// Register adds the client to the pool. It returns the events broadcasted after the client's last event,
+// which are sent to the client by the goroutine serving it, so that they don't fill the buffer of the client.
+// The client is disconnected if the pool is closed.
+func (p *Pool) Register(client *Client) *Resume {
+	result := make(chan *Resume, 1)
+	p.shardFor(client.ID).do(func(s *shard) {
+		result <- s.register(client)
+	})
+
+	select {
+	case resume := <-result:
+		return resume
+	case <-p.closed:
+		_ = client.Writer.Close()
+		return &Resume{LastEventID: p.LastEventID()}
+	}
+}
+
+// Unregister removes the client from the pool. It is safe to call multiple times for the same client.
+func (p *Pool) Unregister(client *Client) {
+	p.shardFor(client.ID).do(func(s *shard) {
+		s.unregister(client)
+	})
+}
+
+// Broadcast sends the status change to the subscribed clients. The logical time is used by the clients
+// to resume their stream from another server.
+func (p *Pool) Broadcast(status *serializer.UserStatus, logicalTime uint64) {
+	p.dispatchLock.Lock()
+	defer p.dispatchLock.Unlock()
+
+	event := p.newEvent(status, logicalTime)
+	p.Metrics.IncEventsBroadcast()
+	for _, s := range p.shards {
+		s.do(func(s *shard) {
+			s.broadcast(event)
+		})
+	}
+}
+
+// UpdateMembership updates the subscriptions of the clients scoped to the team or channel of the membership change.
+func (p *Pool) UpdateMembership(change *MembershipChange) {
+	for _, s := range p.shards {
+		s.do(func(s *shard) {
+			s.updateMembership(change)
+		})
+	}
+}
+
+// ListClients returns the details of all the clients connected to the pool.
+func (p *Pool) ListClients() []*serializer.ClientInfo {
+	results := make(chan []*serializer.ClientInfo, len(p.shards))
+	for _, s := range p.shards {
+		s.do(func(s *shard) {
+			results <- s.listClients()
+		})
+	}
+
+	var clients []*serializer.ClientInfo
+	for range p.shards {
+		select {
+		case shardClients := <-results:
+			clients = append(clients, shardClients...)
+		case <-p.closed:
+			return clients
+		}
+	}
+	return clients
+}
+
+// DisconnectClient closes the connection of the client. It returns false if the client is not connected to the pool.
+func (p *Pool) DisconnectClient(clientID string) bool {
+	result := make(chan bool, 1)
+	p.shardFor(clientID).do(func(s *shard) {
+		result <- s.disconnect(clientID)
+	})
+
+	select {
+	case disconnected := <-result:
+		return disconnected
+	case <-p.closed:
+		return false
+	}
+}
+
+// SubscribedUsers returns the given users to whom the client is subscribed. The subscription is checked by the shard
+// serving the client, as it is updated by the shard when the memberships change.
+func (p *Pool) SubscribedUsers(client *Client, userIDs []string) map[string]bool {
+	result := make(chan map[string]bool, 1)
+	p.shardFor(client.ID).do(func(s *shard) {
+		result <- client.subscribedUsers(userIDs)
+	})
+
+	select {
+	case subscribed := <-result:
+		return subscribed
+	case <-p.closed:
+		return map[string]bool{}
+	}
+}
+
+// SetBatchSettings updates the batch settings used for the clients which enabled the batching capability.
+func (p *Pool) SetBatchSettings(settings BatchSettings) {
+	for _, s := range p.shards {
+		s.do(func(s *shard) {
+			s.setBatchSettings(settings)
+		})
+	}
+}
+
+func (p *Pool) hello(client *Client, hello *serializer.ClientHello) {
+	p.shardFor(client.ID).do(func(s *shard) {
+		s.hello(client, hello)
+	})
+}
+
+// reply sends the response to a request of the client.
+func (p *Pool) reply(client *Client, response *serializer.RPCResponse) {
+	p.shardFor(client.ID).do(func(s *shard) {
+		s.reply(client, response)
+	})
+}
+
+// TraceUser returns the latest events of the user broadcasted by the pool, the latest event first, and the last event
+// of the user written to each of the clients subscribed to the user.
+func (p *Pool) TraceUser(userID string) ([]*serializer.EventTrace, []*serializer.ClientDelivery) {
+	p.eventsLock.Lock()
+	events := append([]*tracedEvent(nil), p.userEvents[userID]...)
+	p.eventsLock.Unlock()
+
+	results := make(chan []*serializer.ClientDelivery, len(p.shards))
+	for _, s := range p.shards {
+		s.do(func(s *shard) {
+			results <- s.traceUser(userID, events)
+		})
+	}
+
+	deliveries := []*serializer.ClientDelivery{}
+collect:
+	for range p.shards {
 		select {
-		case client := <-p.Register:
-			p.Clients[client] = true
-			api.LogInfo(fmt.Sprintf("Client added. Size of connection pool: %d", len(p.Clients)))
-		case client := <-p.Unregister:
-			delete(p.Clients, client)
-			api.LogInfo(fmt.Sprintf("Client removed. Size of connection pool: %d", len(p.Clients)))
-		case statusChangedEvent := <-p.Broadcast:
-			if len(p.Clients) == 0 {
-				api.LogInfo("No clients connected.")
-				break
+		case shardDeliveries := <-results:
+			deliveries = append(deliveries, shardDeliveries...)
+		case <-p.closed:
+			break collect
+		}
+	}
+
+	traces := make([]*serializer.EventTrace, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		traces = append(traces, events[i].trace)
+	}
+
+	return traces, deliveries
+}
+
+// LastEventID returns the ID of the latest broadcasted event.
+func (p *Pool) LastEventID() string {
+	if id, ok := p.lastEventID.Load().(string); ok {
+		return id
+	}
+
+	// No event has been broadcasted yet, so a client resuming from here receives all the events
+	return formatEventID(p.id, 0, p.startedAt)
+}
+
+func (p *Pool) newEvent(data *serializer.UserStatus, logicalTime uint64) *Event {
+	p.eventsLock.Lock()
+	defer p.eventsLock.Unlock()
+
+	p.sequence++
+	event := &Event{
+		ID:          formatEventID(p.id, p.sequence, logicalTime),
+		Data:        data,
+		sequence:    p.sequence,
+		logicalTime: logicalTime,
+	}
+
+	p.history = append(p.history, event)
+	if evicted := len(p.history) - HistorySize; evicted > 0 {
+		for _, e := range p.history[:evicted] {
+			if e.logicalTime > p.evictedTime {
+				p.evictedTime = e.logicalTime
 			}
-			api.LogInfo("Sending message to all clients in pool")
-			for client := range p.Clients {
-				if err := client.Conn.WriteJSON(statusChangedEvent); err != nil {
-					api.LogError("Error in broadcasting the status changed event.", "Error", err.Error())
-				}
+		}
+		p.history = p.history[evicted:]
+	}
+	p.lastEventID.Store(event.ID)
+
+	traced := append(p.userEvents[data.UserID], &tracedEvent{
+		sequence: event.sequence,
+		trace: &serializer.EventTrace{
+			ID:          event.ID,
+			Event:       event.Name(),
+			Email:       data.Email,
+			Status:      data.Status,
+			BroadcastAt: model.GetMillis(),
+		},
+	})
+	if len(traced) > TraceSize {
+		traced = traced[len(traced)-TraceSize:]
+	}
+	p.userEvents[data.UserID] = traced
+
+	return event
+}
+
+// eventsSince returns the events from the history which were broadcasted after the given event, along with the sequence
+// and the ID of the latest broadcasted event. It returns false if some of the events after the given event are not
+// in the history anymore, or were broadcasted by another server before this pool was started.
+func (p *Pool) eventsSince(lastEventID string) (events []*Event, latest uint64, latestID string, ok bool) {
+	p.eventsLock.Lock()
+	defer p.eventsLock.Unlock()
+
+	latestID = p.LastEventID()
+	if lastEventID == "" {
+		return nil, p.sequence, latestID, true
+	}
+
+	poolID, sequence, logicalTime, err := parseEventID(lastEventID)
+	if err != nil {
+		return nil, p.sequence, latestID, false
+	}
+
+	if poolID == p.id {
+		if sequence > p.sequence || (len(p.history) > 0 && sequence+1 < p.history[0].sequence) {
+			return nil, p.sequence, latestID, false
+		}
+
+		for _, event := range p.history {
+			if event.sequence > sequence {
+				events = append(events, event)
 			}
 		}
+		return events, p.sequence, latestID, true
 	}
+
+	if logicalTime < p.startedAt || logicalTime < p.evictedTime {
+		return nil, p.sequence, latestID, false
+	}
+
+	for _, event := range p.history {
+		if event.logicalTime > logicalTime {
+			events = append(events, event)
+		}
+	}
+	return events, p.sequence, latestID, true
+}
+
+func formatEventID(poolID string, sequence, logicalTime uint64) string {
+	return fmt.Sprintf("%s-%d-%d", poolID, sequence, logicalTime)
+}
+
+func parseEventID(id string) (poolID string, sequence, logicalTime uint64, err error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 {
+		return "", 0, 0, fmt.Errorf("invalid event ID %q", id)
+	}
+
+	if sequence, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return "", 0, 0, err
+	}
+	if logicalTime, err = strconv.ParseUint(parts[2], 10, 64); err != nil {
+		return "", 0, 0, err
+	}
+	return parts[0], sequence, logicalTime, nil
+}
+
+func (p *Pool) recordWriteError(err error) {
+	if errors.Is(err, errBufferFull) {
+		p.Metrics.IncEventsDropped()
+		return
+	}
+
+	p.Metrics.IncWriteErrors()
 }
@@ -0,0 +1,528 @@
+package websocket
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+const benchmarkClients = 10000
+
+// discardConn is a network connection which discards the written data, so that the benchmarks measure
+// the cost of serializing and framing the events rather than the cost of the network.
+type discardConn struct{}
+
+func (discardConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (discardConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+
+// hijackRecorder lets the upgrader take over a discardConn instead of a real connection.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn := discardConn{}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+func newBenchmarkConn(b testing.TB, protocol string) *websocket.Conn {
+	return newCompressedBenchmarkConn(b, protocol, CompressionSettings{})
+}
+
+// newCompressedBenchmarkConn creates a connection which negotiated the permessage-deflate compression if it is enabled.
+func newCompressedBenchmarkConn(b testing.TB, protocol string, compression CompressionSettings) *websocket.Conn {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Connection", "upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Version", "13")
+	r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-Websocket-Extensions", "permessage-deflate")
+	if protocol != "" {
+		r.Header.Set("Sec-Websocket-Protocol", protocol)
+	}
+
+	conn, err := CreateConnection(&hijackRecorder{httptest.NewRecorder()}, r, compression)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn
+}
+
+// noopAPI discards the logs of the pool
+type noopAPI struct {
+	plugin.API
+}
+
+func (noopAPI) LogDebug(msg string, keyValuePairs ...interface{}) {}
+func (noopAPI) LogInfo(msg string, keyValuePairs ...interface{})  {}
+func (noopAPI) LogError(msg string, keyValuePairs ...interface{}) {}
+
+// wait blocks until the shards have executed all the operations queued before it.
+func (p *Pool) wait() {
+	done := make(chan struct{}, len(p.shards))
+	for _, s := range p.shards {
+		s.do(func(s *shard) {
+			done <- struct{}{}
+		})
+	}
+	for range p.shards {
+		<-done
+	}
+}
+
+func newBenchmarkClient(pool *Pool, conn *websocket.Conn) *Client {
+	version := ProtocolVersion(conn)
+	writer := NewConnWriter(conn, version >= ProtocolVersion2, 0)
+	go func() {
+		_ = writer.Serve()
+	}()
+
+	return &Client{
+		ID:              model.NewId(),
+		Type:            ClientTypeWebsocket,
+		Conn:            conn,
+		Writer:          writer,
+		Pool:            pool,
+		ProtocolVersion: version,
+	}
+}
+
+// newBenchmarkPool creates a started pool with the given number of unscoped websocket clients.
+// Every nth client uses protocol version 2.
+func newBenchmarkPool(b *testing.B, clients, nth int) *Pool {
+	pool := NewPool("node", "version", nil)
+	pool.Start(noopAPI{})
+	for i := 0; i < clients; i++ {
+		protocol := protocolName(ProtocolVersion1)
+		if nth > 0 && i%nth == 0 {
+			protocol = protocolName(ProtocolVersion2)
+		}
+
+		pool.Register(newBenchmarkClient(pool, newBenchmarkConn(b, protocol)))
+	}
+	pool.wait()
+	return pool
+}
+
+func newBenchmarkStatus(userID string) *serializer.UserStatus {
+	return &serializer.UserStatus{
+		UserID: userID,
+		Email:  "user@example.com",
+		SIPURI: "sip:user@example.com",
+		Status: "online",
+	}
+}
+
+// BenchmarkFanOutWriteJSON is the baseline, which serializes the event separately for every client.
+func BenchmarkFanOutWriteJSON(b *testing.B) {
+	var conns []*websocket.Conn
+	for i := 0; i < benchmarkClients; i++ {
+		conns = append(conns, newBenchmarkConn(b, protocolName(ProtocolVersion1)))
+	}
+	status := newBenchmarkStatus(model.NewId())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, conn := range conns {
+			if err := conn.WriteJSON(status); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	pool := newBenchmarkPool(b, benchmarkClients, 0)
+	status := newBenchmarkStatus(model.NewId())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pool.Broadcast(status, uint64(i))
+		pool.wait()
+	}
+}
+
+// BenchmarkBroadcastMixedProtocols uses both the protocol versions, so every event is serialized twice.
+func BenchmarkBroadcastMixedProtocols(b *testing.B) {
+	pool := newBenchmarkPool(b, benchmarkClients, 2)
+	status := newBenchmarkStatus(model.NewId())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pool.Broadcast(status, uint64(i))
+		pool.wait()
+	}
+}
+
+// BenchmarkBroadcastCompressed compresses the events for all the clients, which is only done once per event.
+func BenchmarkBroadcastCompressed(b *testing.B) {
+	compression := CompressionSettings{Enabled: true, Level: flate.BestSpeed}
+	pool := NewPool("node", "version", nil)
+	pool.Start(noopAPI{})
+	for i := 0; i < benchmarkClients; i++ {
+		pool.Register(newBenchmarkClient(pool, newCompressedBenchmarkConn(b, protocolName(ProtocolVersion2), compression)))
+	}
+	pool.wait()
+	status := newBenchmarkStatus(model.NewId())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pool.Broadcast(status, uint64(i))
+		pool.wait()
+	}
+}
+
+// BenchmarkBroadcastScoped simulates a 50,000 user deployment where every client is scoped to a team of 500 users,
+// so a status change is only sent to the few clients subscribed to the user.
+func BenchmarkBroadcastScoped(b *testing.B) {
+	const users, teamSize = 50000, 500
+
+	userIDs := make([]string, users)
+	for i := range userIDs {
+		userIDs[i] = model.NewId()
+	}
+
+	pool := NewPool("node", "version", nil)
+	pool.Start(noopAPI{})
+	for i := 0; i < benchmarkClients; i++ {
+		client := newBenchmarkClient(pool, newBenchmarkConn(b, protocolName(ProtocolVersion2)))
+		client.Subscription = make(map[string]bool, teamSize)
+		team := (i * teamSize) % users
+		for _, userID := range userIDs[team : team+teamSize] {
+			client.Subscription[userID] = true
+		}
+		pool.Register(client)
+	}
+	pool.wait()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pool.Broadcast(newBenchmarkStatus(userIDs[i%users]), uint64(i))
+		pool.wait()
+	}
+}
+
+// BenchmarkRegisterUnregister measures the churn of the clients reconnecting to a pool of 10,000 clients.
+func BenchmarkRegisterUnregister(b *testing.B) {
+	pool := newBenchmarkPool(b, benchmarkClients, 0)
+	client := newBenchmarkClient(pool, newBenchmarkConn(b, protocolName(ProtocolVersion2)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pool.Register(client)
+		pool.Unregister(client)
+	}
+	pool.wait()
+}
+
+// newTestPool creates a pool started at the logical time 1000, which broadcasted events at the given logical times.
+func newTestPool(logicalTimes ...uint64) *Pool {
+	pool := NewShardedPool("node", "version", nil, 1)
+	pool.startedAt = 1000
+	for _, logicalTime := range logicalTimes {
+		pool.newEvent(newBenchmarkStatus(model.NewId()), logicalTime)
+	}
+	return pool
+}
+
+func TestPoolEventsSince(t *testing.T) {
+	pool := newTestPool(1001, 1002, 1003, 1004)
+	evicted := newTestPool()
+	for i := 0; i < HistorySize+2; i++ {
+		evicted.newEvent(newBenchmarkStatus(model.NewId()), uint64(1001+i))
+	}
+
+	for _, test := range []struct {
+		name        string
+		pool        *Pool
+		lastEventID string
+		sequences   []uint64
+		ok          bool
+	}{
+		{
+			name: "new client",
+			pool: pool,
+			ok:   true,
+		},
+		{
+			name:        "same pool",
+			pool:        pool,
+			lastEventID: formatEventID(pool.id, 2, 1002),
+			sequences:   []uint64{3, 4},
+			ok:          true,
+		},
+		{
+			name:        "same pool up to date",
+			pool:        pool,
+			lastEventID: formatEventID(pool.id, 4, 1004),
+			ok:          true,
+		},
+		{
+			name:        "same pool after the events were evicted",
+			pool:        evicted,
+			lastEventID: formatEventID(evicted.id, 1, 1001),
+		},
+		{
+			name:        "same pool with evicted events before the last event",
+			pool:        evicted,
+			lastEventID: formatEventID(evicted.id, HistorySize+1, 1000+HistorySize+1),
+			sequences:   []uint64{HistorySize + 2},
+			ok:          true,
+		},
+		{
+			name:        "sequence not broadcasted yet",
+			pool:        pool,
+			lastEventID: formatEventID(pool.id, 5, 1005),
+		},
+		{
+			name:        "another server",
+			pool:        pool,
+			lastEventID: formatEventID(model.NewId(), 42, 1002),
+			sequences:   []uint64{3, 4},
+			ok:          true,
+		},
+		{
+			name:        "another server before this pool was started",
+			pool:        pool,
+			lastEventID: formatEventID(model.NewId(), 42, 999),
+		},
+		{
+			name:        "another server before the evicted events",
+			pool:        evicted,
+			lastEventID: formatEventID(model.NewId(), 42, 1001),
+		},
+		{
+			name:        "event ID of an older version",
+			pool:        pool,
+			lastEventID: pool.id + "-2",
+		},
+		{
+			name:        "invalid event ID",
+			pool:        pool,
+			lastEventID: "invalid",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			events, latest, latestID, ok := test.pool.eventsSince(test.lastEventID)
+			if ok != test.ok {
+				t.Errorf("got ok %t, want %t", ok, test.ok)
+			}
+
+			var sequences []uint64
+			for _, event := range events {
+				sequences = append(sequences, event.sequence)
+			}
+			if fmt.Sprint(sequences) != fmt.Sprint(test.sequences) {
+				t.Errorf("got events %v, want %v", sequences, test.sequences)
+			}
+
+			if latest != test.pool.sequence || latestID != test.pool.LastEventID() {
+				t.Errorf("got latest event %d %q, want %d %q", latest, latestID, test.pool.sequence, test.pool.LastEventID())
+			}
+		})
+	}
+}
+
+// TestPoolRegisterReplay checks that the events are replayed by the caller rather than through the buffer of the client,
+// and that the replayed events are not sent again when they are broadcasted.
+func TestPoolRegisterReplay(t *testing.T) {
+	pool := NewShardedPool("node", "version", nil, 1)
+	pool.Start(noopAPI{})
+
+	subscribed := model.NewId()
+	var lastEventID string
+	for i := 0; i < 10; i++ {
+		userID := subscribed
+		if i%2 == 1 {
+			userID = model.NewId()
+		}
+		pool.Broadcast(newBenchmarkStatus(userID), uint64(model.GetMillis()))
+		if i == 0 {
+			lastEventID = pool.LastEventID()
+		}
+	}
+
+	writer := NewChannelWriter(1)
+	client := &Client{
+		ID:           model.NewId(),
+		Type:         ClientTypeSSE,
+		Writer:       writer,
+		Pool:         pool,
+		LastEventID:  lastEventID,
+		Subscription: map[string]bool{subscribed: true},
+	}
+	resume := pool.Register(client)
+	pool.wait()
+
+	if resume.Resync {
+		t.Fatal("the stream was not resumed")
+	}
+	if len(resume.Events) != 4 {
+		t.Errorf("got %d replayed events, want 4", len(resume.Events))
+	}
+	if resume.LastEventID != pool.LastEventID() {
+		t.Errorf("got last event ID %q, want %q", resume.LastEventID, pool.LastEventID())
+	}
+	if len(writer.Events()) != 0 {
+		t.Errorf("got %d events in the buffer, want 0", len(writer.Events()))
+	}
+}
+
+func TestConnWriterQueue(t *testing.T) {
+	writer := NewConnWriter(newBenchmarkConn(t, protocolName(ProtocolVersion2)), true, 0)
+	event := &Event{ID: "id", Data: newBenchmarkStatus(model.NewId())}
+
+	for i := 0; i < connQueueSize; i++ {
+		if err := writer.WriteEvent(event); err != nil {
+			t.Fatalf("frame %d was not queued: %s", i, err)
+		}
+	}
+	if err := writer.WriteEvent(event); err != errBufferFull {
+		t.Errorf("got error %v when the queue is full, want %v", err, errBufferFull)
+	}
+
+	_ = writer.Close()
+	if err := writer.WriteFrame(&serializer.ServerHello{}); err != errClosed {
+		t.Errorf("got error %v after closing the writer, want %v", err, errClosed)
+	}
+	if err := writer.Serve(); err != nil {
+		t.Errorf("got error %v when serving a closed writer", err)
+	}
+}
+
+// TestPoolDisconnectFullClient checks that a client which does not keep up with the events is disconnected
+// without blocking the pool.
+func TestPoolDisconnectFullClient(t *testing.T) {
+	pool := NewShardedPool("node", "version", nil, 1)
+	pool.Start(noopAPI{})
+
+	slow := NewChannelWriter(1)
+	fast := NewChannelWriter(HistorySize)
+	for _, writer := range []*ChannelWriter{slow, fast} {
+		pool.Register(&Client{ID: model.NewId(), Type: ClientTypeSSE, Writer: writer, Pool: pool})
+	}
+
+	for i := 0; i < 3; i++ {
+		pool.Broadcast(newBenchmarkStatus(model.NewId()), uint64(i))
+	}
+	pool.wait()
+
+	select {
+	case <-slow.Done():
+	default:
+		t.Error("the client with a full buffer was not disconnected")
+	}
+
+	select {
+	case <-fast.Done():
+		t.Error("the client keeping up with the events was disconnected")
+	default:
+	}
+	if len(fast.Events()) != 3 {
+		t.Errorf("got %d events for the other client, want 3", len(fast.Events()))
+	}
+}
+
+func TestPoolSubscribedUsers(t *testing.T) {
+	pool := NewShardedPool("node", "version", nil, 1)
+	pool.Start(noopAPI{})
+
+	member, other := model.NewId(), model.NewId()
+	for _, test := range []struct {
+		name         string
+		subscription map[string]bool
+		expected     map[string]bool
+	}{
+		{
+			name:     "unscoped client",
+			expected: map[string]bool{member: true, other: true},
+		},
+		{
+			name:         "scoped client",
+			subscription: map[string]bool{member: true},
+			expected:     map[string]bool{member: true},
+		},
+		{
+			name:         "empty scope",
+			subscription: map[string]bool{},
+			expected:     map[string]bool{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{ID: model.NewId(), Writer: NewChannelWriter(1), Pool: pool, Subscription: test.subscription}
+			pool.Register(client)
+			defer pool.Unregister(client)
+
+			if subscribed := pool.SubscribedUsers(client, []string{member, other}); fmt.Sprint(subscribed) != fmt.Sprint(test.expected) {
+				t.Errorf("got %v, want %v", subscribed, test.expected)
+			}
+		})
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	pool := NewShardedPool("node", "version", nil, 2)
+	pool.Start(noopAPI{})
+
+	writers := []*ChannelWriter{NewChannelWriter(1), NewChannelWriter(1)}
+	for _, writer := range writers {
+		pool.Register(&Client{ID: model.NewId(), Type: ClientTypeSSE, Writer: writer, Pool: pool})
+	}
+
+	pool.Close()
+	pool.Close()
+	for i, writer := range writers {
+		select {
+		case <-writer.Done():
+		default:
+			t.Errorf("client %d was not disconnected", i)
+		}
+	}
+
+	// The operations of a closed pool return without blocking
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*shardQueueSize; i++ {
+			pool.Broadcast(newBenchmarkStatus(model.NewId()), uint64(i))
+		}
+
+		writer := NewChannelWriter(1)
+		pool.Register(&Client{ID: model.NewId(), Type: ClientTypeSSE, Writer: writer, Pool: pool})
+		<-writer.Done()
+
+		if clients := pool.ListClients(); len(clients) != 0 {
+			t.Errorf("got %d clients after closing the pool, want 0", len(clients))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the operations of the closed pool are blocked")
+	}
+}
@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// RPCHandler handles the methods called by the websocket clients, other than ping which is handled by the pool.
+// The returned result is sent back to the client in the response frame. The statuses returned to a scoped client
+// must be restricted to the users to whom the client is subscribed.
+type RPCHandler interface {
+	HandleRPC(client *Client, method string, params json.RawMessage) (interface{}, *serializer.RPCError)
+}
+
+// handleRequest calls the requested method and sends the response to the client. The requests of a client are handled
+// one at a time by the goroutine reading from the client, so a slow request doesn't hold up the shard serving the client.
+func (c *Client) handleRequest(request *serializer.RPCRequest) {
+	response := &serializer.RPCResponse{
+		Type: serializer.FrameTypeResponse,
+		ID:   request.ID,
+	}
+
+	switch {
+	case request.ID == "":
+		response.Error = serializer.NewRPCError(serializer.RPCErrorBadRequest, "request id is required")
+	case request.Method == serializer.RPCMethodPing:
+		response.Result = &serializer.PingResult{
+			Node:       c.Pool.Node,
+			ServerTime: model.GetMillis(),
+		}
+	case c.Pool.RPCHandler == nil:
+		response.Error = serializer.NewRPCError(serializer.RPCErrorMethodNotFound, fmt.Sprintf("unknown method %q", request.Method))
+	default:
+		response.Result, response.Error = c.Pool.RPCHandler.HandleRPC(c, request.Method, request.Params)
+	}
+
+	c.Pool.reply(c, response)
+}
@@ -0,0 +1,31 @@
+package websocket
+
+// Scope restricts a client to the status changes of the members of a team, channel or group.
+// An empty scope means that the client receives the status changes of all the users.
+type Scope struct {
+	TeamID    string
+	ChannelID string
+	GroupID   string
+}
+
+// MembershipChange is sent to the pool whenever a user joins or leaves a team or channel,
+// so that the subscriptions of the clients scoped to that team or channel can be updated.
+type MembershipChange struct {
+	TeamID    string `json:"team_id,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+	UserID    string `json:"user_id"`
+	Joined    bool   `json:"joined"`
+}
+
+func (s Scope) IsEmpty() bool {
+	return s.TeamID == "" && s.ChannelID == "" && s.GroupID == ""
+}
+
+// Matches checks if the membership change affects the users in this scope.
+func (s Scope) Matches(change *MembershipChange) bool {
+	if change.TeamID != "" {
+		return s.TeamID == change.TeamID
+	}
+
+	return change.ChannelID != "" && s.ChannelID == change.ChannelID
+}
@@ -0,0 +1,381 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/plugin"
+
+	"github.com/mattermost/mattermost-plugin-outlook-presence/server/serializer"
+)
+
+// shardQueueSize is the number of operations which can be queued for a shard before the callers are blocked
+const shardQueueSize = 1024
+
+// shard serves a part of the clients of the pool. All the fields of the shard and of its clients
+// are only accessed by the goroutine running the shard, which executes the operations queued by the pool.
+type shard struct {
+	pool *Pool
+	ops  chan func(s *shard)
+
+	clients map[*Client]bool
+
+	// unscoped contains the clients receiving the status changes of all the users, while subscribers indexes
+	// the scoped clients by the IDs of the users in their subscriptions. This way, the cost of broadcasting
+	// a status change depends on the number of clients subscribed to the user rather than on the number of clients.
+	unscoped    map[*Client]bool
+	scoped      map[*Client]bool
+	subscribers map[string]map[*Client]bool
+
+	batchSettings BatchSettings
+	batchTicker   *time.Ticker
+
+	api plugin.API
+}
+
+func newShard(pool *Pool) *shard {
+	return &shard{
+		pool:          pool,
+		ops:           make(chan func(s *shard), shardQueueSize),
+		clients:       make(map[*Client]bool),
+		unscoped:      make(map[*Client]bool),
+		scoped:        make(map[*Client]bool),
+		subscribers:   make(map[string]map[*Client]bool),
+		batchSettings: BatchSettings{Interval: DefaultBatchInterval},
+	}
+}
+
+// do queues the operation to be executed by the goroutine running the shard. The operation is dropped
+// once the pool is closed.
+func (s *shard) do(op func(s *shard)) {
+	select {
+	case s.ops <- op:
+	case <-s.pool.closed:
+	}
+}
+
+func (s *shard) run(api plugin.API) {
+	s.api = api
+	s.batchTicker = time.NewTicker(s.batchSettings.Interval)
+	defer s.batchTicker.Stop()
+
+	for {
+		select {
+		case op := <-s.ops:
+			op(s)
+		case <-s.batchTicker.C:
+			s.flushBatches()
+		case <-s.pool.closed:
+			return
+		}
+	}
+}
+
+// register adds the client to the shard, and returns the events to replay for the client. The events are written
+// by the goroutine serving the client, and the events queued for the client by the shard are written after them.
+func (s *shard) register(client *Client) *Resume {
+	if s.clients[client] {
+		return &Resume{LastEventID: s.pool.LastEventID()}
+	}
+
+	// The events broadcasted before the client is registered might still be queued for the shard,
+	// so the replayed events are skipped when they are broadcasted.
+	events, latest, latestID, ok := s.pool.eventsSince(client.LastEventID)
+	resume := &Resume{
+		Resync:      !ok,
+		LastEventID: latestID,
+	}
+	client.replayedSequence = latest
+	client.startSequence = latest
+	if len(events) > 0 {
+		client.startSequence = events[0].sequence - 1
+	}
+	for _, event := range events {
+		if client.IsSubscribedTo(event.Data.UserID) {
+			resume.Events = append(resume.Events, event)
+			client.writtenSequence = event.sequence
+		}
+	}
+
+	s.clients[client] = true
+	if client.Subscription == nil {
+		s.unscoped[client] = true
+	} else {
+		s.scoped[client] = true
+		for userID := range client.Subscription {
+			s.subscribe(client, userID)
+		}
+	}
+
+	s.pool.Metrics.AddConnectedClients(client.Type, 1)
+	s.api.LogInfo(fmt.Sprintf("Client added. Size of connection pool shard: %d", len(s.clients)))
+	return resume
+}
+
+func (s *shard) unregister(client *Client) {
+	if !s.clients[client] {
+		return
+	}
+
+	delete(s.clients, client)
+	delete(s.unscoped, client)
+	delete(s.scoped, client)
+	for userID := range client.Subscription {
+		s.unsubscribe(client, userID)
+	}
+
+	s.pool.Metrics.AddConnectedClients(client.Type, -1)
+	s.api.LogInfo(fmt.Sprintf("Client removed. Size of connection pool shard: %d", len(s.clients)))
+}
+
+func (s *shard) subscribe(client *Client, userID string) {
+	clients, ok := s.subscribers[userID]
+	if !ok {
+		clients = make(map[*Client]bool)
+		s.subscribers[userID] = clients
+	}
+	clients[client] = true
+}
+
+func (s *shard) unsubscribe(client *Client, userID string) {
+	clients := s.subscribers[userID]
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(s.subscribers, userID)
+	}
+}
+
+func (s *shard) updateMembership(change *MembershipChange) {
+	for client := range s.scoped {
+		if !client.updateSubscription(change) {
+			continue
+		}
+
+		if change.Joined {
+			s.subscribe(client, change.UserID)
+		} else {
+			s.unsubscribe(client, change.UserID)
+		}
+	}
+}
+
+// broadcast sends the event to the subscribed clients, or adds it to the batches of the clients which enabled batching.
+// The event is serialized once for each frame format, and the serialized frames are shared by the clients.
+func (s *shard) broadcast(event *Event) {
+	start := time.Now()
+	for client := range s.unscoped {
+		s.send(client, event)
+	}
+	for client := range s.subscribers[event.Data.UserID] {
+		s.send(client, event)
+	}
+	s.pool.Metrics.ObserveFanOutDuration(time.Since(start))
+}
+
+func (s *shard) send(client *Client, event *Event) {
+	// The event was already sent while replaying the history for the client
+	if event.sequence <= client.replayedSequence {
+		return
+	}
+
+	if client.batch != nil {
+		if client.batch.add(event) {
+			s.pool.Metrics.IncEventsCoalesced()
+		}
+		return
+	}
+
+	if err := s.write(client, event); err != nil {
+		s.api.LogError("Error in broadcasting the status changed event.", "Error", err.Error())
+	}
+}
+
+// traceUser finds the last of the given events of the user which was written to each of the clients subscribed to the user.
+// The events are written to a client in order, so it is the latest event not newer than the last event written to the client.
+func (s *shard) traceUser(userID string, events []*tracedEvent) []*serializer.ClientDelivery {
+	var deliveries []*serializer.ClientDelivery
+	trace := func(client *Client) {
+		delivery := &serializer.ClientDelivery{
+			ClientID: client.ID,
+			Type:     client.Type,
+		}
+		if client.hello != nil {
+			delivery.ClientName = client.hello.ClientName
+		}
+
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].sequence <= client.startSequence {
+				break
+			}
+
+			if events[i].sequence <= client.writtenSequence {
+				delivery.Event = events[i].trace
+				break
+			}
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	for client := range s.unscoped {
+		trace(client)
+	}
+	for client := range s.subscribers[userID] {
+		trace(client)
+	}
+
+	return deliveries
+}
+
+func (s *shard) listClients() []*serializer.ClientInfo {
+	clients := make([]*serializer.ClientInfo, 0, len(s.clients))
+	for client := range s.clients {
+		clients = append(clients, client.info(s.pool.Node))
+	}
+	return clients
+}
+
+// disconnect closes the connection of the client, which is then unregistered by the goroutine serving the client.
+func (s *shard) disconnect(clientID string) bool {
+	for client := range s.clients {
+		if client.ID != clientID {
+			continue
+		}
+
+		if err := client.Writer.Close(); err != nil {
+			s.api.LogDebug("Error in closing the client connection.", "Error", err.Error())
+		}
+		return true
+	}
+
+	return false
+}
+
+// disconnectAll closes the connections of all the clients, which unregister themselves.
+func (s *shard) disconnectAll() {
+	for client := range s.clients {
+		if err := client.Writer.Close(); err != nil {
+			s.api.LogDebug("Error in closing the client connection.", "Error", err.Error())
+		}
+	}
+}
+
+func (s *shard) setBatchSettings(settings BatchSettings) {
+	s.batchSettings = settings
+	s.batchTicker.Reset(settings.Interval)
+}
+
+// hello records the details sent by the client, enables the requested capabilities and responds with the server's capabilities.
+func (s *shard) hello(client *Client, hello *serializer.ClientHello) {
+	if !s.clients[client] {
+		return
+	}
+
+	client.hello = hello
+	client.negotiateCapabilities(hello.Capabilities)
+
+	writer, ok := client.Writer.(*ConnWriter)
+	if !ok {
+		return
+	}
+
+	writer.Envelope = writer.Envelope || client.HasCapability(CapabilityEnvelope)
+	if client.HasCapability(CapabilityBatching) && client.batch == nil {
+		client.batch = newBatch(s.batchSettings, time.Now())
+	}
+
+	if err := writer.WriteFrame(&serializer.ServerHello{
+		Type:                      serializer.FrameTypeHello,
+		ProtocolVersion:           client.ProtocolVersion,
+		ServerVersion:             s.pool.ServerVersion,
+		Node:                      s.pool.Node,
+		ClientID:                  client.ID,
+		Capabilities:              Capabilities,
+		Enabled:                   client.enabledCapabilities(),
+		BatchIntervalMilliseconds: s.batchSettings.Interval.Milliseconds(),
+		MaxEventsPerSecond:        s.batchSettings.MaxEventsPerSecond,
+	}); err != nil {
+		s.api.LogError("Error in responding to the hello frame.", "Error", err.Error())
+	}
+}
+
+func (s *shard) reply(client *Client, response *serializer.RPCResponse) {
+	if !s.clients[client] {
+		return
+	}
+
+	writer, ok := client.Writer.(*ConnWriter)
+	if !ok {
+		return
+	}
+
+	if err := writer.WriteFrame(response); err != nil {
+		s.api.LogError("Error in sending the response to the request.", "Error", err.Error())
+	}
+}
+
+// flushBatches sends the accumulated events to the clients which enabled the batching capability.
+func (s *shard) flushBatches() {
+	now := time.Now()
+	for client := range s.clients {
+		if client.batch == nil {
+			continue
+		}
+
+		events := client.batch.take(s.batchSettings, now)
+		if len(events) == 0 {
+			continue
+		}
+
+		if err := s.writeBatch(client, events); err != nil {
+			s.api.LogError("Error in sending the batch of events.", "Error", err.Error())
+		}
+	}
+}
+
+func (s *shard) write(client *Client, event *Event) error {
+	if err := client.Writer.WriteEvent(event); err != nil {
+		s.writeFailed(client, err)
+		return err
+	}
+
+	client.messagesSent++
+	if event.sequence > client.writtenSequence {
+		client.writtenSequence = event.sequence
+	}
+	return nil
+}
+
+func (s *shard) writeBatch(client *Client, events []*Event) error {
+	writer, ok := client.Writer.(*ConnWriter)
+	if !ok {
+		return nil
+	}
+
+	if err := writer.WriteBatch(events); err != nil {
+		s.writeFailed(client, err)
+		return err
+	}
+
+	client.messagesSent += uint64(len(events))
+	for _, event := range events {
+		if event.sequence > client.writtenSequence {
+			client.writtenSequence = event.sequence
+		}
+	}
+	return nil
+}
+
+// writeFailed records the error in writing to the client. A client whose buffer is full can't keep up with the events,
+// so it is disconnected rather than missing events, and it resumes its stream when reconnecting if it can.
+func (s *shard) writeFailed(client *Client, err error) {
+	client.lastWriteError = err.Error()
+	s.pool.recordWriteError(err)
+
+	if errors.Is(err, errBufferFull) {
+		if closeErr := client.Writer.Close(); closeErr != nil {
+			s.api.LogDebug("Error in closing the client connection.", "Error", closeErr.Error())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// sseBufferSize is the number of events buffered for a Server-Sent Events client. Once the buffer is full,
+	// ChannelWriter.WriteEvent returns errBufferFull and the pool disconnects the client, which can resume its stream when reconnecting.
+	sseBufferSize = 256
+)
+
+// SSEWriter buffers the events for a Server-Sent Events client.
+// The events are written to the response by Serve, which runs in the goroutine handling the request.
+type SSEWriter struct {
+	*ChannelWriter
+}
+
+func NewSSEWriter() *SSEWriter {
+	return &SSEWriter{
+		ChannelWriter: NewChannelWriter(sseBufferSize),
+	}
+}
+
+// Serve streams the queued events to the client until the request is cancelled, sending a keepalive comment
+// whenever there are no events for the keepalive interval. The events replayed for the client are sent first,
+// preceded by a resync event if the client's stream could not be resumed.
+func (w *SSEWriter) Serve(rw http.ResponseWriter, r *http.Request, keepalive time.Duration, resume *Resume) error {
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+
+	flusher, _ := rw.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if resume.Resync {
+		if _, err := fmt.Fprintf(rw, "id: %s\nevent: %s\ndata: {}\n\n", resume.LastEventID, resyncEventName); err != nil {
+			return err
+		}
+	}
+	for _, event := range resume.Events {
+		if err := writeSSEEvent(rw, event); err != nil {
+			return err
+		}
+	}
+	flush()
+
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-w.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := fmt.Fprint(rw, ": keepalive\n\n"); err != nil {
+				return err
+			}
+			flush()
+		case event := <-w.events:
+			if err := writeSSEEvent(rw, event); err != nil {
+				return err
+			}
+			flush()
+		}
+	}
+}
+
+func writeSSEEvent(rw http.ResponseWriter, event *Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(rw, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Name(), data)
+	return err
+}
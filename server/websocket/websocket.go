@@ -1,23 +1,111 @@
 package websocket
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/websocket"
 	"github.com/mattermost/mattermost-server/v6/model"
 )
 
+const (
+	// protocolPrefix is followed by the protocol version in the subprotocols requested using the Sec-WebSocket-Protocol header
+	protocolPrefix = "outlook-presence.v"
+
+	// ProtocolVersionLegacy is used by the clients which don't request a protocol version. Like version 1,
+	// the status changes are sent as plain JSON objects.
+	ProtocolVersionLegacy = 0
+	ProtocolVersion1      = 1
+
+	// ProtocolVersion2 wraps every frame sent by the server in an envelope containing the type of the frame
+	ProtocolVersion2 = 2
+)
+
+// Capabilities which can be enabled by a client using the hello frame
+const (
+	CapabilityEnvelope = "envelope"
+	CapabilityBatching = "batching"
+	CapabilityRPC      = "rpc"
+)
+
+// Capabilities contains all the capabilities supported by the server
+var Capabilities = []string{
+	CapabilityEnvelope,
+	CapabilityBatching,
+	CapabilityRPC,
+}
+
+// The preferred protocol version comes first, as the first subprotocol supported by both sides is selected
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  model.SocketMaxMessageSizeKb,
 	WriteBufferSize: model.SocketMaxMessageSizeKb,
 	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    []string{protocolName(ProtocolVersion2), protocolName(ProtocolVersion1)},
+}
+
+// CompressionSettings configures the permessage-deflate compression of the frames sent to the websocket clients
+type CompressionSettings struct {
+	Enabled bool
+
+	// Level is the compress/flate compression level
+	Level int
+
+	// Threshold is the size in bytes below which the frames are sent uncompressed, as compressing them is not worth the CPU time
+	Threshold int
+}
+
+// ErrUnsupportedProtocol is returned when a client requests only the protocol versions which are not supported
+var ErrUnsupportedProtocol = errors.New("none of the requested protocol versions are supported")
+
+func protocolName(version int) string {
+	return protocolPrefix + strconv.Itoa(version)
 }
 
-func CreateConnection(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+// ProtocolVersion returns the protocol version negotiated with the client
+func ProtocolVersion(conn *websocket.Conn) int {
+	version, err := strconv.Atoi(strings.TrimPrefix(conn.Subprotocol(), protocolPrefix))
+	if err != nil {
+		return ProtocolVersionLegacy
+	}
+
+	return version
+}
+
+// CreateConnection upgrades the request to a websocket connection. The permessage-deflate compression is used
+// if it is enabled in the settings and is supported by the client.
+func CreateConnection(w http.ResponseWriter, r *http.Request, compression CompressionSettings) (*websocket.Conn, error) {
+	// Reject the clients requesting only unsupported protocol versions, as they would not understand the frames sent to them
+	if requested := websocket.Subprotocols(r); len(requested) > 0 && !isProtocolSupported(requested) {
+		return nil, ErrUnsupportedProtocol
+	}
+
+	u := upgrader
+	u.EnableCompression = compression.Enabled
+	ws, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if compression.Enabled {
+		if err = ws.SetCompressionLevel(compression.Level); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+
 	return ws, nil
 }
+
+func isProtocolSupported(requested []string) bool {
+	for _, protocol := range requested {
+		for _, supported := range upgrader.Subprotocols {
+			if protocol == supported {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -2,6 +2,7 @@ import {ActionFunc, DispatchFunc} from 'mattermost-redux/types/actions';
 import {logError} from 'mattermost-redux/actions/errors';
 
 import Client from 'client';
+import Constants from '../constants';
 
 const receivedStatusChangedEvent = (data: any): ActionFunc => {
     return async (dispatch: DispatchFunc) => {
@@ -16,6 +17,16 @@ const receivedStatusChangedEvent = (data: any): ActionFunc => {
     };
 };
 
+const openPresenceSharingModal = () => ({
+    type: Constants.OPEN_PRESENCE_SHARING_MODAL,
+});
+
+const closePresenceSharingModal = () => ({
+    type: Constants.CLOSE_PRESENCE_SHARING_MODAL,
+});
+
 export default {
     receivedStatusChangedEvent,
+    openPresenceSharingModal,
+    closePresenceSharingModal,
 };
@@ -7,6 +7,48 @@ interface StatusChangedEvent {
     status: string;
 }
 
+export interface ClientInfo {
+    id: string;
+    node: string;
+    type: string;
+    remote_addr: string;
+    user_agent: string;
+    credential: string;
+    team_id?: string;
+    channel_id?: string;
+    group_id?: string;
+    protocol_version: number;
+    client_name?: string;
+    client_version?: string;
+    os?: string;
+    machine_id?: string;
+    capabilities?: string[];
+    subscription_size: number;
+    connected_at: number;
+    messages_sent: number;
+    last_write_error?: string;
+}
+
+export interface NodeSummary {
+    node: string;
+    clients: number;
+    clients_by_type: Record<string, number>;
+    clients_by_version: Record<string, number>;
+    updated_at: number;
+}
+
+export interface ClusterSummary {
+    clients: number;
+    clients_by_type: Record<string, number>;
+    clients_by_version: Record<string, number>;
+    nodes: NodeSummary[];
+}
+
+export interface PresencePreference {
+    opted_out: boolean;
+    update_at?: number;
+}
+
 export default class Client {
     url: URL;
     baseUrl: string;
@@ -39,6 +81,59 @@ export default class Client {
         });
     }
 
+    getClientsRoute() {
+        return `${this.pluginApiUrl}/clients`;
+    }
+
+    getClients = async (): Promise<ClientInfo[]> => {
+        const response = await this.doGet(this.getClientsRoute());
+        return response.data;
+    }
+
+    getClientsSummary = async (): Promise<ClusterSummary> => {
+        const response = await this.doGet(`${this.getClientsRoute()}/summary`);
+        return response.data;
+    }
+
+    disconnectClient = (clientId: string) => {
+        return this.doDelete(`${this.getClientsRoute()}/${clientId}`);
+    }
+
+    getPresencePreferenceRoute() {
+        return `${this.pluginApiUrl}/me/preference`;
+    }
+
+    getPresencePreference = async (): Promise<PresencePreference> => {
+        const response = await this.doGet(this.getPresencePreferenceRoute());
+        return response.data;
+    }
+
+    updatePresencePreference = async (optedOut: boolean): Promise<PresencePreference> => {
+        const response = await this.doPut(this.getPresencePreferenceRoute(), {opted_out: optedOut});
+        return response.data;
+    }
+
+    // The server requires the CSRF token for the requests made using the session cookie
+    getCSRFHeaders = () => {
+        const token = document.cookie.replace(/(?:(?:^|.*;\s*)MMCSRF\s*=\s*([^;]*).*$)|^.*$/, '$1');
+        return {
+            'X-Requested-With': 'XMLHttpRequest',
+            'X-CSRF-Token': token,
+        };
+    }
+
+    doGet = async (url: string, headers: any = {}): Promise<AxiosResponse<any, any>> => {
+        return this.client.get(url, {headers: {...this.getCSRFHeaders(), ...headers}});
+    };
+
+    doDelete = async (url: string, headers: any = {}): Promise<AxiosResponse<any, any>> => {
+        return this.client.delete(url, {headers: {...this.getCSRFHeaders(), ...headers}});
+    };
+
+    doPut = async (url: string, body: any, headers: any = {}): Promise<AxiosResponse<any, any>> => {
+        return this.client.put(url, body, {headers: {...this.getCSRFHeaders(), ...headers}});
+    };
+
     doPost = async (url: string, body: any, headers: any = {}): Promise<AxiosResponse<any, any>> => {
         return this.client.post(url, body, {headers});
     };
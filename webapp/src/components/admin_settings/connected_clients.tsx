@@ -0,0 +1,145 @@
+import React, {useCallback, useEffect, useState} from 'react';
+
+import Client from 'client';
+import {ClientInfo, ClusterSummary} from 'client/client';
+
+const ConnectedClients = () => {
+    const [clients, setClients] = useState<ClientInfo[]>([]);
+    const [summary, setSummary] = useState<ClusterSummary | null>(null);
+    const [loading, setLoading] = useState(false);
+    const [error, setError] = useState('');
+
+    const loadClients = useCallback(async () => {
+        setLoading(true);
+        setError('');
+        try {
+            const [clientsResponse, summaryResponse] = await Promise.all([Client.getClients(), Client.getClientsSummary()]);
+            setClients(clientsResponse);
+            setSummary(summaryResponse);
+        } catch (err: any) {
+            setError(err.message);
+        }
+        setLoading(false);
+    }, []);
+
+    const disconnectClient = useCallback(async (clientId: string) => {
+        try {
+            await Client.disconnectClient(clientId);
+        } catch (err: any) {
+            setError(err.message);
+            return;
+        }
+        setClients((current) => current.filter((client) => client.id !== clientId));
+    }, []);
+
+    useEffect(() => {
+        loadClients();
+    }, [loadClients]);
+
+    return (
+        <div>
+            <button
+                className='btn btn-default'
+                onClick={loadClients}
+                disabled={loading}
+            >
+                {'Refresh'}
+            </button>
+            {error && <div className='error-text'>{error}</div>}
+            {summary && (
+                <div>
+                    <p>{`${summary.clients} clients connected to ${summary.nodes.length} servers. ${formatCounts(summary.clients_by_type)}`}</p>
+                    <ul>
+                        {summary.nodes.map((node) => (
+                            <li key={node.node}>
+                                {`${node.node}: ${node.clients} clients (${formatCounts(node.clients_by_version)}), updated at ${new Date(node.updated_at).toLocaleTimeString()}`}
+                            </li>
+                        ))}
+                    </ul>
+                </div>
+            )}
+            <table className='table'>
+                <thead>
+                    <tr>
+                        <th>{'Server'}</th>
+                        <th>{'Type'}</th>
+                        <th>{'Client'}</th>
+                        <th>{'Remote address'}</th>
+                        <th>{'User agent'}</th>
+                        <th>{'Credential'}</th>
+                        <th>{'Scope'}</th>
+                        <th>{'Connected at'}</th>
+                        <th>{'Messages sent'}</th>
+                        <th>{'Last write error'}</th>
+                        <th/>
+                    </tr>
+                </thead>
+                <tbody>
+                    {clients.length === 0 && (
+                        <tr>
+                            <td colSpan={11}>{loading ? 'Loading...' : 'No clients connected.'}</td>
+                        </tr>
+                    )}
+                    {clients.map((client) => (
+                        <tr key={client.id}>
+                            <td>{client.node}</td>
+                            <td>{client.type}</td>
+                            <td>{getClientDetails(client)}</td>
+                            <td>{client.remote_addr}</td>
+                            <td>{client.user_agent}</td>
+                            <td>{client.credential}</td>
+                            <td>{getScope(client)}</td>
+                            <td>{new Date(client.connected_at).toLocaleString()}</td>
+                            <td>{client.messages_sent}</td>
+                            <td>{client.last_write_error}</td>
+                            <td>
+                                <button
+                                    className='btn btn-danger'
+                                    onClick={() => disconnectClient(client.id)}
+                                >
+                                    {'Disconnect'}
+                                </button>
+                            </td>
+                        </tr>
+                    ))}
+                </tbody>
+            </table>
+        </div>
+    );
+};
+
+const formatCounts = (counts: Record<string, number>) => {
+    return Object.entries(counts).map(([name, count]) => `${name}: ${count}`).join(', ');
+};
+
+const getClientDetails = (client: ClientInfo) => {
+    const details = [`Protocol v${client.protocol_version}`];
+    if (client.client_name) {
+        details.push(`${client.client_name} ${client.client_version || ''}`.trim());
+    }
+    if (client.os) {
+        details.push(client.os);
+    }
+    if (client.machine_id) {
+        details.push(`Machine ${client.machine_id}`);
+    }
+    return details.join(', ');
+};
+
+const getScope = (client: ClientInfo) => {
+    let scope = 'All users';
+    if (client.team_id) {
+        scope = `Team ${client.team_id}`;
+    } else if (client.channel_id) {
+        scope = `Channel ${client.channel_id}`;
+    } else if (client.group_id) {
+        scope = `Group ${client.group_id}`;
+    }
+
+    if (client.subscription_size >= 0) {
+        scope += ` (${client.subscription_size} users)`;
+    }
+    return scope;
+};
+
+export default ConnectedClients;
@@ -0,0 +1,102 @@
+import React, {useCallback, useEffect, useState} from 'react';
+import {useDispatch, useSelector} from 'react-redux';
+
+import {GlobalState} from 'mattermost-redux/types/store';
+
+import Client from 'client';
+
+import manifest from '../manifest';
+import Actions from '../actions';
+
+// PresenceSharingModal lets the current user choose whether their presence is shared with the external clients
+const PresenceSharingModal = () => {
+    const visible = useSelector((state: GlobalState) => (state as any)[`plugins-${manifest.id}`]?.presenceSharingModalVisible);
+    const dispatch = useDispatch();
+    const [optedOut, setOptedOut] = useState(false);
+    const [saving, setSaving] = useState(false);
+    const [error, setError] = useState('');
+
+    useEffect(() => {
+        if (!visible) {
+            return;
+        }
+
+        setError('');
+        Client.getPresencePreference().then((preference) => {
+            setOptedOut(preference.opted_out);
+        }).catch((err: any) => {
+            setError(err.message);
+        });
+    }, [visible]);
+
+    const close = useCallback(() => {
+        dispatch(Actions.closePresenceSharingModal());
+    }, [dispatch]);
+
+    const save = useCallback(async () => {
+        setSaving(true);
+        setError('');
+        try {
+            await Client.updatePresencePreference(optedOut);
+        } catch (err: any) {
+            setError(err.message);
+            setSaving(false);
+            return;
+        }
+        setSaving(false);
+        close();
+    }, [optedOut, close]);
+
+    if (!visible) {
+        return null;
+    }
+
+    return (
+        <>
+            <div className='modal-backdrop fade in'/>
+            <div
+                className='modal fade in'
+                style={{display: 'block'}}
+                role='dialog'
+            >
+                <div className='modal-dialog'>
+                    <div className='modal-content'>
+                        <div className='modal-header'>
+                            <h4 className='modal-title'>{'Presence sharing'}</h4>
+                        </div>
+                        <div className='modal-body'>
+                            <div className='checkbox'>
+                                <label>
+                                    <input
+                                        type='checkbox'
+                                        checked={!optedOut}
+                                        onChange={(e) => setOptedOut(!e.target.checked)}
+                                    />
+                                    {'Share my presence with Outlook and the other external clients'}
+                                </label>
+                            </div>
+                            {error && <div className='error-text'>{error}</div>}
+                        </div>
+                        <div className='modal-footer'>
+                            <button
+                                className='btn btn-link'
+                                onClick={close}
+                            >
+                                {'Cancel'}
+                            </button>
+                            <button
+                                className='btn btn-primary'
+                                onClick={save}
+                                disabled={saving}
+                            >
+                                {'Save'}
+                            </button>
+                        </div>
+                    </div>
+                </div>
+            </div>
+        </>
+    );
+};
+
+export default PresenceSharingModal;
@@ -1,7 +1,13 @@
 const PLUGIN_NAME = 'com.mattermost.outlook-presence';
 const STATUS_CHANGED = 'status_change';
+const CONNECTED_CLIENTS_SETTING = 'ConnectedClients';
+const OPEN_PRESENCE_SHARING_MODAL = 'OPEN_PRESENCE_SHARING_MODAL';
+const CLOSE_PRESENCE_SHARING_MODAL = 'CLOSE_PRESENCE_SHARING_MODAL';
 
 export default {
     PLUGIN_NAME,
     STATUS_CHANGED,
+    CONNECTED_CLIENTS_SETTING,
+    OPEN_PRESENCE_SHARING_MODAL,
+    CLOSE_PRESENCE_SHARING_MODAL,
 };
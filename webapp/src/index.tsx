@@ -6,6 +6,9 @@ import manifest from './manifest';
 
 import Constants from './constants';
 import Actions from './actions';
+import reducer from './reducers';
+import ConnectedClients from './components/admin_settings/connected_clients';
+import PresenceSharingModal from './components/presence_sharing_modal';
 
 // eslint-disable-next-line import/no-unresolved
 import {PluginRegistry} from './types/mattermost-webapp';
@@ -16,6 +19,12 @@ export default class Plugin {
         registry.registerWebSocketEventHandler(Constants.STATUS_CHANGED, (event: any) => {
             store.dispatch(Actions.receivedStatusChangedEvent(event.data));
         });
+
+        registry.registerAdminConsoleCustomSetting(Constants.CONNECTED_CLIENTS_SETTING, ConnectedClients, {showTitle: true});
+
+        registry.registerReducer(reducer);
+        registry.registerRootComponent(PresenceSharingModal);
+        registry.registerMainMenuAction('Presence sharing', () => store.dispatch(Actions.openPresenceSharingModal()));
     }
 }
 
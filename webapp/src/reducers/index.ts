@@ -0,0 +1,18 @@
+import {combineReducers} from 'redux';
+
+import Constants from '../constants';
+
+const presenceSharingModalVisible = (state = false, action: {type: string}) => {
+    switch (action.type) {
+    case Constants.OPEN_PRESENCE_SHARING_MODAL:
+        return true;
+    case Constants.CLOSE_PRESENCE_SHARING_MODAL:
+        return false;
+    default:
+        return state;
+    }
+};
+
+export default combineReducers({
+    presenceSharingModalVisible,
+});
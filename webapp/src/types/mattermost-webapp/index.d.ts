@@ -1,6 +1,12 @@
+import {Reducer} from 'redux';
+
 export interface PluginRegistry {
     registerPostTypeComponent(typeName: string, component: React.ElementType)
     registerWebSocketEventHandler(event: string, handler: (msg: any) => void)
+    registerAdminConsoleCustomSetting(key: string, component: React.ElementType, options?: {showTitle: boolean})
+    registerRootComponent(component: React.ElementType)
+    registerMainMenuAction(text: React.ReactNode, action: () => void, mobileIcon?: React.ReactNode)
+    registerReducer(reducer: Reducer)
 
     // Add more if needed from https://developers.mattermost.com/extend/plugins/webapp/reference
 }